@@ -0,0 +1,270 @@
+package automation
+
+import (
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jgulick48/rv-homekit/internal/bmv"
+	"github.com/jgulick48/rv-homekit/internal/models"
+	"github.com/jgulick48/rv-homekit/internal/storage"
+)
+
+const (
+	fullStateOfCharge   = 99.5
+	minDischargeDepth   = 5
+	maxIntegrationGap   = time.Minute
+	healthSaveInterval  = 10 * time.Minute
+	capacitySampleCount = 5
+	maxCapacitySamples  = 20
+	maxDischargeRecords = 100
+)
+
+type DischargeRecord struct {
+	StartedAt int64   `json:"startedAt"`
+	EndedAt   int64   `json:"endedAt"`
+	Depth     float64 `json:"depth"`
+	AmpHours  float64 `json:"ampHours"`
+}
+
+// HealthState is the persisted battery history. DeepestDischarge is a
+// percentage of capacity and TotalAhDrawn is the lifetime discharge throughput.
+type HealthState struct {
+	ChargeCycles     float64           `json:"chargeCycles"`
+	FullDischarges   float64           `json:"fullDischarges"`
+	DeepestDischarge float64           `json:"deepestDischarge"`
+	TotalAhDrawn     float64           `json:"totalAhDrawn"`
+	CapacitySamples  []float64         `json:"capacitySamples"`
+	Discharges       []DischargeRecord `json:"discharges"`
+	LastFullCharge   int64             `json:"lastFullCharge"`
+	Discharging      bool              `json:"discharging"`
+	DischargeStart   int64             `json:"dischargeStart"`
+	MinSOC           float64           `json:"minSOC"`
+	MaxConsumed      float64           `json:"maxConsumed"`
+	ReachedEmpty     bool              `json:"reachedEmpty"`
+}
+
+func (s *HealthState) LoadFromFile(filename string) {
+	if filename == "" {
+		filename = storage.Path("batteryHealth.json")
+	}
+	err := storage.ReadJSON(filename, &s)
+	if os.IsNotExist(err) {
+		log.Printf("No battery health history found. Starting new.")
+	} else if err != nil {
+		log.Printf("Invalid battery health file provided")
+	}
+}
+
+func (s *HealthState) SaveToFile(filename string) {
+	if filename == "" {
+		filename = storage.Path("batteryHealth.json")
+	}
+	if err := storage.WriteJSON(filename, s); err != nil {
+		log.Printf("Error saving %s: %s", filename, err)
+	}
+}
+
+// HealthTracker follows the battery through charge and discharge cycles. When
+// the battery source reports its own history counters those are used for
+// cycles, full discharges and throughput, otherwise they are counted here.
+type HealthTracker struct {
+	config     models.BatteryHealth
+	bmvClient  bmv.Client
+	history    bmv.HistoryProvider
+	state      HealthState
+	stateFile  string
+	lastSaved  time.Time
+	lastUpdate time.Time
+	mutex      sync.Mutex
+}
+
+func NewHealthTracker(config models.BatteryHealth, client bmv.Client) *HealthTracker {
+	var state HealthState
+	state.LoadFromFile("")
+	tracker := &HealthTracker{
+		config:    config,
+		bmvClient: client,
+		state:     state,
+	}
+	if provider, ok := client.(bmv.HistoryProvider); ok {
+		tracker.history = provider
+	}
+	return tracker
+}
+
+func (t *HealthTracker) Start() {
+	ticker := time.NewTicker(time.Second * 10)
+	go func() {
+		for range ticker.C {
+			t.update(time.Now())
+		}
+	}()
+}
+
+func (t *HealthTracker) update(now time.Time) {
+	soc, ok := t.bmvClient.GetBatteryStateOfCharge()
+	if !ok {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	changed := false
+	history, hasHistory := bmv.History{}, false
+	if t.history != nil {
+		history, hasHistory = t.history.GetHistory()
+	}
+	if hasHistory {
+		t.state.ChargeCycles = history.ChargeCycles
+		t.state.FullDischarges = history.FullDischarges
+		t.state.TotalAhDrawn = history.TotalAhDrawn
+	} else if current, ok := t.bmvClient.GetBatteryCurrent(); ok && current < 0 && !t.lastUpdate.IsZero() {
+		elapsed := now.Sub(t.lastUpdate)
+		if elapsed > 0 && elapsed <= maxIntegrationGap {
+			t.state.TotalAhDrawn += -current * elapsed.Hours()
+		}
+	}
+	t.lastUpdate = now
+	consumed, hasConsumed := t.bmvClient.GetConsumedAmpHours()
+	consumed = math.Abs(consumed)
+
+	if soc >= fullStateOfCharge {
+		if t.state.Discharging {
+			t.endDischarge(now, hasHistory)
+			changed = true
+		}
+		t.state.LastFullCharge = now.Unix()
+		t.state.ReachedEmpty = false
+	} else {
+		if !t.state.Discharging {
+			t.state.Discharging = true
+			t.state.DischargeStart = now.Unix()
+			t.state.MinSOC = soc
+			t.state.MaxConsumed = 0
+			t.state.ReachedEmpty = false
+			changed = true
+		}
+		if soc < t.state.MinSOC {
+			t.state.MinSOC = soc
+		}
+		if hasConsumed && consumed > t.state.MaxConsumed {
+			t.state.MaxConsumed = consumed
+		}
+		if voltage, ok := t.bmvClient.GetBatteryVoltage(); ok && t.config.EmptyVoltage > 0 && voltage <= t.config.EmptyVoltage && !t.state.ReachedEmpty {
+			t.state.ReachedEmpty = true
+			if !hasHistory {
+				t.state.FullDischarges++
+			}
+			if t.state.LastFullCharge > 0 && hasConsumed && consumed > 0 {
+				t.addCapacitySample(consumed)
+				log.Printf("Battery reached empty voltage of %vV after %.1fAh since the last full charge.", voltage, consumed)
+			}
+			changed = true
+		}
+	}
+	if changed || now.Sub(t.lastSaved) >= healthSaveInterval {
+		t.state.SaveToFile(t.stateFile)
+		t.lastSaved = now
+	}
+}
+
+// endDischarge records the discharge that ended with a full charge. Caller must
+// hold the mutex.
+func (t *HealthTracker) endDischarge(now time.Time, hasHistory bool) {
+	t.state.Discharging = false
+	depth := fullStateOfCharge - t.state.MinSOC
+	if depth < minDischargeDepth {
+		return
+	}
+	depth = 100 - t.state.MinSOC
+	t.state.Discharges = append(t.state.Discharges, DischargeRecord{
+		StartedAt: t.state.DischargeStart,
+		EndedAt:   now.Unix(),
+		Depth:     depth,
+		AmpHours:  t.state.MaxConsumed,
+	})
+	if len(t.state.Discharges) > maxDischargeRecords {
+		t.state.Discharges = t.state.Discharges[len(t.state.Discharges)-maxDischargeRecords:]
+	}
+	if depth > t.state.DeepestDischarge {
+		t.state.DeepestDischarge = depth
+	}
+	if !hasHistory {
+		t.state.ChargeCycles++
+	}
+	log.Printf("Battery charged to full after a %.1f%% discharge of %.1fAh.", depth, t.state.MaxConsumed)
+}
+
+func (t *HealthTracker) addCapacitySample(ampHours float64) {
+	t.state.CapacitySamples = append(t.state.CapacitySamples, ampHours)
+	if len(t.state.CapacitySamples) > maxCapacitySamples {
+		t.state.CapacitySamples = t.state.CapacitySamples[len(t.state.CapacitySamples)-maxCapacitySamples:]
+	}
+}
+
+func (t *HealthTracker) GetState() HealthState {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	state := t.state
+	state.CapacitySamples = append([]float64{}, t.state.CapacitySamples...)
+	state.Discharges = append([]DischargeRecord{}, t.state.Discharges...)
+	return state
+}
+
+// EstimatedCapacity returns the average of the most recent capacity samples in
+// amp hours.
+func (t *HealthTracker) EstimatedCapacity() (float64, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	samples := t.state.CapacitySamples
+	if len(samples) == 0 {
+		return 0, false
+	}
+	if len(samples) > capacitySampleCount {
+		samples = samples[len(samples)-capacitySampleCount:]
+	}
+	total := float64(0)
+	for _, sample := range samples {
+		total += sample
+	}
+	return total / float64(len(samples)), true
+}
+
+func (t *HealthTracker) StateOfHealth() (float64, bool) {
+	if t.config.RatedCapacity <= 0 {
+		return 0, false
+	}
+	capacity, ok := t.EstimatedCapacity()
+	if !ok {
+		return 0, false
+	}
+	return capacity / t.config.RatedCapacity * 100, true
+}
+
+// EquivalentCycles returns the lifetime throughput as a number of full cycles
+// of the rated capacity.
+func (t *HealthTracker) EquivalentCycles() (float64, bool) {
+	if t.config.RatedCapacity <= 0 {
+		return 0, false
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.state.TotalAhDrawn / t.config.RatedCapacity, true
+}
+
+// AverageDischarge returns the average depth of the recorded discharges as a
+// percentage.
+func (t *HealthTracker) AverageDischarge() (float64, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.state.Discharges) == 0 {
+		return 0, false
+	}
+	total := float64(0)
+	for _, record := range t.state.Discharges {
+		total += record.Depth
+	}
+	return total / float64(len(t.state.Discharges)), true
+}
@@ -0,0 +1,112 @@
+package automation
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/jgulick48/rv-homekit/internal/bmv"
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+type historyClient struct {
+	*bmv.MockClient
+	history bmv.History
+}
+
+func (h historyClient) GetHistory() (bmv.History, bool) {
+	return h.history, true
+}
+
+type HealthTrackerTest struct {
+	suite.Suite
+	bmvClient *bmv.MockClient
+	tracker   *HealthTracker
+}
+
+func (s *HealthTrackerTest) SetupTest() {
+	s.bmvClient = &bmv.MockClient{}
+	s.tracker = &HealthTracker{
+		config: models.BatteryHealth{
+			Enabled:       true,
+			RatedCapacity: 200,
+			EmptyVoltage:  12,
+		},
+		bmvClient: s.bmvClient,
+		stateFile: filepath.Join(s.T().TempDir(), "batteryHealth.json"),
+	}
+}
+
+func (s *HealthTrackerTest) setBattery(soc, current, voltage, consumed float64) {
+	s.bmvClient.ExpectedCalls = nil
+	s.bmvClient.On("GetBatteryStateOfCharge").Return(soc, true)
+	s.bmvClient.On("GetBatteryCurrent").Return(current, true)
+	s.bmvClient.On("GetBatteryVoltage").Return(voltage, true)
+	s.bmvClient.On("GetConsumedAmpHours").Return(consumed, true)
+}
+
+func (s *HealthTrackerTest) Test_TracksCycleAndCapacity() {
+	now := time.Now()
+	s.setBattery(100, 0, 13.4, 0)
+	s.tracker.update(now)
+	s.setBattery(80, -60, 13.1, -60)
+	s.tracker.update(now.Add(time.Minute))
+	s.tracker.update(now.Add(2 * time.Minute))
+	s.Assert().InDelta(2, s.tracker.GetState().TotalAhDrawn, 0.001)
+
+	s.setBattery(10, -20, 11.9, -180)
+	s.tracker.update(now.Add(3 * time.Minute))
+	s.tracker.update(now.Add(4 * time.Minute))
+	state := s.tracker.GetState()
+	s.Assert().Equal(float64(1), state.FullDischarges)
+	s.Assert().Equal([]float64{180}, state.CapacitySamples)
+	health, ok := s.tracker.StateOfHealth()
+	s.Assert().True(ok)
+	s.Assert().Equal(float64(90), health)
+
+	s.setBattery(100, 30, 13.6, 0)
+	s.tracker.update(now.Add(5 * time.Hour))
+	state = s.tracker.GetState()
+	s.Assert().Equal(float64(1), state.ChargeCycles)
+	s.Assert().Equal(float64(90), state.DeepestDischarge)
+	s.Assert().Len(state.Discharges, 1)
+	s.Assert().Equal(float64(180), state.Discharges[0].AmpHours)
+
+	loaded := HealthState{}
+	loaded.LoadFromFile(s.tracker.stateFile)
+	s.Assert().Equal(state.ChargeCycles, loaded.ChargeCycles)
+	s.Assert().Equal(state.CapacitySamples, loaded.CapacitySamples)
+}
+
+func (s *HealthTrackerTest) Test_SavesWhileFullOnInterval() {
+	now := time.Now()
+	s.setBattery(100, 0, 13.4, 0)
+	s.tracker.update(now)
+	s.Assert().Equal(now, s.tracker.lastSaved)
+	s.tracker.update(now.Add(10 * time.Second))
+	s.tracker.update(now.Add(5 * time.Minute))
+	s.Assert().Equal(now, s.tracker.lastSaved)
+	s.tracker.update(now.Add(healthSaveInterval))
+	s.Assert().Equal(now.Add(healthSaveInterval), s.tracker.lastSaved)
+}
+
+func (s *HealthTrackerTest) Test_UsesReportedHistory() {
+	s.tracker.history = historyClient{
+		MockClient: s.bmvClient,
+		history:    bmv.History{ChargeCycles: 42, FullDischarges: 3, TotalAhDrawn: 8000},
+	}
+	s.setBattery(50, -10, 12.8, -100)
+	s.tracker.update(time.Now())
+	state := s.tracker.GetState()
+	s.Assert().Equal(float64(42), state.ChargeCycles)
+	s.Assert().Equal(float64(3), state.FullDischarges)
+	cycles, ok := s.tracker.EquivalentCycles()
+	s.Assert().True(ok)
+	s.Assert().Equal(float64(40), cycles)
+}
+
+func TestHealthTracker(t *testing.T) {
+	suite.Run(t, new(HealthTrackerTest))
+}
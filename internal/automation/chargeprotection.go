@@ -0,0 +1,140 @@
+package automation
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jgulick48/rv-homekit/internal/bmv"
+	"github.com/jgulick48/rv-homekit/internal/models"
+	"github.com/jgulick48/rv-homekit/internal/mqtt"
+	"github.com/jgulick48/rv-homekit/internal/storage"
+)
+
+const defaultProtectionHysteresis = 3
+
+// chargeLimiter is the part of the MQTT client used to limit charging.
+type chargeLimiter interface {
+	SetMaxChargeCurrent(value float64)
+	LimitMaxChargeCurrent(value float64)
+	ClearMaxChargeCurrentLimit()
+}
+
+type ProtectionState struct {
+	Active bool  `json:"active"`
+	Since  int64 `json:"since"`
+}
+
+func (s *ProtectionState) LoadFromFile(filename string) {
+	if filename == "" {
+		filename = storage.Path("chargeProtection.json")
+	}
+	err := storage.ReadJSON(filename, &s)
+	if os.IsNotExist(err) {
+		log.Printf("No charge protection state found. Starting new.")
+	} else if err != nil {
+		log.Printf("Invalid charge protection file provided")
+	}
+}
+
+func (s *ProtectionState) SaveToFile(filename string) {
+	if filename == "" {
+		filename = storage.Path("chargeProtection.json")
+	}
+	if err := storage.WriteJSON(filename, s); err != nil {
+		log.Printf("Error saving %s: %s", filename, err)
+	}
+}
+
+// ChargeProtection stops the battery from being charged while it is too cold.
+type ChargeProtection struct {
+	config      models.ChargeProtection
+	dvccConfig  models.CurrentLimitConfiguration
+	bmvClient   bmv.Client
+	limiter     chargeLimiter
+	state       ProtectionState
+	stateFile   string
+	temperature float64
+	mutex       sync.Mutex
+}
+
+func NewChargeProtection(config models.ChargeProtection, client bmv.Client, mqttClient mqtt.Client, dvccConfig models.CurrentLimitConfiguration) *ChargeProtection {
+	var state ProtectionState
+	state.LoadFromFile("")
+	protection := &ChargeProtection{
+		config:     config,
+		dvccConfig: dvccConfig,
+		bmvClient:  client,
+		limiter:    mqttClient,
+		state:      state,
+	}
+	if state.Active {
+		mqttClient.LimitMaxChargeCurrent(config.ReducedCurrent)
+	}
+	return protection
+}
+
+func (p *ChargeProtection) Start() {
+	ticker := time.NewTicker(time.Second * 10)
+	go func() {
+		for range ticker.C {
+			p.check()
+		}
+	}()
+}
+
+func (p *ChargeProtection) check() {
+	temperature, ok := p.bmvClient.GetBatteryTemperature()
+	if !ok {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.temperature = temperature
+	hysteresis := p.config.Hysteresis
+	if hysteresis == 0 {
+		hysteresis = defaultProtectionHysteresis
+	}
+	if !p.state.Active && temperature < p.config.MinTemperature {
+		log.Printf("Battery temperature of %v°C is below %v°C, limiting max charge current to %v.", temperature, p.config.MinTemperature, p.config.ReducedCurrent)
+		p.limiter.LimitMaxChargeCurrent(p.config.ReducedCurrent)
+		p.limiter.SetMaxChargeCurrent(p.config.ReducedCurrent)
+		p.state.Active = true
+		p.state.Since = time.Now().Unix()
+		p.state.SaveToFile(p.stateFile)
+	} else if p.state.Active && temperature >= p.config.MinTemperature+hysteresis {
+		p.limiter.ClearMaxChargeCurrentLimit()
+		restore := p.config.RestoreCurrent
+		if restore == 0 {
+			restore = p.dvccConfig.HighCurrentMax
+		}
+		if restore > 0 {
+			log.Printf("Battery temperature of %v°C is back above %v°C, restoring max charge current to %v.", temperature, p.config.MinTemperature+hysteresis, restore)
+			p.limiter.SetMaxChargeCurrent(restore)
+		} else {
+			log.Printf("Battery temperature of %v°C is back above %v°C but no restore current is configured, leaving max charge current at %v.", temperature, p.config.MinTemperature+hysteresis, p.config.ReducedCurrent)
+		}
+		p.state.Active = false
+		p.state.Since = time.Now().Unix()
+		p.state.SaveToFile(p.stateFile)
+	}
+}
+
+func (p *ChargeProtection) IsActive() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.state.Active
+}
+
+// InhibitReason returns why generator starts should be blocked, or an empty
+// string if they are allowed.
+func (p *ChargeProtection) InhibitReason() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.state.Active {
+		return ""
+	}
+	return fmt.Sprintf("battery temperature of %v°C is below %v°C", p.temperature, p.config.MinTemperature)
+}
@@ -0,0 +1,93 @@
+package automation
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/jgulick48/rv-homekit/internal/bmv"
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+type fakeLimiter struct {
+	limited bool
+	limit   float64
+	set     []float64
+}
+
+func (f *fakeLimiter) SetMaxChargeCurrent(value float64) {
+	if f.limited && value > f.limit {
+		value = f.limit
+	}
+	f.set = append(f.set, value)
+}
+
+func (f *fakeLimiter) LimitMaxChargeCurrent(value float64) {
+	f.limited = true
+	f.limit = value
+}
+
+func (f *fakeLimiter) ClearMaxChargeCurrentLimit() {
+	f.limited = false
+}
+
+type ChargeProtectionTest struct {
+	suite.Suite
+	bmvClient  *bmv.MockClient
+	limiter    *fakeLimiter
+	protection *ChargeProtection
+}
+
+func (s *ChargeProtectionTest) SetupTest() {
+	s.bmvClient = &bmv.MockClient{}
+	s.limiter = &fakeLimiter{}
+	s.protection = &ChargeProtection{
+		config: models.ChargeProtection{
+			Enabled:        true,
+			MinTemperature: 2,
+			Hysteresis:     3,
+		},
+		dvccConfig: models.CurrentLimitConfiguration{HighCurrentMax: 100},
+		bmvClient:  s.bmvClient,
+		limiter:    s.limiter,
+		stateFile:  filepath.Join(s.T().TempDir(), "chargeProtection.json"),
+	}
+}
+
+func (s *ChargeProtectionTest) Test_LimitsAndRestoresWithHysteresis() {
+	s.bmvClient.On("GetBatteryTemperature").Return(1.5, true).Once()
+	s.protection.check()
+	s.Assert().True(s.protection.IsActive())
+	s.Assert().Equal([]float64{0}, s.limiter.set)
+	s.Assert().NotEmpty(s.protection.InhibitReason())
+
+	s.bmvClient.On("GetBatteryTemperature").Return(4.0, true).Once()
+	s.protection.check()
+	s.Assert().True(s.protection.IsActive())
+
+	s.bmvClient.On("GetBatteryTemperature").Return(5.0, true).Once()
+	s.protection.check()
+	s.Assert().False(s.protection.IsActive())
+	s.Assert().Equal([]float64{0, 100}, s.limiter.set)
+	s.Assert().Empty(s.protection.InhibitReason())
+}
+
+func (s *ChargeProtectionTest) Test_BlocksAutoCharge() {
+	s.bmvClient.On("GetBatteryTemperature").Return(-4.0, true).Once()
+	s.protection.check()
+	starts := 0
+	a := &Automation{
+		stateFile:  filepath.Join(s.T().TempDir(), "state.json"),
+		switchFunc: func(bool) { starts++ },
+		stateFunc:  func() bool { return false },
+	}
+	a.AddStartInhibitor(s.protection.InhibitReason)
+	a.StartAutoCharge()
+	s.Assert().False(a.IsAutomationRunning())
+	s.Assert().Equal(0, starts)
+}
+
+func TestChargeProtection(t *testing.T) {
+	suite.Run(t, new(ChargeProtectionTest))
+}
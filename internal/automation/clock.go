@@ -0,0 +1,77 @@
+package automation
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for the automations so they can be run against a
+// simulated clock.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// SimulatedClock only moves when it is set or slept on, so sleeping returns
+// straight away.
+type SimulatedClock struct {
+	now   time.Time
+	mutex sync.Mutex
+}
+
+func NewSimulatedClock(start time.Time) *SimulatedClock {
+	return &SimulatedClock{now: start}
+}
+
+func (c *SimulatedClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *SimulatedClock) Sleep(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set moves the clock to the given time. It never moves the clock backwards.
+func (c *SimulatedClock) Set(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if now.After(c.now) {
+		c.now = now
+	}
+}
+
+// SetClock replaces the clock used by the generator automation.
+func (a *Automation) SetClock(clock Clock) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.clock = clock
+}
+
+func (a *Automation) now() time.Time {
+	if a.clock == nil {
+		return time.Now()
+	}
+	return a.clock.Now()
+}
+
+func (a *Automation) sleep(d time.Duration) {
+	if a.clock == nil {
+		time.Sleep(d)
+		return
+	}
+	a.clock.Sleep(d)
+}
@@ -0,0 +1,78 @@
+package automation
+
+import (
+	"log"
+	"time"
+)
+
+// Decision is a generator start or stop the automation made during a replay.
+type Decision struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Reason string    `json:"reason"`
+	SOC    float64   `json:"soc"`
+}
+
+// SetDryRun makes the automation log the starts and stops it would make instead
+// of switching the generator. State and run history are not saved while in dry
+// run.
+func (a *Automation) SetDryRun(dryRun bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.dryRun = dryRun
+}
+
+// Decisions returns the starts and stops recorded during a replay.
+func (a *Automation) Decisions() []Decision {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	decisions := make([]Decision, len(a.decisions))
+	copy(decisions, a.decisions)
+	return decisions
+}
+
+// setGenerator switches the generator, or logs the decision in dry run and
+// records it during a replay. Callers must hold the mutex.
+func (a *Automation) setGenerator(on bool, reason string) {
+	if !a.dryRun {
+		a.switchFunc(on)
+		return
+	}
+	action := "stop"
+	if on {
+		action = "start"
+	}
+	soc, _ := a.bmvClient.GetBatteryStateOfCharge()
+	log.Printf("Dry run: would %s generator at %v%% state of charge: %s.", action, soc, reason)
+	a.dryRunOn = on
+	if !a.record {
+		return
+	}
+	a.decisions = append(a.decisions, Decision{
+		Time:   a.now(),
+		Action: action,
+		Reason: reason,
+		SOC:    soc,
+	})
+}
+
+// isGeneratorOn reports whether the generator is on, or whether it would be in
+// dry run.
+func (a *Automation) isGeneratorOn() bool {
+	if a.dryRun {
+		return a.dryRunOn
+	}
+	return a.stateFunc()
+}
+
+func (a *Automation) saveState() {
+	if !a.dryRun {
+		a.state.SaveToFile(a.stateFile)
+	}
+}
+
+func (a *Automation) saveHistory() {
+	if !a.dryRun {
+		a.history.SaveToFile(a.historyFile)
+	}
+}
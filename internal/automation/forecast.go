@@ -0,0 +1,214 @@
+package automation
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jgulick48/rv-homekit/internal/bmv"
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+const (
+	defaultForecastWindow = 15 * time.Minute
+	forecastStep          = 5 * time.Minute
+	forecastHorizon       = 7 * 24 * time.Hour
+	minDerivedCapacityDoD = 5
+)
+
+type ForecastResult struct {
+	// NetPower is the average net battery power in watts including any extra
+	// load, negative while discharging.
+	NetPower    float64
+	TimeToEmpty time.Duration
+	EmptyOK     bool
+	TimeToFull  time.Duration
+	FullOK      bool
+}
+
+type powerSample struct {
+	at    time.Time
+	watts float64
+}
+
+// Forecaster keeps a rolling average of net battery power and projects it
+// forward, along with the configured scheduled loads, to estimate time to empty
+// and time to full.
+type Forecaster struct {
+	config    models.Forecast
+	bmvClient bmv.Client
+	samples   []powerSample
+	mutex     sync.Mutex
+}
+
+func NewForecaster(config models.Forecast, client bmv.Client) *Forecaster {
+	for _, load := range config.ScheduledLoads {
+		if _, err := time.Parse("15:04", load.Start); err != nil {
+			log.Printf("Invalid start time %q for scheduled load %s, it will be ignored.", load.Start, load.Name)
+		}
+		if _, err := time.Parse("15:04", load.End); err != nil {
+			log.Printf("Invalid end time %q for scheduled load %s, it will be ignored.", load.End, load.Name)
+		}
+	}
+	return &Forecaster{
+		config:    config,
+		bmvClient: client,
+	}
+}
+
+func (f *Forecaster) Start() {
+	ticker := time.NewTicker(time.Second * 10)
+	go func() {
+		for range ticker.C {
+			f.sample(time.Now())
+		}
+	}()
+}
+
+func (f *Forecaster) sample(now time.Time) {
+	watts, ok := f.bmvClient.GetPower()
+	if !ok {
+		voltage, ok := f.bmvClient.GetBatteryVoltage()
+		if !ok {
+			return
+		}
+		current, ok := f.bmvClient.GetBatteryCurrent()
+		if !ok {
+			return
+		}
+		watts = voltage * current
+	}
+	window := f.config.Window.Duration
+	if window == 0 {
+		window = defaultForecastWindow
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.samples = append(f.samples, powerSample{at: now, watts: watts})
+	cutoff := now.Add(-window)
+	for len(f.samples) > 1 && f.samples[0].at.Before(cutoff) {
+		f.samples = f.samples[1:]
+	}
+}
+
+func (f *Forecaster) averagePower() (float64, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.samples) == 0 {
+		return 0, false
+	}
+	total := float64(0)
+	for _, sample := range f.samples {
+		total += sample.watts
+	}
+	return total / float64(len(f.samples)), true
+}
+
+// capacity returns the usable capacity in amp hours, from the config or worked
+// out from how much has been consumed to reach the current state of charge.
+func (f *Forecaster) capacity(soc float64) (float64, bool) {
+	if f.config.Capacity > 0 {
+		return f.config.Capacity, true
+	}
+	if soc > 100-minDerivedCapacityDoD {
+		return 0, false
+	}
+	consumed, ok := f.bmvClient.GetConsumedAmpHours()
+	if !ok {
+		return 0, false
+	}
+	return math.Abs(consumed) / (1 - soc/100), true
+}
+
+// scheduledWatts returns the total of the scheduled loads running at the time.
+func (f *Forecaster) scheduledWatts(at time.Time) float64 {
+	minutes := at.Hour()*60 + at.Minute()
+	total := float64(0)
+	for _, load := range f.config.ScheduledLoads {
+		start, err := time.Parse("15:04", load.Start)
+		if err != nil {
+			continue
+		}
+		end, err := time.Parse("15:04", load.End)
+		if err != nil {
+			continue
+		}
+		startMinutes, endMinutes := start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+		running := minutes >= startMinutes && minutes < endMinutes
+		if endMinutes < startMinutes {
+			running = minutes >= startMinutes || minutes < endMinutes
+		}
+		if running {
+			total += load.Watts
+		}
+	}
+	return total
+}
+
+// forecast projects the battery forward from now with extraWatts of additional
+// load. Scheduled loads running now are already part of the measured average so
+// they are taken out of the base power before being added back as they run.
+func (f *Forecaster) forecast(now time.Time, extraWatts float64) (ForecastResult, bool) {
+	average, ok := f.averagePower()
+	if !ok {
+		return ForecastResult{}, false
+	}
+	soc, ok := f.bmvClient.GetBatteryStateOfCharge()
+	if !ok {
+		return ForecastResult{}, false
+	}
+	voltage, ok := f.bmvClient.GetBatteryVoltage()
+	if !ok || voltage <= 0 {
+		return ForecastResult{}, false
+	}
+	capacity, ok := f.capacity(soc)
+	if !ok {
+		return ForecastResult{}, false
+	}
+	base := average + f.scheduledWatts(now)
+	result := ForecastResult{NetPower: average - extraWatts}
+	full := capacity * voltage
+	reserve := f.config.ReserveSOC / 100 * full
+	energy := soc / 100 * full
+	for elapsed := time.Duration(0); elapsed < forecastHorizon; elapsed += forecastStep {
+		power := base - extraWatts - f.scheduledWatts(now.Add(elapsed))
+		next := energy + power*forecastStep.Hours()
+		if power < 0 && next <= reserve {
+			result.TimeToEmpty = elapsed + time.Duration((energy-reserve)/-power*float64(time.Hour))
+			result.EmptyOK = true
+			break
+		}
+		if power > 0 && next >= full {
+			result.TimeToFull = elapsed + time.Duration((full-energy)/power*float64(time.Hour))
+			result.FullOK = true
+			break
+		}
+		energy = next
+	}
+	return result, true
+}
+
+func (f *Forecaster) Forecast() (ForecastResult, bool) {
+	return f.forecast(time.Now(), 0)
+}
+
+// WhatIf forecasts with the named load from the config turned on.
+func (f *Forecaster) WhatIf(name string) (ForecastResult, bool) {
+	for _, load := range f.config.Loads {
+		if load.Name == name {
+			return f.forecast(time.Now(), load.Watts)
+		}
+	}
+	return ForecastResult{}, false
+}
+
+// TimeToEmpty returns the forecast time until the battery reaches the reserve,
+// or false if it is not expected to within the forecast horizon.
+func (f *Forecaster) TimeToEmpty() (time.Duration, bool) {
+	result, ok := f.Forecast()
+	if !ok || !result.EmptyOK {
+		return 0, false
+	}
+	return result.TimeToEmpty, true
+}
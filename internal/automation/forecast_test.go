@@ -0,0 +1,88 @@
+package automation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/jgulick48/rv-homekit/internal/bmv"
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+type ForecastTest struct {
+	suite.Suite
+	bmvClient  *bmv.MockClient
+	forecaster *Forecaster
+}
+
+func (s *ForecastTest) SetupTest() {
+	s.bmvClient = &bmv.MockClient{}
+	s.forecaster = NewForecaster(models.Forecast{
+		Enabled:  true,
+		Capacity: 100,
+		Loads:    []models.ForecastLoad{{Name: "AC", Watts: 600}},
+	}, s.bmvClient)
+}
+
+func (s *ForecastTest) setBattery(soc, watts float64) {
+	s.bmvClient.ExpectedCalls = nil
+	s.bmvClient.On("GetBatteryStateOfCharge").Return(soc, true)
+	s.bmvClient.On("GetBatteryVoltage").Return(float64(12), true)
+	s.bmvClient.On("GetPower").Return(watts, true)
+	s.bmvClient.On("GetConsumedAmpHours").Return(-(100-soc)*0.9, true)
+}
+
+func (s *ForecastTest) Test_TimeToEmptyAndWhatIf() {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	s.setBattery(50, -500)
+	s.forecaster.sample(now)
+	s.setBattery(50, -700)
+	s.forecaster.sample(now.Add(10 * time.Second))
+
+	result, ok := s.forecaster.forecast(now, 0)
+	s.Assert().True(ok)
+	s.Assert().Equal(float64(-600), result.NetPower)
+	s.Assert().True(result.EmptyOK)
+	s.Assert().Equal(time.Hour, result.TimeToEmpty)
+
+	result, ok = s.forecaster.forecast(now, 600)
+	s.Assert().True(ok)
+	s.Assert().Equal(30*time.Minute, result.TimeToEmpty)
+}
+
+func (s *ForecastTest) Test_TimeToFullWithDerivedCapacity() {
+	s.forecaster.config.Capacity = 0
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	s.setBattery(50, 540)
+	s.forecaster.sample(now)
+	result, ok := s.forecaster.forecast(now, 0)
+	s.Assert().True(ok)
+	s.Assert().False(result.EmptyOK)
+	s.Assert().True(result.FullOK)
+	s.Assert().Equal(time.Hour, result.TimeToFull)
+}
+
+func (s *ForecastTest) Test_ScheduledLoads() {
+	s.forecaster.config.ScheduledLoads = []models.ScheduledLoad{
+		{Name: "Heater", Watts: 1200, Start: "22:00", End: "06:00"},
+		{Name: "Invalid", Watts: 100, Start: "noon", End: "13:00"},
+	}
+	day := time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local)
+	s.Assert().Equal(float64(1200), s.forecaster.scheduledWatts(day.Add(23*time.Hour)))
+	s.Assert().Equal(float64(1200), s.forecaster.scheduledWatts(day.Add(5*time.Hour)))
+	s.Assert().Equal(float64(0), s.forecaster.scheduledWatts(day.Add(12*time.Hour+30*time.Minute)))
+
+	// Starting at 21:00 with 100W of other load, 500Wh is left when the heater
+	// starts at 22:00 and the combined 1300W empties it about 23 minutes later.
+	now := day.Add(21 * time.Hour)
+	s.setBattery(50, -100)
+	s.forecaster.sample(now)
+	result, ok := s.forecaster.forecast(now, 0)
+	s.Assert().True(ok)
+	s.Assert().InDelta(60+500.0/1300*60, result.TimeToEmpty.Minutes(), 0.01)
+}
+
+func TestForecast(t *testing.T) {
+	suite.Run(t, new(ForecastTest))
+}
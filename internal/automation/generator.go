@@ -1,6 +1,7 @@
 package automation
 
 import (
+	"fmt"
 	"github.com/jgulick48/rv-homekit/internal/mqtt"
 	"log"
 	"sync"
@@ -10,6 +11,17 @@ import (
 	"github.com/jgulick48/rv-homekit/internal/models"
 )
 
+const (
+	generatorOff      = "OFF"
+	generatorPriming  = "PRIMING"
+	generatorStarting = "STARTING"
+	generatorRunning  = "RUNNING"
+
+	defaultStartTimeout = 2 * time.Minute
+	defaultRetryBackoff = 30 * time.Second
+	startPollInterval   = 5 * time.Second
+)
+
 type Automation struct {
 	parameters   models.Automation
 	dvccConfig   models.CurrentLimitConfiguration
@@ -18,23 +30,38 @@ type Automation struct {
 	mqttClient   mqtt.Client
 	switchFunc   func(bool)
 	stateFunc    func() bool
+	statusFunc   func() string
 	state        State
+	stateFile    string
+	history      History
+	historyFile  string
+	pollInterval time.Duration
 	isEnabled    bool
+	starting     bool
+	inhibitors   []func() string
+	timeToEmpty  func() (time.Duration, bool)
+	deferral     func(soc, lowValue float64) string
+	deferring    bool
+	clock        Clock
+	dryRun       bool
+	dryRunOn     bool
+	record       bool
+	decisions    []Decision
 	mutex        sync.Mutex
-	starter      chan bool
-	startTime    chan time.Time
-	stopTime     chan time.Time
 }
 
-func NewGeneratorAutomationClient(parameters models.Automation, client bmv.Client, mqttClient mqtt.Client, dvccConfig models.CurrentLimitConfiguration, limitsConfig models.CurrentLimitConfiguration, switchFunc func(bool), stateFunc func() bool) Automation {
+func NewGeneratorAutomationClient(parameters models.Automation, client bmv.Client, mqttClient mqtt.Client, dvccConfig models.CurrentLimitConfiguration, limitsConfig models.CurrentLimitConfiguration, switchFunc func(bool), stateFunc func() bool, statusFunc func() string) *Automation {
 	automationState := State{
 		LastStarted:         0,
 		LastStopped:         0,
 		AutomationTriggered: false,
 	}
 	automationState.LoadFromFile("")
-	return Automation{
+	var history History
+	history.LoadFromFile("")
+	return &Automation{
 		state:        automationState,
+		history:      history,
 		parameters:   parameters,
 		dvccConfig:   dvccConfig,
 		limitsConfig: limitsConfig,
@@ -42,10 +69,9 @@ func NewGeneratorAutomationClient(parameters models.Automation, client bmv.Clien
 		mqttClient:   mqttClient,
 		switchFunc:   switchFunc,
 		stateFunc:    stateFunc,
+		statusFunc:   statusFunc,
+		pollInterval: startPollInterval,
 		mutex:        sync.Mutex{},
-		starter:      make(chan bool),
-		startTime:    make(chan time.Time),
-		stopTime:     make(chan time.Time),
 	}
 }
 
@@ -53,97 +79,249 @@ func (a *Automation) AutomateGeneratorStart() {
 	a.isEnabled = true
 	ticker := time.NewTicker(time.Second * 10)
 	go func() {
-		for {
-			select {
-			case stopTime := <-a.stopTime:
-				a.state.LastStopped = stopTime.Unix()
-			case startTime := <-a.startTime:
-				a.state.LastStarted = startTime.Unix()
-			case automationStarted := <-a.starter:
-				a.state.AutomationTriggered = automationStarted
-			case <-ticker.C:
-				a.mutex.Lock()
-				state, ok := a.bmvClient.GetBatteryStateOfCharge()
-				if !ok {
-					a.mutex.Unlock()
-					continue
-				}
-				voltageState, ok := a.bmvClient.GetBatteryVoltage()
-				if !ok {
-					a.mutex.Unlock()
-					continue
-				}
-				if state < a.parameters.LowValue || voltageState < a.parameters.MinVoltage {
-					if a.stateFunc() {
-						if !a.state.AutomationTriggered {
-							log.Printf("Generator already on, skipping start.")
-						}
-					} else {
-						if state < a.parameters.LowValue {
-							log.Printf("State of charge below threshold of %v, starting generator.", a.parameters.LowValue)
-						} else if voltageState < a.parameters.MinVoltage {
-
-							log.Printf("Voltage below threshold of %v, starting generator.", a.parameters.MinVoltage)
-						}
-						if a.parameters.CoolDown.Duration > 0 {
-							if time.Now().Before(time.Unix(a.state.LastStopped, 0).Add(a.parameters.CoolDown.Duration)) {
-								log.Printf("Cooldown has not yet finished, waiting until at least %v to start generator.", time.Unix(a.state.LastStopped, 0).Add(a.parameters.CoolDown.Duration))
-								a.mutex.Unlock()
-								continue
-							}
-						}
-						a.switchFunc(true)
-						a.state.AutomationTriggered = true
-						a.state.LastStarted = time.Now().Unix()
-						a.state.SaveToFile("")
-					}
-				} else if a.state.AutomationTriggered && shouldShutOff(a.parameters, time.Unix(a.state.LastStarted, 0), a.bmvClient) {
-					if a.parameters.OffDelay.Duration > 0 {
-						log.Printf("Waiting %s before stopping generater.", a.parameters.OffDelay)
-						time.Sleep(a.parameters.OffDelay.Duration)
-					}
-					a.state.LastStopped = time.Now().Unix()
-					a.switchFunc(false)
-					a.state.AutomationTriggered = false
-					a.state.SaveToFile("")
-					a.mutex.Unlock()
-					continue
-				}
-				a.mutex.Unlock()
+		for range ticker.C {
+			a.evaluate()
+		}
+	}()
+}
+
+// evaluate checks the battery once and starts or stops the generator as needed.
+func (a *Automation) evaluate() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.starting {
+		return
+	}
+	a.observeRunState()
+	state, ok := a.bmvClient.GetBatteryStateOfCharge()
+	if !ok {
+		return
+	}
+	voltageState, ok := a.bmvClient.GetBatteryVoltage()
+	if !ok {
+		return
+	}
+	forecastLow, timeToEmpty := a.forecastLow()
+	startNeeded := state < a.parameters.LowValue || voltageState < a.parameters.MinVoltage || forecastLow
+	if !startNeeded {
+		// The battery recovered, so any deferral of the start is over.
+		a.setDeferral("")
+	}
+	if startNeeded {
+		if a.isGeneratorOn() {
+			if !a.state.AutomationTriggered {
+				log.Printf("Generator already on, skipping start.")
+			}
+			if a.state.StartFailed {
+				log.Printf("Generator is running again, clearing start failure.")
+				a.state.StartFailed = false
+				a.saveState()
 			}
+			return
+		}
+		if a.state.StartFailed {
+			return
+		}
+		reason := ""
+		if state < a.parameters.LowValue {
+			log.Printf("State of charge below threshold of %v, starting generator.", a.parameters.LowValue)
+			reason = fmt.Sprintf("state of charge %v%% below %v%%", state, a.parameters.LowValue)
+		} else if voltageState < a.parameters.MinVoltage {
 
+			log.Printf("Voltage below threshold of %v, starting generator.", a.parameters.MinVoltage)
+			reason = fmt.Sprintf("voltage %vV below %vV", voltageState, a.parameters.MinVoltage)
+		} else if forecastLow {
+			log.Printf("Forecast time to empty of %s is below %s, starting generator.", timeToEmpty.Round(time.Minute), a.parameters.MinTimeToEmpty)
+			reason = fmt.Sprintf("time to empty %s below %s", timeToEmpty.Round(time.Minute), a.parameters.MinTimeToEmpty)
 		}
-	}()
+		if a.parameters.CoolDown.Duration > 0 {
+			if a.now().Before(time.Unix(a.state.LastStopped, 0).Add(a.parameters.CoolDown.Duration)) {
+				log.Printf("Cooldown has not yet finished, waiting until at least %v to start generator.", time.Unix(a.state.LastStopped, 0).Add(a.parameters.CoolDown.Duration))
+				return
+			}
+		}
+		deferReason := ""
+		if a.deferral != nil && voltageState >= a.parameters.MinVoltage {
+			deferReason = a.deferral(state, a.parameters.LowValue)
+		}
+		a.setDeferral(deferReason)
+		if deferReason != "" {
+			return
+		}
+		if inhibitReason := a.startInhibited(); inhibitReason != "" {
+			log.Printf("Generator start blocked: %s.", inhibitReason)
+			return
+		}
+		started := true
+		if a.dryRun {
+			a.setGenerator(true, reason)
+			a.recordStart(TriggerAutomation)
+		} else {
+			a.mutex.Unlock()
+			started = a.startGenerator(TriggerAutomation)
+			a.mutex.Lock()
+		}
+		if started {
+			a.state.AutomationTriggered = true
+			a.state.LastStarted = a.now().Unix()
+			a.saveState()
+		}
+	} else if a.state.AutomationTriggered {
+		reason := shutOffReason(a.parameters, time.Unix(a.state.LastStarted, 0), a.now(), a.bmvClient)
+		if reason == "" {
+			return
+		}
+		if a.parameters.OffDelay.Duration > 0 {
+			log.Printf("Waiting %s before stopping generater.", a.parameters.OffDelay)
+			a.mutex.Unlock()
+			a.sleep(a.parameters.OffDelay.Duration)
+			a.mutex.Lock()
+			if !a.state.AutomationTriggered {
+				return
+			}
+		}
+		a.state.LastStopped = a.now().Unix()
+		a.setGenerator(false, reason)
+		a.recordStop(reason)
+		a.state.AutomationTriggered = false
+		a.saveState()
+	}
 }
 
-func shouldShutOff(params models.Automation, startTime time.Time, client bmv.Client) bool {
-	if time.Now().Before(startTime.Add(params.MinOn.Duration)) {
+// setDeferral logs when a solar deferral of the start begins and ends rather
+// than on every check. Callers must hold the mutex.
+func (a *Automation) setDeferral(reason string) {
+	deferring := reason != ""
+	if deferring == a.deferring {
+		return
+	}
+	a.deferring = deferring
+	if deferring {
+		log.Printf("Deferring generator start: %s.", reason)
+	} else {
+		log.Printf("No longer deferring generator start for solar.")
+	}
+}
+
+// startGenerator sends the start command and waits for the generator to report
+// that it is running, retrying with an increasing backoff when it falls back to
+// OFF or never gets there. Successful starts are recorded in the run history
+// with the given trigger. It must be called without holding the mutex.
+func (a *Automation) startGenerator(trigger string) bool {
+	a.mutex.Lock()
+	if a.starting {
+		a.mutex.Unlock()
 		return false
 	}
-	if params.MaxOn.Duration != 0 && time.Now().After(startTime.Add(params.MaxOn.Duration)) {
-		log.Printf("Generator has been running for %s which is longer than %s, signaling generator to shut off.", time.Now().Sub(startTime), params.MaxOn)
+	a.starting = true
+	a.mutex.Unlock()
+	defer func() {
+		a.mutex.Lock()
+		a.starting = false
+		a.mutex.Unlock()
+	}()
+	backoff := a.parameters.RetryBackoff.Duration
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
+	attempts := a.parameters.StartRetries + 1
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			log.Printf("Waiting %s before retrying generator start, attempt %v of %v.", backoff, attempt, attempts)
+			a.sleep(backoff)
+			backoff = backoff * 2
+		}
+		a.switchFunc(true)
+		if a.waitForRunning() {
+			a.mutex.Lock()
+			a.recordStart(trigger)
+			if a.state.StartFailed {
+				a.state.StartFailed = false
+				a.saveState()
+			}
+			a.mutex.Unlock()
+			return true
+		}
+		log.Printf("Generator did not start on attempt %v of %v.", attempt, attempts)
+	}
+	log.Printf("ALERT: Generator failed to start after %v attempts, giving up until it is started manually or AutoCharge is toggled.", attempts)
+	a.mutex.Lock()
+	a.state.StartFailed = true
+	a.state.LastStartFailure = a.now().Unix()
+	a.saveState()
+	a.mutex.Unlock()
+	return false
+}
+
+// waitForRunning watches the generator state after a start command. It returns
+// false if the generator drops back to OFF after priming/starting or if it has
+// not reached RUNNING before the start timeout, turning the switch back off so
+// a retry sends a fresh start.
+func (a *Automation) waitForRunning() bool {
+	if a.statusFunc == nil {
 		return true
 	}
+	timeout := a.parameters.StartTimeout.Duration
+	if timeout == 0 {
+		timeout = defaultStartTimeout
+	}
+	deadline := a.now().Add(timeout)
+	cranking := false
+	for a.now().Before(deadline) {
+		a.sleep(a.pollInterval)
+		switch status := a.statusFunc(); status {
+		case generatorRunning:
+			log.Printf("Generator reported running.")
+			return true
+		case generatorPriming, generatorStarting:
+			cranking = true
+		case generatorOff:
+			if cranking {
+				log.Printf("Generator went back to %s while starting.", status)
+				a.switchFunc(false)
+				return false
+			}
+		}
+	}
+	log.Printf("Generator did not report running within %s, stopping start attempt.", timeout)
+	a.switchFunc(false)
+	return false
+}
+
+func shouldShutOff(params models.Automation, startTime time.Time, client bmv.Client) bool {
+	return shutOffReason(params, startTime, time.Now(), client) != ""
+}
+
+// shutOffReason returns why the generator should be shut off, or an empty string
+// if it should keep running.
+func shutOffReason(params models.Automation, startTime, now time.Time, client bmv.Client) string {
+	if now.Before(startTime.Add(params.MinOn.Duration)) {
+		return ""
+	}
+	if params.MaxOn.Duration != 0 && now.After(startTime.Add(params.MaxOn.Duration)) {
+		log.Printf("Generator has been running for %s which is longer than %s, signaling generator to shut off.", now.Sub(startTime), params.MaxOn)
+		return "max run time reached"
+	}
 	state, ok := client.GetBatteryStateOfCharge()
 	if !ok {
 		log.Print("Unable to get battery state of charge, signaling generator to shut off.")
-		return true
+		return "state of charge unavailable"
 	}
 	if state > params.HighValue {
 		log.Printf("Battery is now at %v which is higher than %v, signaling generator to shut off.", state, params.HighValue)
-		return true
+		return "state of charge reached high value"
 	}
 	chargeCurrent, ok := client.GetBatteryCurrent()
 	if !ok {
 		log.Print("Unable to get battery current, signaling generator to shut off.")
-		return true
+		return "battery current unavailable"
 	}
 	if chargeCurrent > 0 && chargeCurrent < params.MinChargeCurrent {
 		log.Printf("Battery current is now at %v which is lower than %v, signaling generator to shut off.", chargeCurrent, params.MinChargeCurrent)
-		return true
+		return "charge current below minimum"
 	}
 
-	return false
+	return ""
 }
 
 func (a *Automation) IsEnabled() bool {
@@ -152,54 +330,133 @@ func (a *Automation) IsEnabled() bool {
 
 func (a *Automation) StartAutoCharge() {
 	a.mutex.Lock()
-	if a.stateFunc() {
+	a.state.StartFailed = false
+	if a.isGeneratorOn() {
 		if !a.state.AutomationTriggered {
 			log.Printf("Generator already on, skipping start but setting triggered flag.")
 		}
+	} else if reason := a.startInhibited(); reason != "" {
+		log.Printf("AutoCharge start blocked: %s.", reason)
+		a.mutex.Unlock()
+		return
 	} else {
 		log.Printf("Generator not on, starting from manual automation trigger.")
-		a.switchFunc(true)
-		a.state.LastStarted = time.Now().Unix()
-		a.startTime <- time.Now()
+		if a.dryRun {
+			a.state.LastStarted = a.now().Unix()
+			a.setGenerator(true, "AutoCharge started")
+			a.recordStart(TriggerAutoCharge)
+		} else {
+			go func() {
+				started := a.startGenerator(TriggerAutoCharge)
+				a.mutex.Lock()
+				if started {
+					a.state.LastStarted = a.now().Unix()
+				} else {
+					a.state.AutomationTriggered = false
+				}
+				a.saveState()
+				a.mutex.Unlock()
+			}()
+		}
 	}
 	a.state.AutomationTriggered = true
-	a.starter <- true
-	a.state.SaveToFile("")
+	a.saveState()
 	a.mutex.Unlock()
 }
 
 func (a *Automation) StopAutoCharge() {
 	a.mutex.Lock()
-	if !a.stateFunc() {
+	if !a.isGeneratorOn() {
 		log.Printf("Generator already off, skipping stop")
 	} else {
-		if a.dvccConfig.LowCurrentMax != 0 && a.mqttClient.IsEnabled() {
+		if a.dvccConfig.LowCurrentMax != 0 && !a.dryRun && a.mqttClient.IsEnabled() {
 			a.mqttClient.SetMaxChargeCurrent(a.dvccConfig.LowCurrentMax)
 			a.mqttClient.SetMaxInputCurrent(a.limitsConfig.LowCurrentMax)
 			log.Printf("Got signal to turn off. Setting DVCC max charge current to %v and waiting 30 seconds", a.dvccConfig.LowCurrentMax)
 			go func() {
-				time.Sleep(time.Second * 30)
+				a.sleep(time.Second * 30)
 				log.Printf("Generator on, stopping from manual automation cancel")
 				a.switchFunc(false)
-				a.state.LastStopped = time.Now().Unix()
-				a.stopTime <- time.Now()
-				time.Sleep(time.Second * 30)
+				a.mutex.Lock()
+				a.recordStop("AutoCharge cancelled")
+				a.state.LastStopped = a.now().Unix()
+				a.saveState()
+				a.mutex.Unlock()
+				a.sleep(time.Second * 30)
 				a.mqttClient.SetMaxChargeCurrent(a.dvccConfig.HighCurrentMax)
 				a.mqttClient.SetMaxInputCurrent(a.limitsConfig.HighCurrentMax)
 			}()
 		} else {
 			log.Printf("Generator on, stopping from manual automation cancel")
-			a.switchFunc(false)
-			a.state.LastStopped = time.Now().Unix()
-			a.stopTime <- time.Now()
+			a.setGenerator(false, "AutoCharge cancelled")
+			a.recordStop("AutoCharge cancelled")
+			a.state.LastStopped = a.now().Unix()
 		}
 	}
 	a.state.AutomationTriggered = false
-	a.starter <- false
-	a.state.SaveToFile("")
+	a.saveState()
 	a.mutex.Unlock()
 }
 
+// AddStartInhibitor registers a check that blocks automatic and AutoCharge
+// starts for as long as it returns a reason.
+func (a *Automation) AddStartInhibitor(inhibitor func() string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.inhibitors = append(a.inhibitors, inhibitor)
+}
+
+// SetTimeToEmptyFunc sets the forecast used to start the generator once the time
+// to empty drops below MinTimeToEmpty, before the state of charge reaches
+// LowValue.
+func (a *Automation) SetTimeToEmptyFunc(timeToEmpty func() (time.Duration, bool)) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.timeToEmpty = timeToEmpty
+}
+
+// SetStartDeferral sets a check that can hold off starts triggered by the state
+// of charge or forecast. Starts for low voltage are never deferred.
+func (a *Automation) SetStartDeferral(deferral func(soc, lowValue float64) string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.deferral = deferral
+}
+
+// forecastLow reports whether the forecast time to empty is below
+// MinTimeToEmpty. Callers must hold the mutex.
+func (a *Automation) forecastLow() (bool, time.Duration) {
+	if a.timeToEmpty == nil || a.parameters.MinTimeToEmpty.Duration <= 0 {
+		return false, 0
+	}
+	timeToEmpty, ok := a.timeToEmpty()
+	if !ok {
+		return false, 0
+	}
+	return timeToEmpty < a.parameters.MinTimeToEmpty.Duration, timeToEmpty
+}
+
+// startInhibited returns the reason the first inhibitor gives for blocking a
+// start. Callers must hold the mutex.
+func (a *Automation) startInhibited() string {
+	for _, inhibitor := range a.inhibitors {
+		if reason := inhibitor(); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
 func (a *Automation) IsAutomationRunning() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
 	return a.state.AutomationTriggered
 }
+
+// IsStartFailed reports whether the automation gave up after the generator
+// failed to start.
+func (a *Automation) IsStartFailed() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.state.StartFailed
+}
@@ -1,6 +1,7 @@
 package automation
 
 import (
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -52,6 +53,110 @@ func (s *GeneratorTest) Test_shouldShutOff_MinCurrent() {
 	s.Assert().True(turnOff)
 }
 
+func (s *GeneratorTest) newStartAutomation(statuses ...string) (*Automation, *[]bool) {
+	switches := []bool{}
+	params := paramaters
+	params.StartTimeout = models.Duration{Duration: 50 * time.Millisecond}
+	params.StartRetries = 2
+	params.RetryBackoff = models.Duration{Duration: time.Millisecond}
+	polls := 0
+	s.bmvClient.On("GetBatteryStateOfCharge").Return(42.0, true)
+	dir := s.T().TempDir()
+	return &Automation{
+		parameters:  params,
+		bmvClient:   s.bmvClient,
+		stateFile:   filepath.Join(dir, "state.json"),
+		historyFile: filepath.Join(dir, "history.json"),
+		switchFunc: func(on bool) {
+			switches = append(switches, on)
+		},
+		statusFunc: func() string {
+			status := statuses[polls%len(statuses)]
+			polls++
+			return status
+		},
+		pollInterval: time.Millisecond,
+	}, &switches
+}
+
+func (s *GeneratorTest) Test_startGenerator_Running() {
+	a, switches := s.newStartAutomation("PRIMING", "STARTING", "RUNNING")
+	s.Assert().True(a.startGenerator(TriggerAutomation))
+	s.Assert().Equal([]bool{true}, *switches)
+	s.Assert().False(a.IsStartFailed())
+	runs := a.GetRunHistory()
+	s.Require().Len(runs, 1)
+	s.Assert().Equal(TriggerAutomation, runs[0].Trigger)
+	s.Assert().Equal(42.0, runs[0].SOCStart)
+}
+
+func (s *GeneratorTest) Test_startGenerator_FallsBackToOff() {
+	a, switches := s.newStartAutomation("PRIMING", "STARTING", "OFF")
+	s.Assert().False(a.startGenerator(TriggerAutomation))
+	s.Assert().Equal([]bool{true, false, true, false, true, false}, *switches)
+	s.Assert().True(a.IsStartFailed())
+	s.Assert().Empty(a.GetRunHistory())
+}
+
+func (s *GeneratorTest) Test_StartAutoCharge_FailedStartNotCounted() {
+	a, _ := s.newStartAutomation("PRIMING", "STARTING", "OFF")
+	a.stateFunc = func() bool { return false }
+	a.StartAutoCharge()
+	s.Assert().Eventually(a.IsStartFailed, time.Second, time.Millisecond)
+	s.Assert().Eventually(func() bool { return !a.IsAutomationRunning() }, time.Second, time.Millisecond)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	s.Assert().Zero(a.state.LastStarted)
+}
+
+func (s *GeneratorTest) Test_History_ManualStartStaysOpen() {
+	a, _ := s.newStartAutomation("STARTING", "STARTING", "OFF")
+	on := false
+	a.stateFunc = func() bool { return on }
+	a.RecordManualChange(true)
+	a.observeRunState()
+	a.observeRunState()
+	on = true
+	a.observeRunState()
+	a.observeRunState()
+	runs := a.GetRunHistory()
+	s.Require().Len(runs, 1)
+	s.Assert().Equal(TriggerHomeKit, runs[0].Trigger)
+	s.Assert().Zero(runs[0].EndedAt)
+
+	on = false
+	a.observeRunState()
+	runs = a.GetRunHistory()
+	s.Require().Len(runs, 1)
+	s.Assert().Equal("stopped outside of automation", runs[0].StopReason)
+}
+
+func (s *GeneratorTest) Test_History_Capped() {
+	a, _ := s.newStartAutomation("OFF")
+	for i := 0; i < maxRunHistory+5; i++ {
+		a.recordStart(TriggerAutomation)
+		a.recordStop("test")
+	}
+	s.Assert().Len(a.GetRunHistory(), maxRunHistory)
+}
+
+func (s *GeneratorTest) Test_History_ServiceStatus() {
+	now := time.Now()
+	history := History{
+		Runs: []RunRecord{
+			{Trigger: TriggerHomeKit, StartedAt: now.Add(-2 * time.Hour).Unix()},
+		},
+		TotalRunSeconds: 98 * 3600,
+		LastService:     map[string]float64{"oil": 0, "air filter": 50},
+	}
+	statuses := history.serviceStatus([]models.ServiceInterval{{Name: "oil", Hours: 100}, {Name: "air filter", Hours: 100}}, now)
+	s.Require().Len(statuses, 2)
+	s.Assert().True(statuses[0].Due)
+	s.Assert().InDelta(100, statuses[0].HoursSince, 0.01)
+	s.Assert().False(statuses[1].Due)
+	s.Assert().InDelta(50, statuses[1].HoursSince, 0.01)
+}
+
 func TestAutomateGeneratorStart(t *testing.T) {
 	suite.Run(t, new(GeneratorTest))
 }
@@ -0,0 +1,205 @@
+package automation
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+	"github.com/jgulick48/rv-homekit/internal/storage"
+)
+
+const (
+	TriggerHomeKit    = "homekit"
+	TriggerAutoCharge = "autocharge"
+	TriggerAutomation = "automation"
+	TriggerExternal   = "external"
+
+	maxRunHistory = 100
+)
+
+type RunRecord struct {
+	Trigger    string  `json:"trigger"`
+	StartedAt  int64   `json:"startedAt"`
+	EndedAt    int64   `json:"endedAt"`
+	SOCStart   float64 `json:"socStart"`
+	SOCEnd     float64 `json:"socEnd"`
+	StopReason string  `json:"stopReason"`
+}
+
+type History struct {
+	Runs            []RunRecord        `json:"runs"`
+	TotalRunSeconds float64            `json:"totalRunSeconds"`
+	LastService     map[string]float64 `json:"lastService"`
+}
+
+type ServiceStatus struct {
+	Name       string
+	Interval   float64
+	HoursSince float64
+	Due        bool
+}
+
+func (h *History) LoadFromFile(filename string) {
+	if filename == "" {
+		filename = storage.Path("generatorHistory.json")
+	}
+	err := storage.ReadJSON(filename, &h)
+	if os.IsNotExist(err) {
+		log.Printf("No generator history found. Starting new.")
+	} else if err != nil {
+		log.Printf("Invalid generator history file provided")
+	}
+	if h.LastService == nil {
+		h.LastService = make(map[string]float64)
+	}
+}
+
+func (h *History) SaveToFile(filename string) {
+	if filename == "" {
+		filename = storage.Path("generatorHistory.json")
+	}
+	if err := storage.WriteJSON(filename, h); err != nil {
+		log.Printf("Error saving %s: %s", filename, err)
+	}
+}
+
+func (h *History) openRun() *RunRecord {
+	if len(h.Runs) == 0 {
+		return nil
+	}
+	run := &h.Runs[len(h.Runs)-1]
+	if run.EndedAt != 0 {
+		return nil
+	}
+	return run
+}
+
+// RunHours returns the cumulative generator run time including any run that is
+// still in progress.
+func (h *History) RunHours(now time.Time) float64 {
+	seconds := h.TotalRunSeconds
+	if run := h.openRun(); run != nil {
+		seconds += now.Sub(time.Unix(run.StartedAt, 0)).Seconds()
+	}
+	return seconds / 3600
+}
+
+func (h *History) serviceStatus(intervals []models.ServiceInterval, now time.Time) []ServiceStatus {
+	hours := h.RunHours(now)
+	statuses := make([]ServiceStatus, 0, len(intervals))
+	for _, interval := range intervals {
+		since := hours - h.LastService[interval.Name]
+		statuses = append(statuses, ServiceStatus{
+			Name:       interval.Name,
+			Interval:   interval.Hours,
+			HoursSince: since,
+			Due:        interval.Hours > 0 && since >= interval.Hours,
+		})
+	}
+	return statuses
+}
+
+// recordStart opens a new run unless one is already in progress. Callers must
+// hold the mutex.
+func (a *Automation) recordStart(trigger string) {
+	if a.history.openRun() != nil {
+		return
+	}
+	soc, _ := a.bmvClient.GetBatteryStateOfCharge()
+	log.Printf("Recording generator run started by %s at %v%% state of charge.", trigger, soc)
+	a.history.Runs = append(a.history.Runs, RunRecord{
+		Trigger:   trigger,
+		StartedAt: a.now().Unix(),
+		SOCStart:  soc,
+	})
+	if len(a.history.Runs) > maxRunHistory {
+		a.history.Runs = a.history.Runs[len(a.history.Runs)-maxRunHistory:]
+	}
+	a.saveHistory()
+}
+
+// recordStop closes the run in progress with the given reason. Callers must
+// hold the mutex.
+func (a *Automation) recordStop(reason string) {
+	run := a.history.openRun()
+	if run == nil {
+		return
+	}
+	soc, _ := a.bmvClient.GetBatteryStateOfCharge()
+	run.EndedAt = a.now().Unix()
+	run.SOCEnd = soc
+	run.StopReason = reason
+	a.history.TotalRunSeconds += float64(run.EndedAt - run.StartedAt)
+	log.Printf("Recording generator run stopped due to %s after %s, state of charge went from %v%% to %v%%.", reason, time.Duration(run.EndedAt-run.StartedAt)*time.Second, run.SOCStart, run.SOCEnd)
+	for _, status := range a.history.serviceStatus(a.parameters.ServiceIntervals, a.now()) {
+		if status.Due {
+			log.Printf("Generator service %s is due, %.1f hours since last service.", status.Name, status.HoursSince)
+		}
+	}
+	a.saveHistory()
+}
+
+// RecordManualChange records a run started or stopped from the generator switch
+// in HomeKit.
+func (a *Automation) RecordManualChange(on bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if on {
+		a.recordStart(TriggerHomeKit)
+	} else {
+		a.recordStop("stopped from HomeKit")
+	}
+}
+
+// observeRunState records runs started or stopped outside of the automation. A
+// run in progress is left open while the generator is still priming or
+// starting, so a start from HomeKit is not closed before it reports running.
+func (a *Automation) observeRunState() {
+	running := a.isGeneratorOn()
+	if running && a.history.openRun() == nil {
+		a.recordStart(TriggerExternal)
+	} else if !running && a.history.openRun() != nil && a.isGeneratorOff() {
+		a.recordStop("stopped outside of automation")
+	}
+}
+
+// isGeneratorOff reports whether the generator status is OFF rather than still
+// priming or starting.
+func (a *Automation) isGeneratorOff() bool {
+	if a.dryRun || a.statusFunc == nil {
+		return true
+	}
+	return a.statusFunc() == generatorOff
+}
+
+func (a *Automation) GetRunHours() float64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.history.RunHours(a.now())
+}
+
+func (a *Automation) GetRunHistory() []RunRecord {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	runs := make([]RunRecord, len(a.history.Runs))
+	copy(runs, a.history.Runs)
+	return runs
+}
+
+func (a *Automation) GetServiceStatus() []ServiceStatus {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.history.serviceStatus(a.parameters.ServiceIntervals, a.now())
+}
+
+// ResetService marks the named service interval as done at the current run
+// hours.
+func (a *Automation) ResetService(name string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	hours := a.history.RunHours(a.now())
+	log.Printf("Marking generator service %s as done at %.1f run hours.", name, hours)
+	a.history.LastService[name] = hours
+	a.saveHistory()
+}
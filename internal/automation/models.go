@@ -1,38 +1,37 @@
 package automation
 
 import (
-	"encoding/json"
-	"io/ioutil"
 	"log"
+	"os"
+
+	"github.com/jgulick48/rv-homekit/internal/storage"
 )
 
 type State struct {
 	LastStarted         int64 `json:"lastStarted"`
 	LastStopped         int64 `json:"lastStopped"`
 	AutomationTriggered bool  `json:"automationTriggered"`
+	StartFailed         bool  `json:"startFailed"`
+	LastStartFailure    int64 `json:"lastStartFailure"`
 }
 
 func (a *State) LoadFromFile(filename string) {
 	if filename == "" {
-		filename = "./state.json"
+		filename = storage.Path("state.json")
 	}
-	configFile, err := ioutil.ReadFile(filename)
-	if err != nil {
+	err := storage.ReadJSON(filename, &a)
+	if os.IsNotExist(err) {
 		log.Printf("No config file found. Making new IDs")
-	}
-	err = json.Unmarshal(configFile, &a)
-	if err != nil {
+	} else if err != nil {
 		log.Printf("Invliad config file provided")
 	}
 }
 
 func (a *State) SaveToFile(filename string) {
 	if filename == "" {
-		filename = "./state.json"
+		filename = storage.Path("state.json")
 	}
-	data, err := json.MarshalIndent(a, "", "  ")
-	if err != nil {
-		return
+	if err := storage.WriteJSON(filename, a); err != nil {
+		log.Printf("Error saving %s: %s", filename, err)
 	}
-	ioutil.WriteFile(filename, data, 0644)
 }
@@ -0,0 +1,145 @@
+package automation
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+// TelemetrySample is one recorded battery reading used to replay the generator
+// automation.
+type TelemetrySample struct {
+	Time    time.Time
+	SOC     float64
+	Voltage float64
+	Current float64
+}
+
+// LoadTelemetry reads recorded battery telemetry from a CSV file with the
+// columns time,soc,voltage,current. Time is either RFC3339 or unix seconds. A
+// header row is skipped.
+func LoadTelemetry(filename string) ([]TelemetrySample, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 4
+	reader.TrimLeadingSpace = true
+	samples := make([]TelemetrySample, 0)
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 1 && strings.EqualFold(record[0], "time") {
+			continue
+		}
+		sample, err := parseTelemetry(record)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+func parseTelemetry(record []string) (TelemetrySample, error) {
+	var sample TelemetrySample
+	if seconds, err := strconv.ParseInt(record[0], 10, 64); err == nil {
+		sample.Time = time.Unix(seconds, 0)
+	} else if sample.Time, err = time.Parse(time.RFC3339, record[0]); err != nil {
+		return sample, fmt.Errorf("invalid time %q", record[0])
+	}
+	values := make([]float64, 3)
+	for i, field := range record[1:] {
+		value, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return sample, fmt.Errorf("invalid value %q", field)
+		}
+		values[i] = value
+	}
+	sample.SOC, sample.Voltage, sample.Current = values[0], values[1], values[2]
+	return sample, nil
+}
+
+// replayBattery serves the current telemetry sample as the battery monitor.
+type replayBattery struct {
+	sample TelemetrySample
+}
+
+func (b *replayBattery) Close() {}
+
+func (b *replayBattery) GetBatteryStateOfCharge() (float64, bool) {
+	return b.sample.SOC, true
+}
+
+func (b *replayBattery) GetBatteryCurrent() (float64, bool) {
+	return b.sample.Current, true
+}
+
+func (b *replayBattery) GetBatteryVoltage() (float64, bool) {
+	return b.sample.Voltage, true
+}
+
+func (b *replayBattery) GetConsumedAmpHours() (float64, bool) {
+	return 0, false
+}
+
+func (b *replayBattery) GetBatteryTemperature() (float64, bool) {
+	return 0, false
+}
+
+func (b *replayBattery) GetPower() (float64, bool) {
+	return b.sample.Voltage * b.sample.Current, true
+}
+
+func (b *replayBattery) GetTimeToGo() (float64, bool) {
+	return 0, false
+}
+
+func (b *replayBattery) GetChargeTimeRemaining() (float64, bool) {
+	return 0, false
+}
+
+// Replay runs the generator automation in dry run over the recorded telemetry
+// on a simulated clock and returns the starts and stops it would have made.
+// Samples that fall inside an OffDelay wait are skipped, as they would be while
+// the automation sleeps.
+func Replay(parameters models.Automation, samples []TelemetrySample) []Decision {
+	if len(samples) == 0 {
+		return nil
+	}
+	battery := &replayBattery{}
+	clock := NewSimulatedClock(samples[0].Time)
+	a := &Automation{
+		parameters: parameters,
+		bmvClient:  battery,
+		clock:      clock,
+		dryRun:     true,
+		record:     true,
+	}
+	for _, sample := range samples {
+		if sample.Time.Before(clock.Now()) {
+			continue
+		}
+		clock.Set(sample.Time)
+		battery.sample = sample
+		a.evaluate()
+	}
+	if a.dryRunOn {
+		log.Printf("Generator would still be running at the end of the replay.")
+	}
+	return a.Decisions()
+}
@@ -0,0 +1,65 @@
+package automation
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ReplayTest struct {
+	suite.Suite
+}
+
+func (s *ReplayTest) Test_Replay() {
+	start := time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC)
+	samples := make([]TelemetrySample, 0)
+	for minute := 0; minute <= 120; minute++ {
+		soc := 50.0
+		if minute >= 40 {
+			soc = 99.5
+		} else if minute >= 5 {
+			soc = 9
+		}
+		samples = append(samples, TelemetrySample{Time: start.Add(time.Duration(minute) * time.Minute), SOC: soc, Voltage: 12.8, Current: 20})
+	}
+	decisions := Replay(paramaters, samples)
+	s.Require().Len(decisions, 2)
+	s.Assert().Equal("start", decisions[0].Action)
+	s.Assert().Equal(start.Add(5*time.Minute), decisions[0].Time)
+	s.Assert().Equal(9.0, decisions[0].SOC)
+	s.Assert().Equal("stop", decisions[1].Action)
+	s.Assert().Equal(start.Add(45*time.Minute), decisions[1].Time)
+	s.Assert().Equal("state of charge reached high value", decisions[1].Reason)
+}
+
+func (s *ReplayTest) Test_DryRunDoesNotRecordDecisions() {
+	battery := &replayBattery{sample: TelemetrySample{SOC: 9, Voltage: 12.8}}
+	a := &Automation{
+		parameters: paramaters,
+		bmvClient:  battery,
+		clock:      NewSimulatedClock(time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC)),
+		dryRun:     true,
+	}
+	a.evaluate()
+	s.Assert().True(a.dryRunOn)
+	s.Assert().Empty(a.Decisions())
+}
+
+func (s *ReplayTest) Test_LoadTelemetry() {
+	filename := filepath.Join(s.T().TempDir(), "telemetry.csv")
+	data := "time,soc,voltage,current\n2021-06-01T08:00:00Z,50,12.8,-5\n1622534460,49.5,12.7,-6\n"
+	s.Require().NoError(ioutil.WriteFile(filename, []byte(data), 0644))
+	samples, err := LoadTelemetry(filename)
+	s.Require().NoError(err)
+	s.Require().Len(samples, 2)
+	s.Assert().Equal(time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC).Unix(), samples[0].Time.Unix())
+	s.Assert().Equal(49.5, samples[1].SOC)
+	s.Assert().Equal(-6.0, samples[1].Current)
+}
+
+func TestReplaySuite(t *testing.T) {
+	suite.Run(t, new(ReplayTest))
+}
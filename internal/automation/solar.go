@@ -0,0 +1,321 @@
+package automation
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jgulick48/rv-homekit/internal/bmv"
+	"github.com/jgulick48/rv-homekit/internal/models"
+	"github.com/jgulick48/rv-homekit/internal/storage"
+)
+
+const (
+	solarSampleInterval   = 15 * time.Minute
+	maxSolarHistory       = 60 * 24 * 4
+	defaultSolarMinSample = 5
+	defaultSolarHardFloor = 20
+	defaultSolarMinPV     = 0.5
+)
+
+// pvSource is the part of the solar charger client used for deferral.
+type pvSource interface {
+	GetPower() (float64, bool)
+	GetYieldToday() (float64, bool)
+	GetYieldYesterday() (float64, bool)
+}
+
+type SolarSample struct {
+	Time           int64   `json:"time"`
+	SOC            float64 `json:"soc"`
+	PVPower        float64 `json:"pvPower"`
+	YieldToday     float64 `json:"yieldToday"`
+	YieldYesterday float64 `json:"yieldYesterday"`
+	Charging       bool    `json:"charging"`
+}
+
+type SolarHistory struct {
+	Samples []SolarSample `json:"samples"`
+}
+
+func (h *SolarHistory) LoadFromFile(filename string) {
+	if filename == "" {
+		filename = storage.Path("solarHistory.json")
+	}
+	err := storage.ReadJSON(filename, &h)
+	if os.IsNotExist(err) {
+		log.Printf("No solar history found. Starting new.")
+	} else if err != nil {
+		log.Printf("Invalid solar history file provided")
+	}
+}
+
+func (h *SolarHistory) SaveToFile(filename string) {
+	if filename == "" {
+		filename = storage.Path("solarHistory.json")
+	}
+	if err := storage.WriteJSON(filename, h); err != nil {
+		log.Printf("Error saving %s: %s", filename, err)
+	}
+}
+
+// SolarHourModel predicts, from yesterday's yield in kWh, how far the state of
+// charge will rise by the end of the day starting at this hour and how far it
+// will drop before it does. PVPower is the average solar power at this hour.
+type SolarHourModel struct {
+	Samples       int     `json:"samples"`
+	PVPower       float64 `json:"pvPower"`
+	GainIntercept float64 `json:"gainIntercept"`
+	GainSlope     float64 `json:"gainSlope"`
+	DropIntercept float64 `json:"dropIntercept"`
+	DropSlope     float64 `json:"dropSlope"`
+}
+
+type SolarModel struct {
+	TrainedAt int64              `json:"trainedAt"`
+	Hours     [24]SolarHourModel `json:"hours"`
+}
+
+func (m *SolarModel) LoadFromFile(filename string) {
+	if filename == "" {
+		filename = storage.Path("solarModel.json")
+	}
+	err := storage.ReadJSON(filename, &m)
+	if os.IsNotExist(err) {
+		log.Printf("No solar model found, solar deferral disabled until one is trained.")
+	} else if err != nil {
+		log.Printf("Invalid solar model file provided")
+	}
+}
+
+func (m *SolarModel) SaveToFile(filename string) {
+	if filename == "" {
+		filename = storage.Path("solarModel.json")
+	}
+	if err := storage.WriteJSON(filename, m); err != nil {
+		log.Printf("Error saving %s: %s", filename, err)
+	}
+}
+
+// fitLine returns the least squares intercept and slope of y against x.
+func fitLine(x, y []float64) (float64, float64) {
+	n := float64(len(x))
+	var sumX, sumY float64
+	for i := range x {
+		sumX += x[i]
+		sumY += y[i]
+	}
+	meanX, meanY := sumX/n, sumY/n
+	var covariance, variance float64
+	for i := range x {
+		covariance += (x[i] - meanX) * (y[i] - meanY)
+		variance += (x[i] - meanX) * (x[i] - meanX)
+	}
+	if variance == 0 {
+		return meanY, 0
+	}
+	slope := covariance / variance
+	return meanY - slope*meanX, slope
+}
+
+// TrainSolarModel fits a model for each hour of the day from the recorded
+// history. For every sample it looks at the rest of that day, up to the next
+// sample taken while the AC input was charging, to find the highest state of
+// charge reached and the lowest state of charge before it. Samples taken while
+// charging are left out so generator and shore charging are not learned as
+// solar.
+func TrainSolarModel(history SolarHistory) SolarModel {
+	days := make(map[string][]SolarSample)
+	order := make([]string, 0)
+	for _, sample := range history.Samples {
+		day := time.Unix(sample.Time, 0).Format("2006-01-02")
+		if _, ok := days[day]; !ok {
+			order = append(order, day)
+		}
+		days[day] = append(days[day], sample)
+	}
+	var yields, gains, drops, power [24][]float64
+	for _, day := range order {
+		samples := days[day]
+		for i, sample := range samples {
+			if sample.Charging {
+				continue
+			}
+			end := i + 1
+			for end < len(samples) && !samples[end].Charging {
+				end++
+			}
+			if end == i+1 {
+				continue
+			}
+			highest, highestAt := sample.SOC, i
+			for j := i + 1; j < end; j++ {
+				if samples[j].SOC > highest {
+					highest, highestAt = samples[j].SOC, j
+				}
+			}
+			lowest := sample.SOC
+			for j := i + 1; j <= highestAt; j++ {
+				if samples[j].SOC < lowest {
+					lowest = samples[j].SOC
+				}
+			}
+			hour := time.Unix(sample.Time, 0).Hour()
+			yields[hour] = append(yields[hour], sample.YieldYesterday)
+			gains[hour] = append(gains[hour], highest-sample.SOC)
+			drops[hour] = append(drops[hour], lowest-sample.SOC)
+			power[hour] = append(power[hour], sample.PVPower)
+		}
+	}
+	model := SolarModel{TrainedAt: time.Now().Unix()}
+	for hour := range model.Hours {
+		if len(yields[hour]) == 0 {
+			continue
+		}
+		gainIntercept, gainSlope := fitLine(yields[hour], gains[hour])
+		dropIntercept, dropSlope := fitLine(yields[hour], drops[hour])
+		var totalPower float64
+		for _, value := range power[hour] {
+			totalPower += value
+		}
+		model.Hours[hour] = SolarHourModel{
+			Samples:       len(yields[hour]),
+			PVPower:       totalPower / float64(len(power[hour])),
+			GainIntercept: gainIntercept,
+			GainSlope:     gainSlope,
+			DropIntercept: dropIntercept,
+			DropSlope:     dropSlope,
+		}
+	}
+	return model
+}
+
+// TrainSolarModelFromFile trains the model from the default history file and
+// saves it to the default model file.
+func TrainSolarModelFromFile() {
+	var history SolarHistory
+	history.LoadFromFile("")
+	model := TrainSolarModel(history)
+	for hour, hourModel := range model.Hours {
+		if hourModel.Samples == 0 {
+			continue
+		}
+		log.Printf("Hour %02d: %v samples, gain %.1f%% + %.2f%%/kWh, drop %.1f%% + %.2f%%/kWh, %.0fW solar.", hour, hourModel.Samples, hourModel.GainIntercept, hourModel.GainSlope, hourModel.DropIntercept, hourModel.DropSlope, hourModel.PVPower)
+	}
+	model.SaveToFile("")
+	log.Printf("Trained solar model from %v samples.", len(history.Samples))
+}
+
+// SolarDeferral records battery and solar history for training and uses the
+// trained model to defer generator starts. chargingFunc reports whether the
+// generator or shore power is charging through the AC input.
+type SolarDeferral struct {
+	config       models.SolarDeferral
+	bmvClient    bmv.Client
+	pvClient     pvSource
+	chargingFunc func() bool
+	history      SolarHistory
+	historyFile  string
+	model        SolarModel
+	mutex        sync.Mutex
+}
+
+func NewSolarDeferral(config models.SolarDeferral, client bmv.Client, pvClient pvSource, chargingFunc func() bool) *SolarDeferral {
+	var history SolarHistory
+	history.LoadFromFile("")
+	var model SolarModel
+	model.LoadFromFile("")
+	return &SolarDeferral{
+		config:       config,
+		bmvClient:    client,
+		pvClient:     pvClient,
+		chargingFunc: chargingFunc,
+		history:      history,
+		model:        model,
+	}
+}
+
+func (s *SolarDeferral) Start() {
+	ticker := time.NewTicker(solarSampleInterval)
+	go func() {
+		for range ticker.C {
+			s.record(time.Now())
+		}
+	}()
+}
+
+func (s *SolarDeferral) record(now time.Time) {
+	soc, ok := s.bmvClient.GetBatteryStateOfCharge()
+	if !ok {
+		return
+	}
+	power, _ := s.pvClient.GetPower()
+	today, _ := s.pvClient.GetYieldToday()
+	yesterday, _ := s.pvClient.GetYieldYesterday()
+	charging := s.chargingFunc != nil && s.chargingFunc()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.history.Samples = append(s.history.Samples, SolarSample{
+		Time:           now.Unix(),
+		SOC:            soc,
+		PVPower:        power,
+		YieldToday:     today,
+		YieldYesterday: yesterday,
+		Charging:       charging,
+	})
+	if len(s.history.Samples) > maxSolarHistory {
+		s.history.Samples = s.history.Samples[len(s.history.Samples)-maxSolarHistory:]
+	}
+	s.history.SaveToFile(s.historyFile)
+}
+
+// DeferReason returns why a start at the given state of charge should wait for
+// solar, or an empty string if the generator should start.
+func (s *SolarDeferral) DeferReason(soc, lowValue float64) string {
+	return s.deferReason(time.Now(), soc, lowValue)
+}
+
+// hardFloor returns the state of charge deferral never lets the battery drop to.
+func (s *SolarDeferral) hardFloor() float64 {
+	if s.config.HardFloor == 0 {
+		return defaultSolarHardFloor
+	}
+	return s.config.HardFloor
+}
+
+func (s *SolarDeferral) deferReason(now time.Time, soc, lowValue float64) string {
+	hardFloor := s.hardFloor()
+	if !s.config.Enabled || soc <= hardFloor {
+		return ""
+	}
+	minSamples := s.config.MinSamples
+	if minSamples == 0 {
+		minSamples = defaultSolarMinSample
+	}
+	s.mutex.Lock()
+	hourModel := s.model.Hours[now.Hour()]
+	s.mutex.Unlock()
+	if hourModel.Samples < minSamples {
+		return ""
+	}
+	yesterday, ok := s.pvClient.GetYieldYesterday()
+	if !ok {
+		return ""
+	}
+	minPV := s.config.MinPVFraction
+	if minPV == 0 {
+		minPV = defaultSolarMinPV
+	}
+	power, ok := s.pvClient.GetPower()
+	if !ok || power < hourModel.PVPower*minPV {
+		return ""
+	}
+	highest := soc + hourModel.GainIntercept + hourModel.GainSlope*yesterday
+	lowest := soc + hourModel.DropIntercept + hourModel.DropSlope*yesterday
+	if lowest <= hardFloor || highest < lowValue {
+		return ""
+	}
+	return fmt.Sprintf("solar is expected to recharge the battery to %.0f%% without dropping below %.0f%%", highest, lowest)
+}
@@ -0,0 +1,137 @@
+package automation
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/jgulick48/rv-homekit/internal/bmv"
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+type fakePV struct {
+	yesterday float64
+	power     float64
+}
+
+func (f fakePV) GetPower() (float64, bool) {
+	return f.power, true
+}
+
+func (f fakePV) GetYieldToday() (float64, bool) {
+	return 0, true
+}
+
+func (f fakePV) GetYieldYesterday() (float64, bool) {
+	return f.yesterday, true
+}
+
+type SolarDeferralTest struct {
+	suite.Suite
+	bmvClient *bmv.MockClient
+	deferral  *SolarDeferral
+}
+
+func (s *SolarDeferralTest) SetupTest() {
+	s.bmvClient = &bmv.MockClient{}
+	s.deferral = &SolarDeferral{
+		config:      models.SolarDeferral{Enabled: true, MinSamples: 2},
+		bmvClient:   s.bmvClient,
+		pvClient:    fakePV{yesterday: 4},
+		historyFile: filepath.Join(s.T().TempDir(), "solarHistory.json"),
+	}
+}
+
+// day builds a day of hourly samples where the battery drains overnight and
+// solar adds 2% an hour from 9 AM to 2 PM for each kWh of yesterday's yield.
+func day(start time.Time, yesterday float64) []SolarSample {
+	samples := make([]SolarSample, 0, 24)
+	soc := float64(40)
+	for hour := 0; hour < 24; hour++ {
+		if hour < 9 {
+			soc -= 1
+		} else if hour < 14 {
+			soc += yesterday * 2
+		}
+		samples = append(samples, SolarSample{
+			Time:           start.Add(time.Duration(hour) * time.Hour).Unix(),
+			SOC:            soc,
+			YieldYesterday: yesterday,
+		})
+	}
+	return samples
+}
+
+func (s *SolarDeferralTest) Test_TrainAndDefer() {
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local)
+	history := SolarHistory{}
+	for i, yesterday := range []float64{1, 2, 3, 4} {
+		history.Samples = append(history.Samples, day(start.AddDate(0, 0, i), yesterday)...)
+	}
+	model := TrainSolarModel(history)
+	eight := model.Hours[8]
+	s.Assert().Equal(4, eight.Samples)
+	s.Assert().InDelta(10, eight.GainSlope, 0.001)
+	s.Assert().InDelta(0, eight.GainIntercept, 0.001)
+	s.Assert().InDelta(0, eight.DropIntercept, 0.001)
+	s.deferral.model = model
+
+	morning := start.Add(8 * time.Hour)
+	s.Assert().Contains(s.deferral.deferReason(morning, 35, 50), "recharge the battery to 75%")
+	// A poor day yesterday does not get the battery back above LowValue.
+	s.deferral.pvClient = fakePV{yesterday: 1}
+	s.Assert().Equal("", s.deferral.deferReason(morning, 35, 50))
+	// Never defer at the default hard floor or without enough samples for the hour.
+	s.deferral.pvClient = fakePV{yesterday: 4}
+	s.Assert().Equal("", s.deferral.deferReason(morning, 20, 50))
+	s.Assert().Equal("", s.deferral.deferReason(start.Add(23*time.Hour), 35, 50))
+}
+
+func (s *SolarDeferralTest) Test_IgnoresChargingFromACInput() {
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local)
+	history := SolarHistory{}
+	for i, yesterday := range []float64{1, 2, 3, 4} {
+		samples := day(start.AddDate(0, 0, i), yesterday)
+		// The generator runs from 10 AM to noon, adding 30% on top of solar.
+		for hour := 10; hour < 24; hour++ {
+			if hour < 12 {
+				samples[hour].Charging = true
+			}
+			samples[hour].SOC += 30
+		}
+		history.Samples = append(history.Samples, samples...)
+	}
+	model := TrainSolarModel(history)
+	eight := model.Hours[8]
+	s.Assert().Equal(4, eight.Samples)
+	s.Assert().InDelta(2, eight.GainSlope, 0.001)
+	s.Assert().Equal(0, model.Hours[10].Samples)
+	s.Assert().Equal(0, model.Hours[11].Samples)
+}
+
+func (s *SolarDeferralTest) Test_NotDeferredWithLowSolarPower() {
+	s.deferral.model.Hours[8] = SolarHourModel{Samples: 4, GainSlope: 10, PVPower: 400}
+	morning := time.Date(2024, 6, 5, 8, 0, 0, 0, time.Local)
+	s.deferral.pvClient = fakePV{yesterday: 4, power: 300}
+	s.Assert().Contains(s.deferral.deferReason(morning, 35, 50), "recharge the battery to 75%")
+	// An overcast morning after a sunny day does not defer the start.
+	s.deferral.pvClient = fakePV{yesterday: 4, power: 100}
+	s.Assert().Equal("", s.deferral.deferReason(morning, 35, 50))
+}
+
+func (s *SolarDeferralTest) Test_RecordsHistory() {
+	s.bmvClient.On("GetBatteryStateOfCharge").Return(float64(60), true)
+	s.deferral.chargingFunc = func() bool { return true }
+	s.deferral.record(time.Now())
+	loaded := SolarHistory{}
+	loaded.LoadFromFile(s.deferral.historyFile)
+	s.Assert().Len(loaded.Samples, 1)
+	s.Assert().Equal(float64(4), loaded.Samples[0].YieldYesterday)
+	s.Assert().True(loaded.Samples[0].Charging)
+}
+
+func TestSolarDeferral(t *testing.T) {
+	suite.Run(t, new(SolarDeferralTest))
+}
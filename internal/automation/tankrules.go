@@ -0,0 +1,223 @@
+package automation
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+	"github.com/jgulick48/rv-homekit/internal/mqtt/system"
+)
+
+const (
+	TankBelow = "below"
+	TankAbove = "above"
+
+	defaultTankDebounce    = 30 * time.Second
+	defaultTankHysteresis  = 5
+	defaultPowerHysteresis = 100
+)
+
+// powerSignals are the system signals a rule can watch with Signal instead of a
+// tank. Their threshold and hysteresis are in watts rather than percent.
+var powerSignals = map[string]bool{
+	system.HouseLoad:   true,
+	system.SolarPower:  true,
+	system.GensetPower: true,
+}
+
+// TankTarget is a device controlled by a tank rule.
+type TankTarget interface {
+	GetState() (string, error)
+	SetState(state string)
+}
+
+type tankRule struct {
+	config       models.TankRule
+	active       bool
+	pendingSince time.Time
+}
+
+// TankRules acts on devices when tank levels or power signals cross their
+// thresholds.
+type TankRules struct {
+	rules      []*tankRule
+	levelFunc  func(tank string) (float64, bool)
+	signalFunc func(signal string) (float64, bool)
+	targetFunc func(target models.ScheduleTarget) (TankTarget, bool)
+	mutex      sync.Mutex
+}
+
+func NewTankRules(rules []models.TankRule, levelFunc func(tank string) (float64, bool), signalFunc func(signal string) (float64, bool), targetFunc func(target models.ScheduleTarget) (TankTarget, bool)) *TankRules {
+	t := &TankRules{
+		levelFunc:  levelFunc,
+		signalFunc: signalFunc,
+		targetFunc: targetFunc,
+	}
+	for _, rule := range rules {
+		if rule.Condition != TankBelow && rule.Condition != TankAbove {
+			log.Printf("Skipping tank rule %s: condition must be %s or %s.", rule.Name, TankBelow, TankAbove)
+			continue
+		}
+		if (rule.Tank == "") == (rule.Signal == "") {
+			log.Printf("Skipping tank rule %s: set either a tank or a signal.", rule.Name)
+			continue
+		}
+		if rule.Signal != "" && !powerSignals[rule.Signal] {
+			log.Printf("Skipping tank rule %s: signal must be %s, %s or %s.", rule.Name, system.HouseLoad, system.SolarPower, system.GensetPower)
+			continue
+		}
+		t.rules = append(t.rules, &tankRule{config: rule})
+	}
+	return t
+}
+
+func (t *TankRules) Start() {
+	ticker := time.NewTicker(time.Second * 10)
+	go func() {
+		for range ticker.C {
+			t.evaluate(time.Now())
+		}
+	}()
+}
+
+func (r *tankRule) triggered(level float64) bool {
+	if r.config.Condition == TankBelow {
+		return level <= r.config.Threshold
+	}
+	return level >= r.config.Threshold
+}
+
+func (r *tankRule) cleared(level float64) bool {
+	hysteresis := r.config.Hysteresis
+	if hysteresis == 0 {
+		hysteresis = defaultTankHysteresis
+		if r.config.Signal != "" {
+			hysteresis = defaultPowerHysteresis
+		}
+	}
+	if r.config.Condition == TankBelow {
+		return level > r.config.Threshold+hysteresis
+	}
+	return level < r.config.Threshold-hysteresis
+}
+
+// source is the tank or signal the rule watches.
+func (r *tankRule) source() string {
+	if r.config.Signal != "" {
+		return r.config.Signal
+	}
+	return r.config.Tank
+}
+
+// unit is the unit of the rule's level in logs.
+func (r *tankRule) unit() string {
+	if r.config.Signal != "" {
+		return "W"
+	}
+	return "%"
+}
+
+func (r *tankRule) debounce() time.Duration {
+	if r.config.Debounce.Duration > 0 {
+		return r.config.Debounce.Duration
+	}
+	return defaultTankDebounce
+}
+
+func (t *TankRules) evaluate(now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, rule := range t.rules {
+		level, ok := t.level(rule)
+		if !ok {
+			continue
+		}
+		changing := rule.triggered(level)
+		if rule.active {
+			changing = rule.cleared(level)
+		}
+		if !changing {
+			if !rule.pendingSince.IsZero() {
+				log.Printf("Tank rule %s: %s level back at %v%s before %s passed, ignoring.", rule.config.Name, rule.source(), level, rule.unit(), rule.debounce())
+			}
+			rule.pendingSince = time.Time{}
+			if rule.active && rule.config.Hold {
+				t.hold(rule, level)
+			}
+			continue
+		}
+		if rule.pendingSince.IsZero() {
+			rule.pendingSince = now
+		}
+		if now.Sub(rule.pendingSince) < rule.debounce() {
+			continue
+		}
+		rule.pendingSince = time.Time{}
+		rule.active = !rule.active
+		if rule.active {
+			log.Printf("Tank rule %s: %s level of %v%s is %s %v%s, setting %s %s to %s.", rule.config.Name, rule.source(), level, rule.unit(), rule.config.Condition, rule.config.Threshold, rule.unit(), rule.config.Target.Type, rule.config.Target.Item, rule.config.Value)
+			t.set(rule, rule.config.Value)
+		} else if rule.config.RestoreValue != "" {
+			log.Printf("Tank rule %s: %s level of %v%s has recovered, setting %s %s to %s.", rule.config.Name, rule.source(), level, rule.unit(), rule.config.Target.Type, rule.config.Target.Item, rule.config.RestoreValue)
+			t.set(rule, rule.config.RestoreValue)
+		} else {
+			log.Printf("Tank rule %s: %s level of %v%s has recovered, rule cleared.", rule.config.Name, rule.source(), level, rule.unit())
+		}
+	}
+}
+
+// level returns the rule's tank level or signal power.
+func (t *TankRules) level(rule *tankRule) (float64, bool) {
+	if rule.config.Signal != "" {
+		return t.signalFunc(rule.config.Signal)
+	}
+	return t.levelFunc(rule.config.Tank)
+}
+
+// hold puts the target back to the rule's value if something else changed it.
+// Callers must hold the mutex.
+func (t *TankRules) hold(rule *tankRule, level float64) {
+	target, ok := t.targetFunc(rule.config.Target)
+	if !ok {
+		return
+	}
+	state, err := target.GetState()
+	if err != nil || state == rule.config.Value {
+		return
+	}
+	log.Printf("Tank rule %s: %s %s changed to %s while %s is at %v%s, setting it back to %s.", rule.config.Name, rule.config.Target.Type, rule.config.Target.Item, state, rule.source(), level, rule.unit(), rule.config.Value)
+	target.SetState(rule.config.Value)
+}
+
+func (t *TankRules) set(rule *tankRule, value string) {
+	target, ok := t.targetFunc(rule.config.Target)
+	if !ok {
+		log.Printf("Tank rule %s has an unknown target %s %s, skipping.", rule.config.Name, rule.config.Target.Type, rule.config.Target.Item)
+		return
+	}
+	target.SetState(value)
+}
+
+// ActiveRules returns a description of each rule that is currently active.
+func (t *TankRules) ActiveRules() map[string]string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	active := make(map[string]string)
+	for _, rule := range t.rules {
+		if rule.active {
+			active[rule.config.Name] = fmt.Sprintf("%s is %s %v%s", rule.source(), rule.config.Condition, rule.config.Threshold, rule.unit())
+		}
+	}
+	return active
+}
+
+// Names returns the names of the valid rules in config order.
+func (t *TankRules) Names() []string {
+	names := make([]string, 0, len(t.rules))
+	for _, rule := range t.rules {
+		names = append(names, rule.config.Name)
+	}
+	return names
+}
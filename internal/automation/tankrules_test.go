@@ -0,0 +1,135 @@
+package automation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+type fakeTankTarget struct {
+	state string
+	sets  []string
+}
+
+func (f *fakeTankTarget) GetState() (string, error) {
+	return f.state, nil
+}
+
+func (f *fakeTankTarget) SetState(state string) {
+	f.state = state
+	f.sets = append(f.sets, state)
+}
+
+type TankRulesTest struct {
+	suite.Suite
+	levels map[string]float64
+	pump   *fakeTankTarget
+	flush  *fakeTankTarget
+	rules  *TankRules
+}
+
+func (s *TankRulesTest) SetupTest() {
+	s.levels = map[string]float64{"Fresh": 50, "Grey": 20}
+	s.pump = &fakeTankTarget{state: "ON"}
+	s.flush = &fakeTankTarget{state: "OFF"}
+	targets := map[string]*fakeTankTarget{"Pump": s.pump, "Flush": s.flush}
+	s.rules = NewTankRules([]models.TankRule{
+		{Name: "Pump off when empty", Tank: "Fresh", Condition: TankBelow, Threshold: 0, Target: models.ScheduleTarget{Type: "openhab", Item: "Pump"}, Value: "OFF", RestoreValue: "ON"},
+		{Name: "Block flush when grey full", Tank: "Grey", Condition: TankAbove, Threshold: 90, Debounce: models.Duration{Duration: time.Minute}, Target: models.ScheduleTarget{Type: "openhab", Item: "Flush"}, Value: "OFF", Hold: true},
+		{Name: "Invalid", Tank: "Fresh", Condition: "equals"},
+	}, func(tank string) (float64, bool) {
+		level, ok := s.levels[tank]
+		return level, ok
+	}, func(signal string) (float64, bool) {
+		return 0, false
+	}, func(target models.ScheduleTarget) (TankTarget, bool) {
+		item, ok := targets[target.Item]
+		return item, ok
+	})
+}
+
+func (s *TankRulesTest) Test_DebounceAndRestore() {
+	s.Assert().Equal([]string{"Pump off when empty", "Block flush when grey full"}, s.rules.Names())
+	now := time.Now()
+	s.levels["Fresh"] = 0
+	s.rules.evaluate(now)
+	// Sloshing back up before the debounce passes resets it.
+	s.levels["Fresh"] = 3
+	s.rules.evaluate(now.Add(20 * time.Second))
+	s.levels["Fresh"] = 0
+	s.rules.evaluate(now.Add(40 * time.Second))
+	s.Assert().Equal("ON", s.pump.state)
+	s.rules.evaluate(now.Add(70 * time.Second))
+	s.Assert().Equal("OFF", s.pump.state)
+	s.Assert().Contains(s.rules.ActiveRules(), "Pump off when empty")
+
+	// Inside the hysteresis the rule stays active.
+	s.levels["Fresh"] = 4
+	s.rules.evaluate(now.Add(5 * time.Minute))
+	s.rules.evaluate(now.Add(6 * time.Minute))
+	s.Assert().Equal("OFF", s.pump.state)
+
+	s.levels["Fresh"] = 40
+	s.rules.evaluate(now.Add(7 * time.Minute))
+	s.rules.evaluate(now.Add(8 * time.Minute))
+	s.Assert().Equal("ON", s.pump.state)
+	s.Assert().Empty(s.rules.ActiveRules())
+}
+
+func (s *TankRulesTest) Test_PowerSignalHysteresis() {
+	load := 2500.0
+	rules := NewTankRules([]models.TankRule{
+		{Name: "Pump off on high load", Signal: "houseLoad", Condition: TankAbove, Threshold: 2000, Target: models.ScheduleTarget{Type: "openhab", Item: "Pump"}, Value: "OFF", RestoreValue: "ON"},
+		{Name: "Tank and signal", Tank: "Fresh", Signal: "houseLoad", Condition: TankAbove},
+		{Name: "Unknown signal", Signal: "Fresh", Condition: TankAbove},
+	}, func(tank string) (float64, bool) {
+		return 0, false
+	}, func(signal string) (float64, bool) {
+		return load, signal == "houseLoad"
+	}, func(target models.ScheduleTarget) (TankTarget, bool) {
+		return s.pump, true
+	})
+	s.Assert().Equal([]string{"Pump off on high load"}, rules.Names())
+	now := time.Now()
+	rules.evaluate(now)
+	rules.evaluate(now.Add(time.Minute))
+	s.Assert().Equal("OFF", s.pump.state)
+	s.Assert().Equal(map[string]string{"Pump off on high load": "houseLoad is above 2000W"}, rules.ActiveRules())
+
+	// Watts default to a wider hysteresis than the percent of a tank.
+	load = 1950
+	rules.evaluate(now.Add(2 * time.Minute))
+	rules.evaluate(now.Add(3 * time.Minute))
+	s.Assert().Equal("OFF", s.pump.state)
+
+	load = 1800
+	rules.evaluate(now.Add(4 * time.Minute))
+	rules.evaluate(now.Add(5 * time.Minute))
+	s.Assert().Equal("ON", s.pump.state)
+}
+
+func (s *TankRulesTest) Test_HoldKeepsTargetOff() {
+	now := time.Now()
+	s.levels["Grey"] = 95
+	s.rules.evaluate(now)
+	s.rules.evaluate(now.Add(time.Minute))
+	s.Assert().Equal([]string{"OFF"}, s.flush.sets)
+
+	s.flush.state = "ON"
+	s.rules.evaluate(now.Add(2 * time.Minute))
+	s.Assert().Equal("OFF", s.flush.state)
+
+	s.levels["Grey"] = 50
+	s.rules.evaluate(now.Add(3 * time.Minute))
+	s.rules.evaluate(now.Add(4 * time.Minute))
+	s.flush.state = "ON"
+	s.rules.evaluate(now.Add(5 * time.Minute))
+	s.Assert().Equal("ON", s.flush.state)
+}
+
+func TestTankRules(t *testing.T) {
+	suite.Run(t, new(TankRulesTest))
+}
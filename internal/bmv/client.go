@@ -207,6 +207,22 @@ func (c *client) GetDeviceName() string {
 	return c.config.Name
 }
 
+// GetTimeToGo returns the time to go in seconds. The monitor reports -1 while
+// the battery is not discharging, which is returned as not available.
 func (c *client) GetTimeToGo() (float64, bool) {
-	return 0, false
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	value, ok := c.data["TTG"]
+	if !ok {
+		return 0, false
+	}
+	minutes, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Error parsing value from map: %s", err.Error())
+		return 0, false
+	}
+	if minutes < 0 {
+		return 0, false
+	}
+	return minutes * 60, true
 }
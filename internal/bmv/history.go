@@ -0,0 +1,56 @@
+package bmv
+
+import (
+	"math"
+	"strconv"
+)
+
+// History holds the lifetime counters kept by a battery monitor. Amp hours are
+// positive values and energy is in kWh.
+type History struct {
+	DeepestDischarge       float64
+	LastDischarge          float64
+	AverageDischarge       float64
+	ChargeCycles           float64
+	FullDischarges         float64
+	TotalAhDrawn           float64
+	MinimumVoltage         float64
+	MaximumVoltage         float64
+	SecondsSinceFullCharge float64
+	DischargedEnergy       float64
+	ChargedEnergy          float64
+}
+
+// HistoryProvider is implemented by battery sources that report history
+// counters.
+type HistoryProvider interface {
+	GetHistory() (History, bool)
+}
+
+func (c *client) GetHistory() (History, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if _, ok := c.data["H4"]; !ok {
+		return History{}, false
+	}
+	value := func(key string, scale float64) float64 {
+		parsed, err := strconv.ParseFloat(c.data[key], 64)
+		if err != nil {
+			return 0
+		}
+		return parsed * scale
+	}
+	return History{
+		DeepestDischarge:       math.Abs(value("H1", 0.001)),
+		LastDischarge:          math.Abs(value("H2", 0.001)),
+		AverageDischarge:       math.Abs(value("H3", 0.001)),
+		ChargeCycles:           value("H4", 1),
+		FullDischarges:         value("H5", 1),
+		TotalAhDrawn:           math.Abs(value("H6", 0.001)),
+		MinimumVoltage:         value("H7", 0.001),
+		MaximumVoltage:         value("H8", 0.001),
+		SecondsSinceFullCharge: value("H9", 1),
+		DischargedEnergy:       value("H17", 0.01),
+		ChargedEnergy:          value("H18", 0.01),
+	}, true
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"encoding/json"
 	"errors"
+	"strconv"
 	"time"
 
 	"github.com/guregu/null"
@@ -28,12 +29,111 @@ type Config struct {
 	GeneratorOffDelay       Duration                  `json:"generatorOffDelay"`
 	EVSEConfiguration       EVSEConfiguration         `json:"evseConfiguration"`
 	ShoreDetection          ShoreDetection            `json:"shoreDetection"`
+	LoadShedding            LoadShedding              `json:"loadShedding"`
+	HighPowerDevices        []HighPowerDevice         `json:"highPowerDevices"`
+	ChargeProtection        ChargeProtection          `json:"chargeProtection"`
+	BatteryHealth           BatteryHealth             `json:"batteryHealth"`
+	Forecast                Forecast                  `json:"forecast"`
+	Scheduler               Scheduler                 `json:"scheduler"`
+	TankRules               []TankRule                `json:"tankRules"`
+	MQTTSensors             MQTTSensors               `json:"mqttSensors"`
+	Driving                 Driving                   `json:"driving"`
+	DataDir                 string                    `json:"dataDir"`
+	Batteries               []BatteryBank             `json:"batteries"`
 }
 
+// ShoreDetection watches the median AC input voltage and frequency over
+// Window. Below SagVoltage the event is only recorded, below BrownoutVoltage
+// high power devices are shed one at a time and below MinVoltage (or outside
+// MinFrequency/MaxFrequency) shore power is treated as lost. A condition must
+// last for its delay before it takes effect and the voltage must rise
+// Hysteresis volts above the threshold for RecoveryDelay before it clears.
 type ShoreDetection struct {
-	MinVoltage   float64  `json:"minVoltage"`
-	Enabled      bool     `json:"enabled"`
-	StartupDelay Duration `json:"startupDelay"`
+	MinVoltage      float64         `json:"minVoltage"`
+	Enabled         bool            `json:"enabled"`
+	StartupDelay    Duration        `json:"startupDelay"`
+	Restore         RestoreSequence `json:"restore"`
+	Window          Duration        `json:"window"`
+	SagVoltage      float64         `json:"sagVoltage"`
+	BrownoutVoltage float64         `json:"brownoutVoltage"`
+	MinFrequency    float64         `json:"minFrequency"`
+	MaxFrequency    float64         `json:"maxFrequency"`
+	Hysteresis      float64         `json:"hysteresis"`
+	SagDelay        Duration        `json:"sagDelay"`
+	BrownoutDelay   Duration        `json:"brownoutDelay"`
+	LossDelay       Duration        `json:"lossDelay"`
+	RecoveryDelay   Duration        `json:"recoveryDelay"`
+	PedestalProbe   PedestalProbe   `json:"pedestalProbe"`
+}
+
+// PedestalProbe finds the input current limit a shore pedestal can supply by
+// ramping the limit up from the input LowCurrentMax towards MaxCurrent (or the
+// input HighCurrentMax) and stopping at the highest step where the input
+// voltage stays within MaxSag volts of where it started. A step only counts if
+// the input current reaches MinLoadFraction of it, otherwise the probe is
+// inconclusive and the limit is ramped to the saved limit for the location or
+// the input HighCurrentMax. Results are saved per GPS location and only when
+// there is a fix.
+type PedestalProbe struct {
+	Enabled         bool    `json:"enabled"`
+	MaxCurrent      float64 `json:"maxCurrent"`
+	MaxSag          float64 `json:"maxSag"`
+	MinLoadFraction float64 `json:"minLoadFraction"`
+}
+
+// RestoreSequence controls how high power devices are turned back on after shore
+// power returns. Each device waits DeviceDelay (or its own RestoreDelay) and
+// until the AC input current is below SettleThreshold of the input current
+// limit. The sequence is aborted and the devices turned off again if the input
+// voltage drops below SagVoltage. DeviceDelay defaults to 30 seconds and
+// SagVoltage to a few volts below the input voltage when the restore starts, but
+// not below the shore MinVoltage.
+type RestoreSequence struct {
+	DeviceDelay     Duration `json:"deviceDelay"`
+	SettleThreshold float64  `json:"settleThreshold"`
+	SagVoltage      float64  `json:"sagVoltage"`
+}
+
+// LoadShedding turns off high power devices when the AC output current stays
+// above ShedThreshold (a fraction of the input current limit, or of
+// InverterRating when off shore power) and restores them once it stays below
+// RestoreThreshold.
+type LoadShedding struct {
+	Enabled               bool     `json:"enabled"`
+	InverterRating        float64  `json:"inverterRating"`
+	ShedThreshold         float64  `json:"shedThreshold"`
+	RestoreThreshold      float64  `json:"restoreThreshold"`
+	ShedDelay             Duration `json:"shedDelay"`
+	RestoreDelay          Duration `json:"restoreDelay"`
+	DrivingInverterRating float64  `json:"drivingInverterRating"`
+}
+
+// Driving detects time on the road from the Orion DC-DC and alternator chargers
+// on the GX. The RV counts as driving while a charger puts out at least
+// MinCurrent amps (default 1A) and for OffDelay (default 5m) after, so a stop at
+// a light does not end it. InhibitGenerator holds off generator starts while
+// driving, and load shedding uses LoadShedding.DrivingInverterRating in place of
+// InverterRating when it is set.
+type Driving struct {
+	Enabled          bool     `json:"enabled"`
+	MinCurrent       float64  `json:"minCurrent"`
+	OffDelay         Duration `json:"offDelay"`
+	InhibitGenerator bool     `json:"inhibitGenerator"`
+}
+
+// HighPowerDevice marks a device that is turned off on power failure and when
+// shedding load. Match is an openHAB thing UID, thing type UID, channel UID, item
+// name or accessory name. A thing UID or label only matches the thing's switch
+// channel; match a channel UID or item name for any other item. HighPowerStates
+// lists the states that count as drawing high power; when empty the device
+// decides for itself. RestorePolicy is one of "previous" (the default), "on" or
+// "never".
+type HighPowerDevice struct {
+	Match           string   `json:"match"`
+	Priority        int      `json:"priority"`
+	HighPowerStates []string `json:"highPowerStates"`
+	RestorePolicy   string   `json:"restorePolicy"`
+	RestoreDelay    Duration `json:"restoreDelay"`
 }
 
 type EVSEConfiguration struct {
@@ -44,13 +144,47 @@ type EVSEConfiguration struct {
 	MinCurrentBuffer int    `json:"minCurrentBuffer"`
 }
 
+// MQTTConfiguration connects to the GX device's broker. Service instances such
+// as the VE.Bus and battery are discovered from the published topics; set
+// Instances (for example {"vebus": 276}) to use a specific one instead. Without
+// a DeviceID the portal id of the first GX device seen is used for writes. With
+// UseVRM the VRM broker for DeviceID is used over TLS, logging in with
+// Username (the VRM email) and either Password or a VRMToken.
 type MQTTConfiguration struct {
-	UseVRM   bool   `json:"useVRM"`
-	Host     string `json:"host"`
-	Port     int    `json:"port"`
-	DeviceID string `json:"deviceId"`
-	Username string `json:"username"`
-	Password string `json:"password"`
+	UseVRM        bool                   `json:"useVRM"`
+	Host          string                 `json:"host"`
+	Port          int                    `json:"port"`
+	DeviceID      string                 `json:"deviceId"`
+	Username      string                 `json:"username"`
+	Password      string                 `json:"password"`
+	VRMToken      string                 `json:"vrmToken"`
+	TLS           TLSConfiguration       `json:"tls"`
+	Instances     map[string]int         `json:"instances"`
+	HomeAssistant HomeAssistantDiscovery `json:"homeAssistant"`
+}
+
+// HomeAssistantDiscovery controls the Home Assistant MQTT discovery configs
+// published for the values on the GX, one per service instance seen. Prefix is
+// the discovery prefix (default "homeassistant"). The bridge publishes "online"
+// to AvailabilityTopic (default rv-homekit/<deviceId>/status) with "offline" as
+// its last will. Entities turns single entities on or off by service and ID,
+// such as "vebus/acOutL2Power", see haEntities in internal/mqtt/discovery.go.
+type HomeAssistantDiscovery struct {
+	Disabled          bool            `json:"disabled"`
+	Prefix            string          `json:"prefix"`
+	AvailabilityTopic string          `json:"availabilityTopic"`
+	Entities          map[string]bool `json:"entities"`
+}
+
+// TLSConfiguration connects to the broker over ssl://. CAFile is a PEM bundle
+// to trust instead of the system roots, such as Victron's CA or a self-signed
+// certificate, and CertFile/KeyFile are an optional client certificate.
+type TLSConfiguration struct {
+	Enabled            bool   `json:"enabled"`
+	CAFile             string `json:"caFile"`
+	CertFile           string `json:"certFile"`
+	KeyFile            string `json:"keyFile"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
 }
 
 type CurrentLimitConfiguration struct {
@@ -67,15 +201,161 @@ type BMVConfig struct {
 	Name   string `json:"name"`
 }
 
+// BatteryBank is a battery besides the house battery, such as the chassis
+// battery or a second house bank. It gets its own HomeKit accessory and its
+// Name is used as the metrics label. Source is "mqtt" with Instance set to the
+// GX battery instance, or "vedirect" with Device and Baud set for another
+// battery monitor. The house battery is the bmvConfig monitor, or the battery
+// instance set in mqttConfiguration.instances.
+type BatteryBank struct {
+	Name     string `json:"name"`
+	Source   string `json:"source"`
+	Instance int    `json:"instance"`
+	Device   string `json:"device"`
+	Baud     int    `json:"baud"`
+}
+
 type Automation struct {
-	HighValue        float64  `json:"highValue"`
-	LowValue         float64  `json:"lowValue"`
-	MinVoltage       float64  `json:"minVoltage"`
-	OffDelay         Duration `json:"offDelay"`
-	CoolDown         Duration `json:"coolDown"`
-	MinOn            Duration `json:"minOn"`
-	MaxOn            Duration `json:"maxOn"`
-	MinChargeCurrent float64  `json:"minChargeCurrent"`
+	HighValue        float64           `json:"highValue"`
+	LowValue         float64           `json:"lowValue"`
+	MinVoltage       float64           `json:"minVoltage"`
+	OffDelay         Duration          `json:"offDelay"`
+	CoolDown         Duration          `json:"coolDown"`
+	MinOn            Duration          `json:"minOn"`
+	MaxOn            Duration          `json:"maxOn"`
+	MinChargeCurrent float64           `json:"minChargeCurrent"`
+	StartTimeout     Duration          `json:"startTimeout"`
+	StartRetries     int               `json:"startRetries"`
+	RetryBackoff     Duration          `json:"retryBackoff"`
+	ServiceIntervals []ServiceInterval `json:"serviceIntervals"`
+	MinTimeToEmpty   Duration          `json:"minTimeToEmpty"`
+	SolarDeferral    SolarDeferral     `json:"solarDeferral"`
+	// DryRun logs the starts and stops the automation would make without
+	// switching the generator.
+	DryRun bool `json:"dryRun"`
+}
+
+// SolarDeferral holds off generator starts below LowValue when the solar model
+// predicts the battery will recover above LowValue today without dropping to
+// HardFloor (default 20%) first. The model is trained from the recorded history
+// with the -trainSolarModel flag, leaving out readings taken while the AC input
+// was charging, and needs MinSamples readings for the hour of day before it is
+// used. Starts are not deferred while the solar power is below MinPVFraction
+// (default 0.5) of the usual power for the hour.
+type SolarDeferral struct {
+	Enabled       bool    `json:"enabled"`
+	HardFloor     float64 `json:"hardFloor"`
+	MinSamples    int     `json:"minSamples"`
+	MinPVFraction float64 `json:"minPVFraction"`
+}
+
+// ChargeProtection limits the DVCC max charge current to ReducedCurrent while
+// the battery temperature is below MinTemperature (Celsius). Charging is
+// restored to RestoreCurrent, or the DVCC HighCurrentMax, once the temperature
+// is Hysteresis degrees above MinTemperature.
+type ChargeProtection struct {
+	Enabled        bool    `json:"enabled"`
+	MinTemperature float64 `json:"minTemperature"`
+	Hysteresis     float64 `json:"hysteresis"`
+	ReducedCurrent float64 `json:"reducedCurrent"`
+	RestoreCurrent float64 `json:"restoreCurrent"`
+}
+
+// BatteryHealth tracks charge cycles, depth of discharge and throughput, and
+// estimates usable capacity from the amp hours consumed between a full charge
+// and the voltage dropping to EmptyVoltage. State of health is the estimated
+// capacity as a percentage of RatedCapacity (amp hours).
+type BatteryHealth struct {
+	Enabled       bool    `json:"enabled"`
+	RatedCapacity float64 `json:"ratedCapacity"`
+	EmptyVoltage  float64 `json:"emptyVoltage"`
+}
+
+// Forecast estimates time to empty and time to full from the average net
+// battery power over Window plus the ScheduledLoads expected to run. Capacity is
+// the usable capacity in amp hours; when zero it is worked out from the consumed
+// amp hours and state of charge. Time to empty is measured down to ReserveSOC.
+// Loads are the named loads that can be used for what-if forecasts.
+type Forecast struct {
+	Enabled        bool            `json:"enabled"`
+	Window         Duration        `json:"window"`
+	Capacity       float64         `json:"capacity"`
+	ReserveSOC     float64         `json:"reserveSOC"`
+	ScheduledLoads []ScheduledLoad `json:"scheduledLoads"`
+	Loads          []ForecastLoad  `json:"loads"`
+}
+
+// ScheduledLoad is a load of Watts that runs every day between Start and End,
+// given as local "15:04" times. End may be before Start to run past midnight.
+type ScheduledLoad struct {
+	Name  string  `json:"name"`
+	Watts float64 `json:"watts"`
+	Start string  `json:"start"`
+	End   string  `json:"end"`
+}
+
+type ForecastLoad struct {
+	Name  string  `json:"name"`
+	Watts float64 `json:"watts"`
+}
+
+// Scheduler runs Entries on a cron expression or at sunrise or sunset. Sun times
+// are worked out from Latitude and Longitude, or from the GPS when they are not
+// set.
+type Scheduler struct {
+	Enabled   bool            `json:"enabled"`
+	Latitude  float64         `json:"latitude"`
+	Longitude float64         `json:"longitude"`
+	Entries   []ScheduleEntry `json:"entries"`
+}
+
+// ScheduleEntry sets Target to Value when Cron (minute hour day month weekday)
+// matches, or at Sun ("sunrise" or "sunset") shifted by Offset. Only one of Cron
+// or Sun should be set.
+type ScheduleEntry struct {
+	Name   string         `json:"name"`
+	Cron   string         `json:"cron"`
+	Sun    string         `json:"sun"`
+	Offset Duration       `json:"offset"`
+	Target ScheduleTarget `json:"target"`
+	Value  string         `json:"value"`
+}
+
+// ScheduleTarget is what a schedule entry controls. Type is "openhab" with Item
+// set to the item name, "victron" with Item set to the path written under
+// W/<deviceId>/, or "evse". A Victron path may leave out the instance, as in
+// vebus/Mode, to use the discovered one.
+type ScheduleTarget struct {
+	Type string `json:"type"`
+	Item string `json:"item"`
+}
+
+// TankRule sets Target to Value when the level of Tank, the name of a Mopeka
+// sensor or OneControl tank, is "below" or "above" Threshold percent. The level
+// has to stay past the threshold for Debounce (30s by default) so sloshing while
+// driving does not trigger it, and has to move Hysteresis percent (5 by
+// default) back before the rule clears. Instead of Tank a rule can set Signal to
+// one of the system power signals "houseLoad", "solarPower" or "gensetPower",
+// with Threshold and Hysteresis in watts and Hysteresis 100W by default. With
+// Hold the target is kept at Value while the rule is active. RestoreValue, if
+// set, is applied when it clears.
+type TankRule struct {
+	Name         string         `json:"name"`
+	Tank         string         `json:"tank"`
+	Signal       string         `json:"signal"`
+	Condition    string         `json:"condition"`
+	Threshold    float64        `json:"threshold"`
+	Hysteresis   float64        `json:"hysteresis"`
+	Debounce     Duration       `json:"debounce"`
+	Target       ScheduleTarget `json:"target"`
+	Value        string         `json:"value"`
+	Hold         bool           `json:"hold"`
+	RestoreValue string         `json:"restoreValue"`
+}
+
+type ServiceInterval struct {
+	Name  string  `json:"name"`
+	Hours float64 `json:"hours"`
 }
 
 type TemperatureRange struct {
@@ -84,6 +364,25 @@ type TemperatureRange struct {
 	Unit     string  `json:"unit"`
 }
 
+// MQTTSensors adds HomeKit accessories for the tank senders and temperature
+// sensors on the GX device. They are named from their CustomName on the GX.
+// Sensors are collected for up to DiscoveryWait (default 15s) at startup, and
+// ones seen on an earlier run are always added. Power adds House Load, Solar
+// Power and Genset Power light sensors that read the watts from the system
+// overview as lux. Relays adds a switch for each GX relay, which has to be set
+// to manual on the GX, and DigitalInputs adds a contact, leak or smoke sensor
+// for each digital input according to its type. Alarms adds a GX Alarms sensor
+// that opens and reports a fault while any device on the GX has an alarm.
+type MQTTSensors struct {
+	Tanks         bool     `json:"tanks"`
+	Temperatures  bool     `json:"temperatures"`
+	Power         bool     `json:"power"`
+	Relays        bool     `json:"relays"`
+	DigitalInputs bool     `json:"digitalInputs"`
+	Alarms        bool     `json:"alarms"`
+	DiscoveryWait Duration `json:"discoveryWait"`
+}
+
 type MopkeaProCheck struct {
 	Enabled         bool                `json:"enabled"`
 	RegisterNew     bool                `json:"registerNew"`
@@ -128,8 +427,30 @@ func (d *Duration) UnmarshalJSON(b []byte) error {
 	}
 }
 
+// Message is a value published by the GX device. Text holds the value when it
+// is a string, such as a CustomName, and Value is only valid for numbers.
 type Message struct {
 	Value null.Float `json:"value"`
+	Text  string     `json:"-"`
+}
+
+func (m *Message) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if len(raw.Value) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw.Value, &m.Text); err == nil {
+		if value, err := strconv.ParseFloat(m.Text, 64); err == nil {
+			m.Value = null.FloatFrom(value)
+		}
+		return nil
+	}
+	return json.Unmarshal(raw.Value, &m.Value)
 }
 
 type Metric struct {
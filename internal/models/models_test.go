@@ -58,3 +58,20 @@ func Test_ConfigParse(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, expectedConfig, actualConfig)
 }
+
+func Test_MessageParse(t *testing.T) {
+	var message Message
+	assert.NoError(t, json.Unmarshal([]byte(`{"value": 12.5}`), &message))
+	assert.True(t, message.Value.Valid)
+	assert.Equal(t, 12.5, message.Value.Float64)
+
+	message = Message{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"value": "Fresh Water"}`), &message))
+	assert.False(t, message.Value.Valid)
+	assert.Equal(t, "Fresh Water", message.Text)
+
+	message = Message{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"value": null}`), &message))
+	assert.False(t, message.Value.Valid)
+	assert.Equal(t, "", message.Text)
+}
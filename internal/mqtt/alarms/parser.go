@@ -0,0 +1,253 @@
+package alarms
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+// Severity follows the values the GX publishes on the Alarms topics.
+type Severity int
+
+const (
+	SeverityOK      Severity = 0
+	SeverityWarning Severity = 1
+	SeverityAlarm   Severity = 2
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityOK:
+		return "ok"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return "alarm"
+	}
+}
+
+// errorTopics are the error code topics that are treated as alarms while they
+// are non-zero.
+var errorTopics = map[string]bool{
+	"VebusError": true,
+	"ErrorCode":  true,
+}
+
+var alarmState = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "victronAlarm",
+		Help: "Severity of the alarms reported by the GX, 0 when ok, 1 for a warning and 2 for an alarm.",
+	},
+	[]string{
+		"source",
+		"alarm",
+	},
+)
+
+func NewAlarmClient() Client {
+	prometheus.MustRegister(alarmState)
+	return newClient()
+}
+
+func newClient() Client {
+	return Client{
+		mux:         &sync.RWMutex{},
+		active:      map[string]*Alarm{},
+		subscribers: &[]func(Event){},
+	}
+}
+
+// Alarm is an alarm or error reported by a device on the GX.
+type Alarm struct {
+	Service  string
+	Instance int
+	Name     string
+	Severity Severity
+	Code     int
+	Raised   time.Time
+	Updated  time.Time
+}
+
+// Source returns the service and instance that raised the alarm, such as
+// vebus/276.
+func (a Alarm) Source() string {
+	return fmt.Sprintf("%s/%v", a.Service, a.Instance)
+}
+
+func (a Alarm) String() string {
+	if a.Code != 0 {
+		return fmt.Sprintf("%s %s %s (code %v)", a.Source(), a.Name, a.Severity, a.Code)
+	}
+	return fmt.Sprintf("%s %s %s", a.Source(), a.Name, a.Severity)
+}
+
+// Event is sent to subscribers when an alarm is raised, changes severity or is
+// cleared.
+type Event struct {
+	Alarm   Alarm
+	Cleared bool
+}
+
+type Client struct {
+	mux         *sync.RWMutex
+	active      map[string]*Alarm
+	subscribers *[]func(Event)
+}
+
+// GetDataParser returns the alarm parser for <service>/<instance>/Alarms/...
+// and the error code topics, or defaultParser for anything else.
+func (c Client) GetDataParser(segments []string, defaultParser func(topic []string, message models.Message) ([]string, float64)) func(topic []string, message models.Message) ([]string, float64) {
+	if _, ok := alarmName(segments); ok {
+		return c.ParseAlarmData
+	}
+	return defaultParser
+}
+
+// alarmName returns the name of the alarm a topic reports. Only alarm states are
+// accepted: Alarms/<name>, the per phase Alarms/L<n>/<name> and the tank
+// Alarms/<High|Low>/State. Tanks also publish their alarm thresholds, delays and
+// enables under Alarms, which are not alarms.
+func alarmName(segments []string) (string, bool) {
+	if len(segments) < 5 {
+		return "", false
+	}
+	if _, err := strconv.Atoi(segments[3]); err != nil {
+		return "", false
+	}
+	if segments[4] == "Alarms" {
+		switch rest := segments[5:]; {
+		case len(rest) == 1:
+			return rest[0], true
+		case len(rest) == 2 && segments[2] == "tank":
+			return rest[0], rest[1] == "State"
+		case len(rest) == 2 && isPhase(rest[0]):
+			return strings.Join(rest, "/"), true
+		}
+		return "", false
+	}
+	if len(segments) == 5 && errorTopics[segments[4]] {
+		return segments[4], true
+	}
+	return "", false
+}
+
+func isPhase(segment string) bool {
+	if !strings.HasPrefix(segment, "L") {
+		return false
+	}
+	_, err := strconv.Atoi(segment[1:])
+	return err == nil
+}
+
+func (c Client) ParseAlarmData(segments []string, message models.Message) ([]string, float64) {
+	name, ok := alarmName(segments)
+	if !ok {
+		return []string{}, 0
+	}
+	instance, _ := strconv.Atoi(segments[3])
+	value := int(message.Value.Float64)
+	if !message.Value.Valid {
+		value = 0
+	}
+	severity, code := Severity(value), 0
+	if errorTopics[name] {
+		severity, code = SeverityOK, value
+		if value != 0 {
+			severity = SeverityAlarm
+		}
+	} else if severity < SeverityOK || severity > SeverityAlarm {
+		log.Printf("Ignoring alarm %s/%s with unknown value %v.", strings.Join(segments[2:4], "/"), name, value)
+		return []string{}, 0
+	}
+	if event, changed := c.update(segments[2], instance, name, severity, code, time.Now()); changed {
+		c.notify(event)
+	}
+	return []string{}, 0
+}
+
+// update records the latest value of an alarm and returns the event to send
+// when it changed.
+func (c Client) update(service string, instance int, name string, severity Severity, code int, now time.Time) (Event, bool) {
+	key := fmt.Sprintf("%s/%v/%s", service, instance, name)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	alarm, active := c.active[key]
+	if severity == SeverityOK {
+		if !active {
+			return Event{}, false
+		}
+		delete(c.active, key)
+		alarm.Severity = SeverityOK
+		alarm.Updated = now
+		alarmState.WithLabelValues(alarm.Source(), name).Set(0)
+		return Event{Alarm: *alarm, Cleared: true}, true
+	}
+	if active && alarm.Severity == severity && alarm.Code == code {
+		return Event{}, false
+	}
+	if !active {
+		alarm = &Alarm{Service: service, Instance: instance, Name: name, Raised: now}
+		c.active[key] = alarm
+	}
+	alarm.Severity = severity
+	alarm.Code = code
+	alarm.Updated = now
+	alarmState.WithLabelValues(alarm.Source(), name).Set(float64(severity))
+	return Event{Alarm: *alarm}, true
+}
+
+func (c Client) notify(event Event) {
+	if event.Cleared {
+		log.Printf("Alarm cleared: %s %s", event.Alarm.Source(), event.Alarm.Name)
+	} else {
+		log.Printf("Alarm raised: %s", event.Alarm)
+	}
+	c.mux.RLock()
+	subscribers := append([]func(Event){}, *c.subscribers...)
+	c.mux.RUnlock()
+	for _, subscriber := range subscribers {
+		subscriber(event)
+	}
+}
+
+// Subscribe registers a function that is called whenever an alarm is raised,
+// changes or clears.
+func (c Client) Subscribe(subscriber func(Event)) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	*c.subscribers = append(*c.subscribers, subscriber)
+}
+
+// GetActive returns the active alarms, the most severe first.
+func (c Client) GetActive() []Alarm {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	alarms := make([]Alarm, 0, len(c.active))
+	for _, alarm := range c.active {
+		alarms = append(alarms, *alarm)
+	}
+	sort.Slice(alarms, func(i, j int) bool {
+		if alarms[i].Severity != alarms[j].Severity {
+			return alarms[i].Severity > alarms[j].Severity
+		}
+		return alarms[i].Raised.Before(alarms[j].Raised)
+	})
+	return alarms
+}
+
+// Highest returns the severity of the worst active alarm.
+func (c Client) Highest() Severity {
+	active := c.GetActive()
+	if len(active) == 0 {
+		return SeverityOK
+	}
+	return active[0].Severity
+}
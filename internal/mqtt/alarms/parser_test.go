@@ -0,0 +1,89 @@
+package alarms
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+type AlarmTest struct {
+	suite.Suite
+	client Client
+	events []Event
+}
+
+func (s *AlarmTest) SetupTest() {
+	s.client = newClient()
+	s.events = nil
+	s.client.Subscribe(func(event Event) {
+		s.events = append(s.events, event)
+	})
+}
+
+func (s *AlarmTest) parse(topic string, payload string) bool {
+	segments := strings.Split(topic, "/")
+	handled := true
+	parser := s.client.GetDataParser(segments, func(topic []string, message models.Message) ([]string, float64) {
+		handled = false
+		return []string{}, 0
+	})
+	var message models.Message
+	_ = json.Unmarshal([]byte(payload), &message)
+	parser(segments, message)
+	return handled
+}
+
+func (s *AlarmTest) Test_RaiseAndClear() {
+	s.Assert().True(s.parse("N/d41243b4f71d/battery/288/Alarms/LowVoltage", `{"value": 0}`))
+	s.Assert().Empty(s.events)
+	s.parse("N/d41243b4f71d/battery/288/Alarms/LowVoltage", `{"value": 1}`)
+	s.parse("N/d41243b4f71d/vebus/276/Alarms/L1/Overload", `{"value": 2}`)
+	s.parse("N/d41243b4f71d/vebus/276/Alarms/L1/Overload", `{"value": 2}`)
+	s.Require().Len(s.events, 2)
+	s.Assert().Equal(SeverityAlarm, s.client.Highest())
+	active := s.client.GetActive()
+	s.Require().Len(active, 2)
+	s.Assert().Equal("vebus/276", active[0].Source())
+	s.Assert().Equal("L1/Overload", active[0].Name)
+	s.parse("N/d41243b4f71d/vebus/276/Alarms/L1/Overload", `{"value": null}`)
+	s.Require().Len(s.events, 3)
+	s.Assert().True(s.events[2].Cleared)
+	s.Assert().Equal(SeverityWarning, s.client.Highest())
+}
+
+func (s *AlarmTest) Test_ErrorCodes() {
+	s.parse("N/d41243b4f71d/vebus/276/VebusError", `{"value": 3}`)
+	active := s.client.GetActive()
+	s.Require().Len(active, 1)
+	s.Assert().Equal(SeverityAlarm, active[0].Severity)
+	s.Assert().Equal(3, active[0].Code)
+	s.Assert().False(s.parse("N/d41243b4f71d/settings/0/Settings/Devices/adc_builtin0_1/Alarms/High/Active", `{"value": 90}`))
+	s.Assert().False(s.parse("N/d41243b4f71d/vebus/276/Ac/Out/L1/P", `{"value": 90}`))
+}
+
+func (s *AlarmTest) Test_TankAlarmConfiguration() {
+	s.Assert().False(s.parse("N/d41243b4f71d/tank/20/Alarms/High/Active", `{"value": 90}`))
+	s.Assert().False(s.parse("N/d41243b4f71d/tank/20/Alarms/High/Restore", `{"value": 80}`))
+	s.Assert().False(s.parse("N/d41243b4f71d/tank/20/Alarms/Low/Delay", `{"value": 30}`))
+	s.Assert().False(s.parse("N/d41243b4f71d/tank/20/Alarms/Low/Enable", `{"value": 1}`))
+	s.Assert().Empty(s.client.GetActive())
+
+	s.Assert().True(s.parse("N/d41243b4f71d/tank/20/Alarms/High/State", `{"value": 2}`))
+	active := s.client.GetActive()
+	s.Require().Len(active, 1)
+	s.Assert().Equal("tank/20", active[0].Source())
+	s.Assert().Equal("High", active[0].Name)
+	s.Assert().Equal(SeverityAlarm, active[0].Severity)
+
+	// Values outside the alarm states are not cast to a severity.
+	s.parse("N/d41243b4f71d/battery/288/Alarms/LowVoltage", `{"value": 90}`)
+	s.Assert().Len(s.client.GetActive(), 1)
+}
+
+func TestAlarmTest(t *testing.T) {
+	suite.Run(t, new(AlarmTest))
+}
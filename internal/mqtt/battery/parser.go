@@ -2,84 +2,150 @@ package battery
 
 import (
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
 	"sync"
 
+	"github.com/jgulick48/rv-homekit/internal/bmv"
 	"github.com/jgulick48/rv-homekit/internal/metrics"
 	"github.com/jgulick48/rv-homekit/internal/models"
 )
 
-func NewBatteryClient() Client {
+// NewBatteryClient keeps the readings of every battery instance on the GX.
+// The bmv.Client methods report the primary instance, or the lowest instance
+// seen when primary is negative.
+func NewBatteryClient(primary int) Client {
 	return Client{
-		values: map[string]float64{
-			"battery_secondsRemaining": 0,
-		},
-		mux: sync.RWMutex{},
+		values:  map[int]map[string]float64{},
+		primary: primary,
+		mux:     &sync.RWMutex{},
 	}
 }
 
 type Client struct {
-	mux    sync.RWMutex
-	values map[string]float64
+	mux     *sync.RWMutex
+	values  map[int]map[string]float64
+	primary int
+}
+
+// Instance is the bmv.Client for a single battery instance.
+type Instance struct {
+	client   Client
+	instance int
 }
 
 func (c Client) Close() {
 	panic("implement me")
 }
 
-func (c Client) GetBatteryStateOfCharge() (float64, bool) {
+// Instance returns the readings of one battery instance.
+func (c Client) Instance(instance int) Instance {
+	return Instance{client: c, instance: instance}
+}
+
+// Instances returns the battery instances seen so far.
+func (c Client) Instances() []int {
 	c.mux.RLock()
 	defer c.mux.RUnlock()
-	value, ok := c.values["battery_stateofcharge"]
-	return value, ok
+	instances := make([]int, 0, len(c.values))
+	for instance := range c.values {
+		instances = append(instances, instance)
+	}
+	sort.Ints(instances)
+	return instances
+}
+
+func (c Client) primaryInstance() Instance {
+	if c.primary >= 0 {
+		return c.Instance(c.primary)
+	}
+	instances := c.Instances()
+	if len(instances) == 0 {
+		return c.Instance(-1)
+	}
+	return c.Instance(instances[0])
+}
+
+func (c Client) GetBatteryStateOfCharge() (float64, bool) {
+	return c.primaryInstance().GetBatteryStateOfCharge()
 }
 
 func (c Client) GetBatteryCurrent() (float64, bool) {
-	c.mux.RLock()
-	defer c.mux.RUnlock()
-	value, ok := c.values["battery_current"]
-	return value, ok
+	return c.primaryInstance().GetBatteryCurrent()
 }
 
 func (c Client) GetBatteryVoltage() (float64, bool) {
-	c.mux.RLock()
-	defer c.mux.RUnlock()
-	value, ok := c.values["battery_volts"]
-	return value, ok
+	return c.primaryInstance().GetBatteryVoltage()
 }
 
 func (c Client) GetConsumedAmpHours() (float64, bool) {
-	c.mux.RLock()
-	defer c.mux.RUnlock()
-	value, ok := c.values["battery_ampHours"]
-	return value, ok
+	return c.primaryInstance().GetConsumedAmpHours()
 }
 
 func (c Client) GetBatteryTemperature() (float64, bool) {
-	c.mux.RLock()
-	defer c.mux.RUnlock()
-	value, ok := c.values["battery_degrees"]
-	return value, ok
+	return c.primaryInstance().GetBatteryTemperature()
 }
 
 func (c Client) GetPower() (float64, bool) {
-	c.mux.RLock()
-	defer c.mux.RUnlock()
-	value, ok := c.values["battery_watts"]
-	return value, ok
+	return c.primaryInstance().GetPower()
 }
 
 func (c Client) GetTimeToGo() (float64, bool) {
-	c.mux.RLock()
-	defer c.mux.RUnlock()
-	value, ok := c.values["battery_secondsRemaining"]
-	return value, ok
+	return c.primaryInstance().GetTimeToGo()
 }
+
 func (c Client) GetChargeTimeRemaining() (float64, bool) {
-	ampHours, ok := c.GetConsumedAmpHours()
+	return c.primaryInstance().GetChargeTimeRemaining()
+}
+
+func (c Client) GetHistory() (bmv.History, bool) {
+	return c.primaryInstance().GetHistory()
+}
+
+func (i Instance) value(name string) (float64, bool) {
+	i.client.mux.RLock()
+	defer i.client.mux.RUnlock()
+	value, ok := i.client.values[i.instance][name]
+	return value, ok
+}
+
+func (i Instance) Close() {}
+
+func (i Instance) GetBatteryStateOfCharge() (float64, bool) {
+	return i.value("battery_stateofcharge")
+}
+
+func (i Instance) GetBatteryCurrent() (float64, bool) {
+	return i.value("battery_current")
+}
+
+func (i Instance) GetBatteryVoltage() (float64, bool) {
+	return i.value("battery_volts")
+}
+
+func (i Instance) GetConsumedAmpHours() (float64, bool) {
+	return i.value("battery_ampHours")
+}
+
+func (i Instance) GetBatteryTemperature() (float64, bool) {
+	return i.value("battery_degrees")
+}
+
+func (i Instance) GetPower() (float64, bool) {
+	return i.value("battery_watts")
+}
+
+func (i Instance) GetTimeToGo() (float64, bool) {
+	return i.value("battery_secondsRemaining")
+}
+
+func (i Instance) GetChargeTimeRemaining() (float64, bool) {
+	ampHours, ok := i.GetConsumedAmpHours()
 	if !ok {
 		return 0, false
 	}
-	current, ok := c.GetBatteryCurrent()
+	current, ok := i.GetBatteryCurrent()
 	if !ok {
 		return 0, false
 	}
@@ -89,23 +155,73 @@ func (c Client) GetChargeTimeRemaining() (float64, bool) {
 	return (-ampHours / current) * 3600, true
 }
 
+func (i Instance) GetHistory() (bmv.History, bool) {
+	i.client.mux.RLock()
+	defer i.client.mux.RUnlock()
+	values := i.client.values[i.instance]
+	if _, ok := values["history_ChargeCycles"]; !ok {
+		return bmv.History{}, false
+	}
+	return bmv.History{
+		DeepestDischarge:       math.Abs(values["history_DeepestDischarge"]),
+		LastDischarge:          math.Abs(values["history_LastDischarge"]),
+		AverageDischarge:       math.Abs(values["history_AverageDischarge"]),
+		ChargeCycles:           values["history_ChargeCycles"],
+		FullDischarges:         values["history_FullDischarges"],
+		TotalAhDrawn:           math.Abs(values["history_TotalAhDrawn"]),
+		MinimumVoltage:         values["history_MinimumVoltage"],
+		MaximumVoltage:         values["history_MaximumVoltage"],
+		SecondsSinceFullCharge: values["history_TimeSinceLastFullCharge"],
+		DischargedEnergy:       values["history_DischargedEnergy"],
+		ChargedEnergy:          values["history_ChargedEnergy"],
+	}, true
+}
+
 func (c Client) GetDataParser(segments []string, defaultParser func(topic []string, message models.Message) ([]string, float64)) func(topic []string, message models.Message) ([]string, float64) {
 	if len(segments) < 5 {
 		return defaultParser
 	}
+	if _, err := strconv.Atoi(segments[3]); err != nil {
+		return defaultParser
+	}
 	switch segments[4] {
-	case "Dc", "Soc", "TimeToGo", "ConsumedAmphours":
+	case "Dc":
+		// Dc/1 is the starter battery input of a BMV, only the main
+		// battery on Dc/0 is kept.
+		if len(segments) < 7 || segments[5] != "0" {
+			return defaultParser
+		}
 		return c.ParseDCData
+	case "Soc", "TimeToGo", "ConsumedAmphours":
+		return c.ParseDCData
+	case "History":
+		return c.ParseHistoryData
 	default:
 		return defaultParser
 	}
 
 }
 
+// set stores a reading for an instance. Callers must hold the mutex.
+func (c Client) set(instance int, name string, value float64) {
+	values, ok := c.values[instance]
+	if !ok {
+		values = map[string]float64{
+			"battery_secondsRemaining": 0,
+		}
+		c.values[instance] = values
+	}
+	values[name] = value
+}
+
 func (c Client) ParseDCData(segments []string, message models.Message) ([]string, float64) {
 	if !message.Value.Valid {
 		return []string{}, 0
 	}
+	instance, err := strconv.Atoi(segments[3])
+	if err != nil {
+		return []string{}, 0
+	}
 	tags := []string{
 		metrics.FormatTag("deployment", segments[1]),
 		metrics.FormatTag("battery_id", segments[3]),
@@ -116,10 +232,24 @@ func (c Client) ParseDCData(segments []string, message models.Message) ([]string
 	}
 	c.mux.Lock()
 	defer c.mux.Unlock()
-	c.values[metricName] = message.Value.Float64
+	c.set(instance, metricName, message.Value.Float64)
 	return append([]string{metricName}, tags...), message.Value.Float64
 }
 
+func (c Client) ParseHistoryData(segments []string, message models.Message) ([]string, float64) {
+	if !message.Value.Valid || len(segments) < 6 {
+		return []string{}, 0
+	}
+	instance, err := strconv.Atoi(segments[3])
+	if err != nil {
+		return []string{}, 0
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.set(instance, fmt.Sprintf("history_%s", segments[5]), message.Value.Float64)
+	return []string{}, 0
+}
+
 func parseDCLineMeasurements(tags []string, segments []string) ([]string, string, bool) {
 	unit := ""
 	switch segments[len(segments)-1] {
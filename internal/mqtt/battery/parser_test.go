@@ -0,0 +1,57 @@
+package battery
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/guregu/null"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+type BatteryTest struct {
+	suite.Suite
+}
+
+func parse(client Client, topic string, value float64) {
+	segments := strings.Split(topic, "/")
+	parser := client.GetDataParser(segments, func(topic []string, message models.Message) ([]string, float64) {
+		return []string{}, 0
+	})
+	parser(segments, models.Message{Value: null.FloatFrom(value)})
+}
+
+func (s *BatteryTest) Test_Instances() {
+	client := NewBatteryClient(-1)
+	parse(client, "N/d41243b4f71d/battery/289/Soc", 80)
+	parse(client, "N/d41243b4f71d/battery/289/Dc/0/Voltage", 13.2)
+	parse(client, "N/d41243b4f71d/battery/288/Soc", 55)
+	parse(client, "N/d41243b4f71d/battery/288/Dc/0/Voltage", 12.6)
+	parse(client, "N/d41243b4f71d/battery/288/Dc/1/Voltage", 12.1)
+	s.Assert().Equal([]int{288, 289}, client.Instances())
+	soc, ok := client.GetBatteryStateOfCharge()
+	s.Assert().True(ok)
+	s.Assert().Equal(55.0, soc)
+	voltage, _ := client.GetBatteryVoltage()
+	s.Assert().Equal(12.6, voltage)
+	voltage, _ = client.Instance(289).GetBatteryVoltage()
+	s.Assert().Equal(13.2, voltage)
+	_, ok = client.Instance(290).GetBatteryStateOfCharge()
+	s.Assert().False(ok)
+}
+
+func (s *BatteryTest) Test_Primary() {
+	client := NewBatteryClient(289)
+	parse(client, "N/d41243b4f71d/battery/288/Soc", 55)
+	_, ok := client.GetBatteryStateOfCharge()
+	s.Assert().False(ok)
+	parse(client, "N/d41243b4f71d/battery/289/Soc", 80)
+	soc, ok := client.GetBatteryStateOfCharge()
+	s.Assert().True(ok)
+	s.Assert().Equal(80.0, soc)
+}
+
+func TestBatterySuite(t *testing.T) {
+	suite.Run(t, new(BatteryTest))
+}
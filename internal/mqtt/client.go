@@ -5,279 +5,183 @@ import (
 	"fmt"
 	"github.com/jgulick48/rv-homekit/internal/openevse"
 	"log"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/jgulick48/rv-homekit/internal/bmv"
 	"github.com/jgulick48/rv-homekit/internal/models"
+	"github.com/jgulick48/rv-homekit/internal/mqtt/alarms"
 	"github.com/jgulick48/rv-homekit/internal/mqtt/battery"
+	"github.com/jgulick48/rv-homekit/internal/mqtt/dcdc"
+	"github.com/jgulick48/rv-homekit/internal/mqtt/gps"
+	"github.com/jgulick48/rv-homekit/internal/mqtt/gxio"
 	"github.com/jgulick48/rv-homekit/internal/mqtt/pv"
+	"github.com/jgulick48/rv-homekit/internal/mqtt/system"
+	"github.com/jgulick48/rv-homekit/internal/mqtt/tank"
+	"github.com/jgulick48/rv-homekit/internal/mqtt/temperature"
 	"github.com/jgulick48/rv-homekit/internal/mqtt/vebus"
 	"github.com/jgulick48/rv-homekit/internal/openHab"
 )
 
+// discoveryDelay is how long to collect topics after connecting before the
+// Home Assistant sensors are published for the discovered instances.
+const discoveryDelay = 15 * time.Second
+
 type Client interface {
 	Close()
 	Connect()
+	GetAlarmClient() alarms.Client
 	GetBatteryClient() bmv.Client
+	GetBatteryInstance(instance int) bmv.Client
+	GetDCDCClient() dcdc.Client
 	GetVEBusClient() vebus.Client
+	GetPVClient() pv.Client
+	GetSystemClient() system.Client
+	GetGPSClient() gps.Client
+	GetIOClient() gxio.Client
+	GetTankClient() tank.Client
+	GetTemperatureClient() temperature.Client
 	IsEnabled() bool
-	RegisterOpenHabHPDevice(item *openHab.EnrichedItemDTO)
-	RegisterEVSEHPDevice(item *openevse.Client)
+	RegisterOpenHabHPDevice(item *openHab.EnrichedItemDTO, device models.HighPowerDevice)
+	RegisterEVSEHPDevice(item *openevse.Client, device models.HighPowerDevice)
 	SetMaxChargeCurrent(value float64)
 	SetMaxInputCurrent(value float64)
+	SetRelay(number int, on bool)
+	LimitMaxChargeCurrent(value float64)
+	ClearMaxChargeCurrentLimit()
+	Write(path string, value string)
 }
 
-func NewClient(config models.MQTTConfiguration, dvccConfig models.CurrentLimitConfiguration, inputConfig models.CurrentLimitConfiguration, shoreDetection models.ShoreDetection, debug bool) Client {
+func NewClient(config models.MQTTConfiguration, dvccConfig models.CurrentLimitConfiguration, inputConfig models.CurrentLimitConfiguration, shoreDetection models.ShoreDetection, loadShedding models.LoadShedding, driving models.Driving, debug bool) Client {
 	if config.UseVRM {
 		if config.DeviceID != "" {
-			sum := 0
-			for char := range []rune(config.DeviceID) {
-				sum = sum + char
-			}
-			config.Host = fmt.Sprintf("mqtt%v.victronenergy.com", sum%128)
-			config.Port = 443
+			config.Host = vrmHost(config.DeviceID)
+			config.Port = vrmPort
 			log.Printf("Got host of %s", config.Host)
 		}
 	}
 	if config.Host != "" {
 		c := client{
-			config:       config,
-			dvccConfig:   dvccConfig,
-			done:         make(chan bool),
-			messages:     make(chan mqtt.Message),
-			battery:      battery.NewBatteryClient(),
-			pv:           pv.NewPVClient(),
-			debug:        debug,
-			lastReceived: time.Now(),
+			config:      config,
+			dvccConfig:  dvccConfig,
+			done:        make(chan struct{}),
+			lost:        make(chan error, 1),
+			stopped:     make(chan struct{}),
+			messages:    make(chan mqtt.Message),
+			alarms:      alarms.NewAlarmClient(),
+			battery:     battery.NewBatteryClient(primaryBattery(config)),
+			pv:          pv.NewPVClient(),
+			system:      system.NewSystemClient(),
+			gps:         gps.NewGPSClient(),
+			io:          gxio.NewIOClient(),
+			tank:        tank.NewTankClient(),
+			temperature: temperature.NewTemperatureClient(),
+			dcdc:        dcdc.NewDCDCClient(driving),
+			debug:       debug,
+			chargeLimit: &chargeLimit{},
+			instances:   newInstances(config.Instances),
 		}
-		c.vebus = vebus.NewVeBusClient(dvccConfig, inputConfig, shoreDetection, c.SetMaxChargeCurrent, c.SetMaxInputCurrent)
+		prometheus.MustRegister(connectionState, connectionAttempts, connectionDrops)
+		c.vebus = vebus.NewVeBusClient(dvccConfig, inputConfig, shoreDetection, loadShedding, c.SetMaxChargeCurrent, c.SetMaxInputCurrent, c.gps.GetLocation, c.dcdc.IsDriving)
 		return &c
 	}
-	return &client{config: config}
+	return &client{config: config, chargeLimit: &chargeLimit{}, instances: newInstances(config.Instances)}
 }
 
 type client struct {
 	config       models.MQTTConfiguration
 	dvccConfig   models.CurrentLimitConfiguration
-	done         chan bool
+	done         chan struct{}
+	lost         chan error
+	stopped      chan struct{}
+	started      int32
+	connectOnce  sync.Once
+	closeOnce    sync.Once
+	legacyOnce   sync.Once
+	connMux      sync.RWMutex
 	mqttClient   mqtt.Client
 	messages     chan mqtt.Message
+	alarms       alarms.Client
 	battery      battery.Client
 	vebus        vebus.Client
 	pv           pv.Client
+	system       system.Client
+	gps          gps.Client
+	io           gxio.Client
+	tank         tank.Client
+	temperature  temperature.Client
+	dcdc         dcdc.Client
 	debug        bool
 	hasDVCC      bool
 	hasMaxInput  bool
-	lastReceived time.Time
+	lastReceived int64
+	portalID     atomic.Value
+	chargeLimit  *chargeLimit
+	instances    *instances
 }
 
-func (c *client) Close() {
-	c.done <- true
+// chargeLimit caps every max charge current written, for example while the
+// battery is too cold to charge.
+type chargeLimit struct {
+	mux     sync.Mutex
+	enabled bool
+	value   float64
 }
 
 func (c *client) IsEnabled() bool {
 	return c.config.Host != ""
 }
 
-func (c *client) RegisterOpenHabHPDevice(item *openHab.EnrichedItemDTO) {
+func (c *client) RegisterOpenHabHPDevice(item *openHab.EnrichedItemDTO, device models.HighPowerDevice) {
 	if item != nil {
-		c.vebus.RegisterHPDevice(item.Name, item.Label, item)
+		c.vebus.RegisterHPDevice(item.Name, item.Label, item, device)
 	}
 }
-func (c *client) RegisterEVSEHPDevice(item *openevse.Client) {
+func (c *client) RegisterEVSEHPDevice(item *openevse.Client, device models.HighPowerDevice) {
 	if item != nil {
-		c.vebus.RegisterHPDevice("EVSE", "EVSE", item)
+		c.vebus.RegisterHPDevice("EVSE", "EVSE", item, device)
 	}
 }
 
-func (c *client) Connect() {
-	go func() {
-		for message := range c.messages {
-			c.ProcessData(message.Topic(), message.Payload())
-		}
-	}()
-	log.Printf("Connecting to %s", fmt.Sprintf("tcp://%s:%d", c.config.Host, c.config.Port))
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", c.config.Host, c.config.Port))
-	opts.SetClientID("go_mqtt_client")
-	opts.SetDefaultPublishHandler(c.messagePubHandler)
-	if c.config.Username != "" && c.config.Password != "" {
-		opts.SetUsername(c.config.Username)
-		opts.SetPassword(c.config.Password)
-	}
-	opts.OnConnect = connectHandler
-	opts.OnConnectionLost = c.connectLostHandler
-	c.mqttClient = mqtt.NewClient(opts)
-	if token := c.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Printf("Error connecting to mqtt client: %s", token.Error())
+func (c *client) sub(connection mqtt.Client) error {
+	topic := fmt.Sprintf("N/%s/#", c.config.DeviceID)
+	if c.config.DeviceID == "" {
+		log.Printf("No deviceId configured, subscribing to all GX devices")
+		topic = "N/+/#"
 	}
-	c.sub()
-	defer c.mqttClient.Disconnect(250)
-	c.publishHASensors()
-	c.keepAlive()
-}
-func (c *client) keepAlive() {
-	ticker := time.NewTicker(5 * time.Second)
-	for {
-		select {
-		case <-c.done:
-			return
-		case <-ticker.C:
-			if time.Now().Add(-1 * time.Minute).After(c.lastReceived) {
-				log.Printf("Metrics are getting stale, exiting connection.")
-				return
-			}
-			token := c.mqttClient.Publish(fmt.Sprintf("R/%s/keepalive", c.config.DeviceID), 0, false, "[\"#\"]")
-			token.Wait()
-		}
+	token := connection.Subscribe(topic, 1, nil)
+	if token.Wait() && token.Error() != nil {
+		return token.Error()
 	}
+	log.Printf("Subscribed to topic: %s", topic)
+	return nil
 }
 
-func (c *client) publishHASensors() {
-	log.Println("Publishing HAS sensors to mqtt")
-	sensorDevice := SensorDevice{
-		Manufacturer: "Victron",
-		Name:         c.config.DeviceID,
-		Identifiers:  []string{c.config.DeviceID},
-	}
-	if body, err := json.Marshal(SensorJSON{
-		UniqueId:          fmt.Sprintf("victron_%s_battery_%s_soc", c.config.DeviceID, "288"),
-		Name:              "State of Charge",
-		StateTopic:        fmt.Sprintf("N/%s/battery/%s/Soc", c.config.DeviceID, "288"),
-		StateClass:        "measurement",
-		DeviceClass:       "battery",
-		ValueTemplate:     "{{ value_json.value }}",
-		UnitOfMeasurement: "%",
-		Device:            sensorDevice,
-	}); err == nil {
-		log.Println("Publishing SOC sensor to mqtt")
-		token := c.mqttClient.Publish(fmt.Sprintf("homeassistant/sensor/%s/soc/config", c.config.DeviceID), 0, true, body)
-		token.Wait()
-	}
-	if body, err := json.Marshal(SensorJSON{
-		UniqueId:          fmt.Sprintf("victron_%s_%s_energy_invertertoacout", c.config.DeviceID, "276"),
-		Name:              "Inverter Output Energy",
-		StateTopic:        fmt.Sprintf("N/%s/vebus/%s/Energy/InverterToAcOut", c.config.DeviceID, "276"),
-		StateClass:        "total_increasing",
-		DeviceClass:       "energy",
-		ValueTemplate:     "{{ value_json.value }}",
-		UnitOfMeasurement: "kWh",
-		Device:            sensorDevice,
-	}); err == nil {
-		log.Println("Publishing InverterToAcOut sensor to mqtt")
-		token := c.mqttClient.Publish(fmt.Sprintf("homeassistant/sensor/%s/e_eps/config", c.config.DeviceID), 0, true, body)
-		token.Wait()
-	}
-	if body, err := json.Marshal(SensorJSON{
-		UniqueId:          fmt.Sprintf("victron_%s_%s_energy_acin1toacout", c.config.DeviceID, "276"),
-		Name:              "Inverter Pass Through Energy L1",
-		StateTopic:        fmt.Sprintf("N/%s/vebus/%s/Energy/AcIn1ToAcOut", c.config.DeviceID, "276"),
-		StateClass:        "total_increasing",
-		DeviceClass:       "energy",
-		ValueTemplate:     "{{ value_json.value }}",
-		UnitOfMeasurement: "kWh",
-		Device:            sensorDevice,
-	}); err == nil {
-		log.Println("Publishing AcIn1ToAcOut sensor to mqtt")
-		token := c.mqttClient.Publish(fmt.Sprintf("homeassistant/sensor/%s/e_pass/config", c.config.DeviceID), 0, true, body)
-		token.Wait()
-	}
-	if body, err := json.Marshal(SensorJSON{
-		UniqueId:          fmt.Sprintf("victron_%s_%s_energy_acin1toinverter", c.config.DeviceID, "276"),
-		Name:              "Grid Charge Total L1",
-		StateTopic:        fmt.Sprintf("N/%s/vebus/%s/Energy/AcIn1ToInverter", c.config.DeviceID, "276"),
-		StateClass:        "total_increasing",
-		DeviceClass:       "energy",
-		ValueTemplate:     "{{ value_json.value }}",
-		UnitOfMeasurement: "kWh",
-		Device:            sensorDevice,
-	}); err == nil {
-		log.Println("Publishing AcIn1ToInverter sensor to mqtt")
-		token := c.mqttClient.Publish(fmt.Sprintf("homeassistant/sensor/%s/e_inv_in/config", c.config.DeviceID), 0, true, body)
-		token.Wait()
-	}
-	if body, err := json.Marshal(SensorJSON{
-		UniqueId:          fmt.Sprintf("victron_%s_%s_energy_acouttoacin1", c.config.DeviceID, "276"),
-		Name:              "Grid Output Total L1",
-		StateTopic:        fmt.Sprintf("N/%s/vebus/%s/Energy/AcOutToAcIn1", c.config.DeviceID, "276"),
-		StateClass:        "total_increasing",
-		DeviceClass:       "energy",
-		ValueTemplate:     "{{ value_json.value }}",
-		UnitOfMeasurement: "kWh",
-		Device:            sensorDevice,
-	}); err == nil {
-		log.Println("Publishing AcOutToAcIn1 sensor to mqtt")
-		token := c.mqttClient.Publish(fmt.Sprintf("homeassistant/sensor/%s/e_inv_out_l1/config", c.config.DeviceID), 0, true, body)
-		token.Wait()
+// deviceID returns the configured portal id of the GX device, or the one learned
+// from the topics received when none is configured.
+func (c *client) deviceID() string {
+	if c.config.DeviceID != "" {
+		return c.config.DeviceID
 	}
-	for i := 0; i < 2; i++ {
-		if body, err := json.Marshal(SensorJSON{
-			UniqueId:          fmt.Sprintf("victron_%s_pv%v_yield", c.config.DeviceID, i),
-			Name:              fmt.Sprintf("Solar Energy MPPT %v", i),
-			StateTopic:        fmt.Sprintf("N/%s/solarcharger/%v/Yield/User", c.config.DeviceID, i),
-			StateClass:        "total_increasing",
-			DeviceClass:       "energy",
-			ValueTemplate:     "{{ value_json.value }}",
-			UnitOfMeasurement: "kWh",
-			Device:            sensorDevice,
-		}); err == nil {
-			log.Println("Publishing Yield sensor to mqtt")
-			token := c.mqttClient.Publish(fmt.Sprintf("homeassistant/sensor/%s/e_pv%v/config", c.config.DeviceID, i), 0, true, body)
-			token.Wait()
-		}
-	}
-	if body, err := json.Marshal(SensorJSON{
-		UniqueId:          fmt.Sprintf("victron_%s_battery_%s_chargedEnergy", c.config.DeviceID, "288"),
-		Name:              "Charged Energy",
-		StateTopic:        fmt.Sprintf("N/%s/battery/%s/History/ChargedEnergy", c.config.DeviceID, "288"),
-		StateClass:        "total_increasing",
-		DeviceClass:       "energy",
-		ValueTemplate:     "{{ value_json.value }}",
-		UnitOfMeasurement: "kWh",
-		Device:            sensorDevice,
-	}); err == nil {
-		log.Println("Publishing ChargedEngergy sensor to mqtt")
-		token := c.mqttClient.Publish(fmt.Sprintf("homeassistant/sensor/%s/batt_chrg/config", c.config.DeviceID), 0, true, body)
-		token.Wait()
-	}
-	if body, err := json.Marshal(SensorJSON{
-		UniqueId:          fmt.Sprintf("victron_%s_battery_%s_dischargedEnergy", c.config.DeviceID, "288"),
-		Name:              "Discharged Energy",
-		StateTopic:        fmt.Sprintf("N/%s/battery/%s/History/DischargedEnergy", c.config.DeviceID, "288"),
-		StateClass:        "total_increasing",
-		DeviceClass:       "energy",
-		ValueTemplate:     "{{ value_json.value }}",
-		UnitOfMeasurement: "kWh",
-		Device:            sensorDevice,
-	}); err == nil {
-		log.Println("Publishing dischargedEngergy sensor to mqtt")
-		token := c.mqttClient.Publish(fmt.Sprintf("homeassistant/sensor/%s/batt_dischrg/config", c.config.DeviceID), 0, true, body)
-		token.Wait()
-	}
-}
-
-func (c *client) messagePubHandler(client mqtt.Client, msg mqtt.Message) {
-	c.lastReceived = time.Now()
-	c.messages <- msg
-}
-
-var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
-	log.Println("Connected")
-}
-
-func (c *client) connectLostHandler(client mqtt.Client, err error) {
-	log.Printf("Connect lost: %v", err)
-	c.done <- true
+	id, _ := c.portalID.Load().(string)
+	return id
 }
 
-func (c *client) sub() {
-	topic := "#"
-	token := c.mqttClient.Subscribe(topic, 1, nil)
-	token.Wait()
-	log.Printf("Subscribed to topic: %s", topic)
+// learnPortalID keeps the portal id from the first N/<portalId>/... topic when
+// no deviceId is configured, so writes and keepalives reach the GX.
+func (c *client) learnPortalID(segments []string) {
+	if c.config.DeviceID != "" || segments[0] != "N" || segments[1] == "" {
+		return
+	}
+	if c.portalID.CompareAndSwap(nil, segments[1]) {
+		log.Printf("Using portal id %s of the first GX device seen", segments[1])
+	}
 }
 
 func (c *client) ProcessData(topic string, message []byte) error {
@@ -287,6 +191,11 @@ func (c *client) ProcessData(topic string, message []byte) error {
 		return err
 	}
 	segments := strings.Split(topic, "/")
+	if len(segments) < 3 {
+		return nil
+	}
+	c.learnPortalID(segments)
+	c.instances.observe(segments)
 	parser := c.GetDataParser(segments)
 	parser(segments, payload)
 	if c.debug {
@@ -295,7 +204,13 @@ func (c *client) ProcessData(topic string, message []byte) error {
 	return nil
 }
 
+// GetDataParser returns the parser for a topic. Alarms and error codes are
+// collected from every service before the service's own parser is used.
 func (c *client) GetDataParser(segments []string) func(topic []string, message models.Message) ([]string, float64) {
+	return c.alarms.GetDataParser(segments, c.serviceParser(segments))
+}
+
+func (c *client) serviceParser(segments []string) func(topic []string, message models.Message) ([]string, float64) {
 	switch segments[2] {
 	case "vebus":
 		return c.vebus.GetDataParser(segments, DefaultParser)
@@ -303,21 +218,87 @@ func (c *client) GetDataParser(segments []string) func(topic []string, message m
 		return c.battery.GetDataParser(segments, DefaultParser)
 	case "solarcharger":
 		return c.pv.GetDataParser(segments, DefaultParser)
-	case "system":
-		return c.SystemSettingsParser
+	case "gps":
+		return c.gps.GetDataParser(segments, DefaultParser)
+	case ServiceTank:
+		return c.tank.GetDataParser(segments, DefaultParser)
+	case ServiceTemperature:
+		return c.temperature.GetDataParser(segments, DefaultParser)
+	case ServiceDCDC, ServiceAlternator:
+		return c.dcdc.GetDataParser(segments, DefaultParser)
+	case ServiceSystem:
+		return c.system.GetDataParser(segments, c.io.GetRelayParser(segments, c.SystemSettingsParser))
+	case ServiceDigitalInput:
+		return c.io.GetInputParser(segments, DefaultParser)
+	case "settings":
+		return c.io.GetRelayFunctionParser(segments, DefaultParser)
 	default:
 		return DefaultParser
 	}
 }
 
+// GetAlarmClient returns the alarms and errors reported by the devices on the
+// GX.
+func (c *client) GetAlarmClient() alarms.Client {
+	return c.alarms
+}
+
 func (c *client) GetBatteryClient() bmv.Client {
 	return c.battery
 }
 
+// GetBatteryInstance returns the readings of one battery instance, such as a
+// second shunt or a lithium BMS.
+func (c *client) GetBatteryInstance(instance int) bmv.Client {
+	return c.battery.Instance(instance)
+}
+
+// primaryBattery is the battery instance used for HomeKit and the automations,
+// or -1 to use the lowest instance found.
+func primaryBattery(config models.MQTTConfiguration) int {
+	if instance, ok := config.Instances[ServiceBattery]; ok {
+		return instance
+	}
+	return -1
+}
+
+// GetDCDCClient returns the Orion DC-DC and alternator chargers, which also
+// tell whether the RV is driving.
+func (c *client) GetDCDCClient() dcdc.Client {
+	return c.dcdc
+}
+
 func (c *client) GetVEBusClient() vebus.Client {
 	return c.vebus
 }
 
+func (c *client) GetPVClient() pv.Client {
+	return c.pv
+}
+
+// GetSystemClient returns the totals from the GX system overview, such as the
+// house load, solar power and generator power.
+func (c *client) GetSystemClient() system.Client {
+	return c.system
+}
+
+func (c *client) GetGPSClient() gps.Client {
+	return c.gps
+}
+
+// GetIOClient returns the GX relays and digital inputs.
+func (c *client) GetIOClient() gxio.Client {
+	return c.io
+}
+
+func (c *client) GetTankClient() tank.Client {
+	return c.tank
+}
+
+func (c *client) GetTemperatureClient() temperature.Client {
+	return c.temperature
+}
+
 func DefaultParser(segments []string, message models.Message) ([]string, float64) {
 	return []string{}, 0
 }
@@ -343,28 +324,100 @@ func (c *client) SetMaxChargeCurrent(value float64) {
 	if value < 0 {
 		return
 	}
-	log.Printf("Setting max charge current to %v", value)
-	if !c.mqttClient.IsConnected() {
-		go c.mqttClient.Connect()
-	}
-	token := c.mqttClient.Publish(fmt.Sprintf("W/%s/settings/0/Settings/SystemSetup/MaxChargeCurrent", c.config.DeviceID), 0, false, fmt.Sprintf("{\"value\": %v}", value))
-	token.Wait()
-	if token.Error() != nil {
-		log.Printf("Error setting mach charge current %s", token.Error())
+	c.chargeLimit.mux.Lock()
+	if c.chargeLimit.enabled && value > c.chargeLimit.value {
+		log.Printf("Max charge current of %v is above the limit of %v, using the limit", value, c.chargeLimit.value)
+		value = c.chargeLimit.value
 	}
+	c.chargeLimit.mux.Unlock()
+	log.Printf("Setting max charge current to %v", value)
+	c.publishWrite("settings/0/Settings/SystemSetup/MaxChargeCurrent", value)
+}
+
+// LimitMaxChargeCurrent caps the max charge current written by
+// SetMaxChargeCurrent until ClearMaxChargeCurrentLimit is called.
+func (c *client) LimitMaxChargeCurrent(value float64) {
+	c.chargeLimit.mux.Lock()
+	defer c.chargeLimit.mux.Unlock()
+	c.chargeLimit.enabled = true
+	c.chargeLimit.value = value
+}
+
+func (c *client) ClearMaxChargeCurrentLimit() {
+	c.chargeLimit.mux.Lock()
+	defer c.chargeLimit.mux.Unlock()
+	c.chargeLimit.enabled = false
 }
+
 func (c *client) SetMaxInputCurrent(value float64) {
 	//Name of topic for max charge current settings (N/d41243b4f71d/vebus/276/Ac/ActiveIn/CurrentLimit)
 	if value < 0 {
 		return
 	}
+	instance, ok := c.instances.get(ServiceVEBus)
+	if !ok {
+		log.Printf("No VE.Bus instance found, skipping max input current setting")
+		return
+	}
 	log.Printf("Setting max input current to %v", value)
-	if !c.mqttClient.IsConnected() {
-		go c.mqttClient.Connect()
+	c.publishWrite(fmt.Sprintf("vebus/%v/Ac/ActiveIn/CurrentLimit", instance), value)
+}
+
+// SetRelay switches one of the GX relays. Relays that are not set to manual on
+// the GX are switched by the GX itself and are left alone.
+func (c *client) SetRelay(number int, on bool) {
+	if relay, _ := c.io.GetRelay(number); !relay.Manual() {
+		log.Printf("GX relay %v is not set to manual, skipping.", number)
+		return
+	}
+	value := 0
+	if on {
+		value = 1
+	}
+	log.Printf("Setting GX relay %v to %v", number, value)
+	c.publishWrite(fmt.Sprintf("system/0/Relay/%v/State", number), value)
+}
+
+// Write sets a value on the GX device at the given path under W/<portalId>/.
+// Numeric values are written as numbers and anything else as a string. A path
+// that leaves out the instance, such as vebus/Mode, is written to the
+// discovered instance of that service.
+func (c *client) Write(path string, value string) {
+	if !c.IsEnabled() {
+		log.Printf("MQTT not configured, skipping write of %s to %s", value, path)
+		return
+	}
+	path, ok := c.instances.resolve(path)
+	if !ok {
+		log.Printf("No instance found for %s, skipping write of %s", path, value)
+		return
+	}
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		c.publishWrite(path, number)
+		return
+	}
+	c.publishWrite(path, value)
+}
+
+func (c *client) publishWrite(path string, value interface{}) {
+	connection := c.connection()
+	if connection == nil || !connection.IsConnected() {
+		log.Printf("Not connected to mqtt, skipping write of %v to %s", value, path)
+		return
+	}
+	deviceID := c.deviceID()
+	if deviceID == "" {
+		log.Printf("No GX device seen yet, skipping write of %v to %s", value, path)
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{"value": value})
+	if err != nil {
+		log.Printf("Error encoding value for %s: %s", path, err)
+		return
 	}
-	token := c.mqttClient.Publish(fmt.Sprintf("W/%s/vebus/276/Ac/ActiveIn/CurrentLimit", c.config.DeviceID), 0, false, fmt.Sprintf("{\"value\": %v}", value))
+	token := connection.Publish(fmt.Sprintf("W/%s/%s", deviceID, path), 0, false, body)
 	token.Wait()
 	if token.Error() != nil {
-		log.Printf("Error setting mach charge current %s", token.Error())
+		log.Printf("Error writing %v to %s %s", value, path, token.Error())
 	}
 }
@@ -19,7 +19,7 @@ func (s *MQTTTest) SetupTest() {
 		Port:     1883,
 		DeviceID: "d41243b4f71d",
 	}
-	s.mqtt = NewClient(config, models.CurrentLimitConfiguration{}, models.CurrentLimitConfiguration{}, models.ShoreDetection{}, false)
+	s.mqtt = NewClient(config, models.CurrentLimitConfiguration{}, models.CurrentLimitConfiguration{}, models.ShoreDetection{}, models.LoadShedding{}, models.Driving{}, false)
 }
 
 func (s *MQTTTest) Test_shouldShutOff_SOC() {
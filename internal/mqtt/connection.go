@@ -0,0 +1,273 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jgulick48/rv-homekit/internal/metrics"
+)
+
+const (
+	connectionDisconnected = 0
+	connectionConnecting   = 1
+	connectionConnected    = 2
+
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = 2 * time.Minute
+	keepAliveInterval   = 5 * time.Second
+	staleTimeout        = time.Minute
+)
+
+var (
+	connectionState = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mqttConnectionState",
+			Help: "State of the GX MQTT connection, 0 disconnected, 1 connecting and 2 connected.",
+		},
+	)
+	connectionAttempts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqttConnectionAttempts",
+			Help: "Number of attempts to connect to the GX MQTT broker by result.",
+		},
+		[]string{"result"},
+	)
+	connectionDrops = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqttConnectionDrops",
+			Help: "Number of times the GX MQTT connection was dropped by reason.",
+		},
+		[]string{"reason"},
+	)
+)
+
+var errStale = errors.New("no messages received")
+
+// Connect starts the connection manager. It keeps one connection to the broker
+// open, reconnecting with an exponential backoff, and feeds every message
+// through a single reader. Calling it again has no effect.
+func (c *client) Connect() {
+	if !c.IsEnabled() {
+		return
+	}
+	c.connectOnce.Do(func() {
+		atomic.StoreInt32(&c.started, 1)
+		go c.pump()
+		go func() {
+			defer close(c.stopped)
+			c.manage()
+		}()
+	})
+}
+
+// Close disconnects from the broker and stops the connection manager, waiting
+// for the connection to close.
+func (c *client) Close() {
+	if !c.IsEnabled() {
+		return
+	}
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	if atomic.LoadInt32(&c.started) == 1 {
+		<-c.stopped
+	}
+}
+
+// pump is the only reader of incoming messages.
+func (c *client) pump() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case message := <-c.messages:
+			c.ProcessData(message.Topic(), message.Payload())
+		}
+	}
+}
+
+func (c *client) manage() {
+	backoff := minReconnectBackoff
+	for {
+		c.setConnectionState(connectionConnecting)
+		connection, err := c.dial()
+		if err != nil {
+			c.setConnectionState(connectionDisconnected)
+			connectionAttempts.WithLabelValues("failed").Inc()
+			log.Printf("Error connecting to mqtt client: %s, retrying in %s", err, backoff)
+			select {
+			case <-c.done:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = backoff * 2
+			if backoff > maxReconnectBackoff {
+				backoff = maxReconnectBackoff
+			}
+			continue
+		}
+		connectionAttempts.WithLabelValues("connected").Inc()
+		backoff = minReconnectBackoff
+		c.setConnectionState(connectionConnected)
+		err = c.watch(connection)
+		if err == nil {
+			c.publishAvailability(connection, availabilityOffline)
+		}
+		c.setConnection(nil)
+		connection.Disconnect(250)
+		c.setConnectionState(connectionDisconnected)
+		if err == nil {
+			log.Printf("Mqtt connection closed.")
+			return
+		}
+		reason := "lost"
+		if errors.Is(err, errStale) {
+			reason = "stale"
+		}
+		connectionDrops.WithLabelValues(reason).Inc()
+		log.Printf("Mqtt connection %s: %s, reconnecting.", reason, err)
+	}
+}
+
+// dial opens a new connection to the broker and subscribes to the GX topics.
+func (c *client) dial() (mqtt.Client, error) {
+	log.Printf("Connecting to %s", brokerURL(c.config))
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(brokerURL(c.config))
+	opts.SetClientID("go_mqtt_client")
+	opts.SetDefaultPublishHandler(c.messagePubHandler)
+	opts.SetAutoReconnect(false)
+	if username, password := credentials(c.config); username != "" && password != "" {
+		opts.SetUsername(username)
+		opts.SetPassword(password)
+	}
+	if useTLS(c.config) {
+		tlsConfig, err := newTLSConfig(c.config.TLS, c.config.Host)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	if !c.config.HomeAssistant.Disabled && c.config.DeviceID != "" {
+		// Home Assistant marks the sensors unavailable if the bridge drops off.
+		opts.SetWill(c.availabilityTopic(), availabilityOffline, 1, true)
+	}
+	opts.OnConnect = connectHandler
+	opts.OnConnectionLost = c.connectLostHandler
+	connection := mqtt.NewClient(opts)
+	if token := connection.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	// Drop any loss reported by an earlier connection.
+	select {
+	case <-c.lost:
+	default:
+	}
+	c.received()
+	c.setConnection(connection)
+	if err := c.sub(connection); err != nil {
+		connection.Disconnect(250)
+		c.setConnection(nil)
+		return nil, err
+	}
+	c.publishAvailability(connection, availabilityOnline)
+	return connection, nil
+}
+
+// watch sends keepalives on the connection until it is lost, goes stale or the
+// client is closed, which returns nil.
+func (c *client) watch(connection mqtt.Client) error {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+	c.sendKeepAlive(connection)
+	discovery := time.NewTimer(discoveryDelay)
+	defer discovery.Stop()
+	discovering, discovered := true, 0
+	for {
+		select {
+		case <-c.done:
+			return nil
+		case err := <-c.lost:
+			return err
+		case <-discovery.C:
+			// Give the GX time to publish its topics so the instances are known.
+			discovering, discovered = false, c.instances.version()
+			c.publishHASensors(connection)
+		case <-ticker.C:
+			if since := time.Since(c.lastReceivedAt()); since > staleTimeout {
+				return fmt.Errorf("%w for %s", errStale, since.Round(time.Second))
+			}
+			c.sendKeepAlive(connection)
+			if !discovering && c.instances.version() != discovered {
+				// A device showed up later, such as an MPPT waking up.
+				discovering = true
+				discovery.Reset(discoveryDelay)
+			}
+		}
+	}
+}
+
+// sendKeepAlive asks the GX device to keep publishing. Without a deviceId it
+// waits until the portal id has been learned from a received topic.
+func (c *client) sendKeepAlive(connection mqtt.Client) {
+	deviceID := c.deviceID()
+	if deviceID == "" {
+		return
+	}
+	token := connection.Publish(fmt.Sprintf("R/%s/keepalive", deviceID), 0, false, "[\"#\"]")
+	token.Wait()
+}
+
+func (c *client) messagePubHandler(client mqtt.Client, msg mqtt.Message) {
+	c.received()
+	select {
+	case c.messages <- msg:
+	case <-c.done:
+	}
+}
+
+var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
+	log.Println("Connected")
+}
+
+func (c *client) connectLostHandler(client mqtt.Client, err error) {
+	log.Printf("Connect lost: %v", err)
+	select {
+	case c.lost <- err:
+	default:
+	}
+}
+
+func (c *client) received() {
+	atomic.StoreInt64(&c.lastReceived, time.Now().UnixNano())
+}
+
+func (c *client) lastReceivedAt() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastReceived))
+}
+
+// connection returns the current broker connection, or nil while disconnected.
+func (c *client) connection() mqtt.Client {
+	c.connMux.RLock()
+	defer c.connMux.RUnlock()
+	return c.mqttClient
+}
+
+func (c *client) setConnection(connection mqtt.Client) {
+	c.connMux.Lock()
+	defer c.connMux.Unlock()
+	c.mqttClient = connection
+}
+
+func (c *client) setConnectionState(state int) {
+	connectionState.Set(float64(state))
+	if metrics.StatsEnabled {
+		metrics.SendGaugeMetricWithRate("mqtt.connectionState", float64(state), []string{fmt.Sprintf("host:%s", c.config.Host)}, 1)
+	}
+}
@@ -0,0 +1,74 @@
+package mqtt
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+type ConnectionTest struct {
+	suite.Suite
+}
+
+func newTestClient(port int) *client {
+	return &client{
+		config:      models.MQTTConfiguration{Host: "127.0.0.1", Port: port, DeviceID: "d41243b4f71d"},
+		done:        make(chan struct{}),
+		lost:        make(chan error, 1),
+		stopped:     make(chan struct{}),
+		messages:    make(chan mqtt.Message),
+		chargeLimit: &chargeLimit{},
+		instances:   newInstances(nil),
+	}
+}
+
+func (s *ConnectionTest) Test_CloseWhileRetrying() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	c := newTestClient(port)
+	c.Connect()
+	c.Connect()
+	time.Sleep(100 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		s.Fail("Close did not stop the connection manager")
+	}
+	s.Assert().Nil(c.connection())
+}
+
+func (s *ConnectionTest) Test_WriteWhileDisconnected() {
+	c := newTestClient(1883)
+	c.Write("vebus/276/Mode", "3")
+}
+
+func (s *ConnectionTest) Test_KeepAliveLearnsPortalID() {
+	c := newTestClient(1883)
+	c.config.DeviceID = ""
+	connection := &publishRecorder{published: map[string][]byte{}}
+	c.sendKeepAlive(connection)
+	s.Assert().Empty(connection.published)
+
+	c.learnPortalID(strings.Split("N/d41243b4f71d/system/0/Serial", "/"))
+	c.learnPortalID(strings.Split("N/c0619ab1ee20/system/0/Serial", "/"))
+	c.sendKeepAlive(connection)
+	s.Assert().Contains(connection.published, "R/d41243b4f71d/keepalive")
+	s.Assert().Len(connection.published, 1)
+}
+
+func TestConnectionSuite(t *testing.T) {
+	suite.Run(t, new(ConnectionTest))
+}
@@ -0,0 +1,186 @@
+package dcdc
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+const (
+	defaultMinCurrent = 1
+	defaultOffDelay   = 5 * time.Minute
+)
+
+// chargingStates are the State values of a charger that is putting energy into
+// the battery: bulk, absorption, float, storage and equalize.
+var chargingStates = map[int]bool{
+	3: true,
+	4: true,
+	5: true,
+	6: true,
+	7: true,
+}
+
+func NewDCDCClient(config models.Driving) Client {
+	if config.MinCurrent == 0 {
+		config.MinCurrent = defaultMinCurrent
+	}
+	if config.OffDelay.Duration == 0 {
+		config.OffDelay.Duration = defaultOffDelay
+	}
+	return Client{
+		mux:      &sync.RWMutex{},
+		chargers: map[string]*Charger{},
+		config:   config,
+		driving:  &drivingState{},
+	}
+}
+
+// Charger is the last reported state of one Orion DC-DC or alternator charger.
+type Charger struct {
+	Service      string
+	Instance     int
+	CustomName   string
+	State        int
+	HasState     bool
+	Voltage      float64
+	Current      float64
+	Power        float64
+	InputVoltage float64
+}
+
+// Name returns the custom name of the charger, or a name made from its service
+// and instance.
+func (c Charger) Name() string {
+	if c.CustomName != "" {
+		return c.CustomName
+	}
+	if c.Service == "alternator" {
+		return fmt.Sprintf("Alternator %v", c.Instance)
+	}
+	return fmt.Sprintf("DC-DC %v", c.Instance)
+}
+
+// charging reports whether the charger is putting out at least minCurrent amps.
+// Alternators that only report power are converted using the output voltage.
+func (c Charger) charging(minCurrent float64) bool {
+	current := c.Current
+	if current == 0 && c.Voltage > 0 {
+		current = c.Power / c.Voltage
+	}
+	if current < minCurrent {
+		return false
+	}
+	// Alternators without a State topic are judged by current alone.
+	return !c.HasState || chargingStates[c.State]
+}
+
+type drivingState struct {
+	lastCharging time.Time
+}
+
+type Client struct {
+	mux      *sync.RWMutex
+	chargers map[string]*Charger
+	config   models.Driving
+	driving  *drivingState
+}
+
+func (c Client) GetDataParser(segments []string, defaultParser func(topic []string, message models.Message) ([]string, float64)) func(topic []string, message models.Message) ([]string, float64) {
+	if len(segments) < 5 {
+		return defaultParser
+	}
+	if _, err := strconv.Atoi(segments[3]); err != nil {
+		return defaultParser
+	}
+	switch strings.Join(segments[4:], "/") {
+	case "Dc/0/Voltage", "Dc/0/Current", "Dc/0/Power", "Dc/In/V", "State", "CustomName":
+		return c.ParseChargerData
+	default:
+		return defaultParser
+	}
+}
+
+func (c Client) ParseChargerData(segments []string, message models.Message) ([]string, float64) {
+	instance, err := strconv.Atoi(segments[3])
+	if err != nil {
+		return []string{}, 0
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	key := fmt.Sprintf("%s/%v", segments[2], instance)
+	charger, ok := c.chargers[key]
+	if !ok {
+		charger = &Charger{Service: segments[2], Instance: instance}
+		c.chargers[key] = charger
+	}
+	switch strings.Join(segments[4:], "/") {
+	case "Dc/0/Voltage":
+		charger.Voltage = message.Value.Float64
+	case "Dc/0/Current":
+		charger.Current = message.Value.Float64
+	case "Dc/0/Power":
+		charger.Power = message.Value.Float64
+	case "Dc/In/V":
+		charger.InputVoltage = message.Value.Float64
+	case "State":
+		charger.State = int(message.Value.Float64)
+		charger.HasState = message.Value.Valid
+	case "CustomName":
+		charger.CustomName = message.Text
+	}
+	if charger.charging(c.config.MinCurrent) {
+		c.driving.lastCharging = time.Now()
+	}
+	return []string{}, 0
+}
+
+// GetChargers returns every DC-DC and alternator charger seen so far ordered
+// by service and instance.
+func (c Client) GetChargers() []Charger {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	chargers := make([]Charger, 0, len(c.chargers))
+	for _, charger := range c.chargers {
+		chargers = append(chargers, *charger)
+	}
+	sort.Slice(chargers, func(i, j int) bool {
+		if chargers[i].Service != chargers[j].Service {
+			return chargers[i].Service < chargers[j].Service
+		}
+		return chargers[i].Instance < chargers[j].Instance
+	})
+	return chargers
+}
+
+// IsCharging reports whether any charger is charging from the engine right now.
+func (c Client) IsCharging() bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	for _, charger := range c.chargers {
+		if charger.charging(c.config.MinCurrent) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsDriving reports whether a charger has been charging from the engine within
+// the configured off delay.
+func (c Client) IsDriving() bool {
+	return c.isDriving(time.Now())
+}
+
+func (c Client) isDriving(now time.Time) bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	if c.driving.lastCharging.IsZero() {
+		return false
+	}
+	return now.Sub(c.driving.lastCharging) < c.config.OffDelay.Duration
+}
@@ -0,0 +1,62 @@
+package dcdc
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+type DCDCTest struct {
+	suite.Suite
+}
+
+func parse(client Client, topic string, value float64) {
+	segments := strings.Split(topic, "/")
+	parser := client.GetDataParser(segments, func(topic []string, message models.Message) ([]string, float64) {
+		return []string{}, 0
+	})
+	parser(segments, models.Message{Value: null.FloatFrom(value)})
+}
+
+func (s *DCDCTest) Test_Driving() {
+	client := NewDCDCClient(models.Driving{MinCurrent: 2})
+	parse(client, "N/d41243b4f71d/dcdc/278/State", 3)
+	parse(client, "N/d41243b4f71d/dcdc/278/Dc/0/Current", 1)
+	s.Assert().False(client.IsCharging())
+	s.Assert().False(client.IsDriving())
+	parse(client, "N/d41243b4f71d/dcdc/278/Dc/0/Current", 18)
+	s.Assert().True(client.IsCharging())
+	s.Assert().True(client.IsDriving())
+	parse(client, "N/d41243b4f71d/dcdc/278/State", 0)
+	parse(client, "N/d41243b4f71d/dcdc/278/Dc/0/Current", 0)
+	s.Assert().False(client.IsCharging())
+	s.Assert().True(client.isDriving(time.Now().Add(4 * time.Minute)))
+	s.Assert().False(client.isDriving(time.Now().Add(6 * time.Minute)))
+}
+
+func (s *DCDCTest) Test_OffStateIsNotCharging() {
+	client := NewDCDCClient(models.Driving{MinCurrent: 2})
+	parse(client, "N/d41243b4f71d/dcdc/278/State", 0)
+	parse(client, "N/d41243b4f71d/dcdc/278/Dc/0/Current", 3)
+	s.Assert().False(client.IsCharging())
+	s.Assert().False(client.IsDriving())
+}
+
+func (s *DCDCTest) Test_AlternatorPower() {
+	client := NewDCDCClient(models.Driving{})
+	parse(client, "N/d41243b4f71d/alternator/0/Dc/0/Voltage", 14)
+	parse(client, "N/d41243b4f71d/alternator/0/Dc/0/Power", 700)
+	s.Assert().True(client.IsCharging())
+	chargers := client.GetChargers()
+	s.Require().Len(chargers, 1)
+	s.Assert().Equal("Alternator 0", chargers[0].Name())
+}
+
+func TestDCDCTest(t *testing.T) {
+	suite.Run(t, new(DCDCTest))
+}
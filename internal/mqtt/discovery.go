@@ -0,0 +1,233 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	defaultDiscoveryPrefix = "homeassistant"
+	availabilityOnline     = "online"
+	availabilityOffline    = "offline"
+)
+
+// haEntity describes one value the parsers understand so Home Assistant can be
+// told about it. ID is unique within the service and, with the service, is the
+// key used to turn the entity on or off in the config.
+type haEntity struct {
+	Service     string
+	ID          string
+	Path        string
+	Name        string
+	DeviceClass string
+	StateClass  string
+	Unit        string
+	Disabled    bool
+}
+
+// haEntities is every value published to Home Assistant for each instance of
+// its service seen on the GX. The second and third AC lines are off by default
+// as most RVs are single phase.
+var haEntities = []haEntity{
+	{Service: ServiceBattery, ID: "soc", Path: "Soc", Name: "State of Charge", DeviceClass: "battery", StateClass: "measurement", Unit: "%"},
+	{Service: ServiceBattery, ID: "voltage", Path: "Dc/0/Voltage", Name: "Battery Voltage", DeviceClass: "voltage", StateClass: "measurement", Unit: "V"},
+	{Service: ServiceBattery, ID: "current", Path: "Dc/0/Current", Name: "Battery Current", DeviceClass: "current", StateClass: "measurement", Unit: "A"},
+	{Service: ServiceBattery, ID: "power", Path: "Dc/0/Power", Name: "Battery Power", DeviceClass: "power", StateClass: "measurement", Unit: "W"},
+	{Service: ServiceBattery, ID: "temperature", Path: "Dc/0/Temperature", Name: "Battery Temperature", DeviceClass: "temperature", StateClass: "measurement", Unit: "°C"},
+	{Service: ServiceBattery, ID: "timeToGo", Path: "TimeToGo", Name: "Time to Go", DeviceClass: "duration", StateClass: "measurement", Unit: "s"},
+	{Service: ServiceBattery, ID: "chargedEnergy", Path: "History/ChargedEnergy", Name: "Charged Energy", DeviceClass: "energy", StateClass: "total_increasing", Unit: "kWh"},
+	{Service: ServiceBattery, ID: "dischargedEnergy", Path: "History/DischargedEnergy", Name: "Discharged Energy", DeviceClass: "energy", StateClass: "total_increasing", Unit: "kWh"},
+
+	{Service: ServiceVEBus, ID: "acInL1Voltage", Path: "Ac/ActiveIn/L1/V", Name: "AC Input Voltage L1", DeviceClass: "voltage", StateClass: "measurement", Unit: "V"},
+	{Service: ServiceVEBus, ID: "acInL1Current", Path: "Ac/ActiveIn/L1/I", Name: "AC Input Current L1", DeviceClass: "current", StateClass: "measurement", Unit: "A"},
+	{Service: ServiceVEBus, ID: "acInL1Power", Path: "Ac/ActiveIn/L1/P", Name: "AC Input Power L1", DeviceClass: "power", StateClass: "measurement", Unit: "W"},
+	{Service: ServiceVEBus, ID: "acInL1Frequency", Path: "Ac/ActiveIn/L1/F", Name: "AC Input Frequency L1", DeviceClass: "frequency", StateClass: "measurement", Unit: "Hz"},
+	{Service: ServiceVEBus, ID: "acInL2Voltage", Path: "Ac/ActiveIn/L2/V", Name: "AC Input Voltage L2", DeviceClass: "voltage", StateClass: "measurement", Unit: "V", Disabled: true},
+	{Service: ServiceVEBus, ID: "acInL2Current", Path: "Ac/ActiveIn/L2/I", Name: "AC Input Current L2", DeviceClass: "current", StateClass: "measurement", Unit: "A", Disabled: true},
+	{Service: ServiceVEBus, ID: "acInL2Power", Path: "Ac/ActiveIn/L2/P", Name: "AC Input Power L2", DeviceClass: "power", StateClass: "measurement", Unit: "W", Disabled: true},
+	{Service: ServiceVEBus, ID: "acInL3Voltage", Path: "Ac/ActiveIn/L3/V", Name: "AC Input Voltage L3", DeviceClass: "voltage", StateClass: "measurement", Unit: "V", Disabled: true},
+	{Service: ServiceVEBus, ID: "acInL3Current", Path: "Ac/ActiveIn/L3/I", Name: "AC Input Current L3", DeviceClass: "current", StateClass: "measurement", Unit: "A", Disabled: true},
+	{Service: ServiceVEBus, ID: "acInL3Power", Path: "Ac/ActiveIn/L3/P", Name: "AC Input Power L3", DeviceClass: "power", StateClass: "measurement", Unit: "W", Disabled: true},
+	{Service: ServiceVEBus, ID: "acOutL1Voltage", Path: "Ac/Out/L1/V", Name: "AC Output Voltage L1", DeviceClass: "voltage", StateClass: "measurement", Unit: "V"},
+	{Service: ServiceVEBus, ID: "acOutL1Current", Path: "Ac/Out/L1/I", Name: "AC Output Current L1", DeviceClass: "current", StateClass: "measurement", Unit: "A"},
+	{Service: ServiceVEBus, ID: "acOutL1Power", Path: "Ac/Out/L1/P", Name: "AC Output Power L1", DeviceClass: "power", StateClass: "measurement", Unit: "W"},
+	{Service: ServiceVEBus, ID: "acOutL2Voltage", Path: "Ac/Out/L2/V", Name: "AC Output Voltage L2", DeviceClass: "voltage", StateClass: "measurement", Unit: "V", Disabled: true},
+	{Service: ServiceVEBus, ID: "acOutL2Current", Path: "Ac/Out/L2/I", Name: "AC Output Current L2", DeviceClass: "current", StateClass: "measurement", Unit: "A", Disabled: true},
+	{Service: ServiceVEBus, ID: "acOutL2Power", Path: "Ac/Out/L2/P", Name: "AC Output Power L2", DeviceClass: "power", StateClass: "measurement", Unit: "W", Disabled: true},
+	{Service: ServiceVEBus, ID: "acOutL3Voltage", Path: "Ac/Out/L3/V", Name: "AC Output Voltage L3", DeviceClass: "voltage", StateClass: "measurement", Unit: "V", Disabled: true},
+	{Service: ServiceVEBus, ID: "acOutL3Current", Path: "Ac/Out/L3/I", Name: "AC Output Current L3", DeviceClass: "current", StateClass: "measurement", Unit: "A", Disabled: true},
+	{Service: ServiceVEBus, ID: "acOutL3Power", Path: "Ac/Out/L3/P", Name: "AC Output Power L3", DeviceClass: "power", StateClass: "measurement", Unit: "W", Disabled: true},
+	{Service: ServiceVEBus, ID: "inputCurrentLimit", Path: "Ac/ActiveIn/CurrentLimit", Name: "Input Current Limit", DeviceClass: "current", StateClass: "measurement", Unit: "A"},
+	{Service: ServiceVEBus, ID: "inverterToAcOut", Path: "Energy/InverterToAcOut", Name: "Inverter Output Energy", DeviceClass: "energy", StateClass: "total_increasing", Unit: "kWh"},
+	{Service: ServiceVEBus, ID: "acIn1ToAcOut", Path: "Energy/AcIn1ToAcOut", Name: "Inverter Pass Through Energy L1", DeviceClass: "energy", StateClass: "total_increasing", Unit: "kWh"},
+	{Service: ServiceVEBus, ID: "acIn1ToInverter", Path: "Energy/AcIn1ToInverter", Name: "Grid Charge Total L1", DeviceClass: "energy", StateClass: "total_increasing", Unit: "kWh"},
+	{Service: ServiceVEBus, ID: "acOutToAcIn1", Path: "Energy/AcOutToAcIn1", Name: "Grid Output Total L1", DeviceClass: "energy", StateClass: "total_increasing", Unit: "kWh"},
+
+	{Service: ServiceSolarCharger, ID: "power", Path: "Yield/Power", Name: "Solar Power", DeviceClass: "power", StateClass: "measurement", Unit: "W"},
+	{Service: ServiceSolarCharger, ID: "pvVoltage", Path: "Pv/V", Name: "PV Voltage", DeviceClass: "voltage", StateClass: "measurement", Unit: "V"},
+	{Service: ServiceSolarCharger, ID: "current", Path: "Dc/0/Current", Name: "Solar Charge Current", DeviceClass: "current", StateClass: "measurement", Unit: "A"},
+	{Service: ServiceSolarCharger, ID: "yield", Path: "Yield/User", Name: "Solar Energy", DeviceClass: "energy", StateClass: "total_increasing", Unit: "kWh"},
+
+	{Service: ServiceDCDC, ID: "current", Path: "Dc/0/Current", Name: "DC-DC Charge Current", DeviceClass: "current", StateClass: "measurement", Unit: "A"},
+	{Service: ServiceDCDC, ID: "inputVoltage", Path: "Dc/In/V", Name: "DC-DC Input Voltage", DeviceClass: "voltage", StateClass: "measurement", Unit: "V"},
+	{Service: ServiceAlternator, ID: "power", Path: "Dc/0/Power", Name: "Alternator Power", DeviceClass: "power", StateClass: "measurement", Unit: "W"},
+
+	{Service: ServiceTank, ID: "level", Path: "Level", Name: "Level", StateClass: "measurement", Unit: "%"},
+	{Service: ServiceTemperature, ID: "temperature", Path: "Temperature", Name: "Temperature", DeviceClass: "temperature", StateClass: "measurement", Unit: "°C"},
+	{Service: ServiceTemperature, ID: "humidity", Path: "Humidity", Name: "Humidity", DeviceClass: "humidity", StateClass: "measurement", Unit: "%"},
+
+	{Service: ServiceSystem, ID: "dcSystemPower", Path: "Dc/System/Power", Name: "DC Loads", DeviceClass: "power", StateClass: "measurement", Unit: "W"},
+	{Service: ServiceSystem, ID: "acConsumptionL1", Path: "Ac/Consumption/L1/Power", Name: "AC Loads L1", DeviceClass: "power", StateClass: "measurement", Unit: "W"},
+	{Service: ServiceSystem, ID: "gridL1", Path: "Ac/Grid/L1/Power", Name: "Shore Power L1", DeviceClass: "power", StateClass: "measurement", Unit: "W"},
+	{Service: ServiceSystem, ID: "gensetL1", Path: "Ac/Genset/L1/Power", Name: "Generator Power L1", DeviceClass: "power", StateClass: "measurement", Unit: "W"},
+	{Service: ServiceSystem, ID: "pvPower", Path: "Dc/Pv/Power", Name: "Total Solar Power", DeviceClass: "power", StateClass: "measurement", Unit: "W"},
+}
+
+// entityEnabled applies the config override for an entity, if any.
+func (c *client) entityEnabled(entity haEntity) bool {
+	if enabled, ok := c.config.HomeAssistant.Entities[fmt.Sprintf("%s/%s", entity.Service, entity.ID)]; ok {
+		return enabled
+	}
+	return !entity.Disabled
+}
+
+// availabilityTopic is where the bridge publishes online and the broker
+// publishes the bridge's last will.
+func (c *client) availabilityTopic() string {
+	if c.config.HomeAssistant.AvailabilityTopic != "" {
+		return c.config.HomeAssistant.AvailabilityTopic
+	}
+	return fmt.Sprintf("rv-homekit/%s/status", c.config.DeviceID)
+}
+
+func (c *client) discoveryPrefix() string {
+	if c.config.HomeAssistant.Prefix != "" {
+		return c.config.HomeAssistant.Prefix
+	}
+	return defaultDiscoveryPrefix
+}
+
+// instanceName is added to the entity name to tell instances apart. Tanks and
+// temperature sensors always use their name from the GX, other services only
+// when there is more than one instance.
+func (c *client) instanceName(service string, instance int, count int) string {
+	switch service {
+	case ServiceTank:
+		if tank, ok := c.tank.GetTank(instance); ok {
+			return tank.Name()
+		}
+		return fmt.Sprintf("Tank %v", instance)
+	case ServiceTemperature:
+		if sensor, ok := c.temperature.GetSensor(instance); ok {
+			return sensor.Name()
+		}
+		return fmt.Sprintf("Temperature %v", instance)
+	}
+	if count > 1 {
+		return fmt.Sprintf("%v", instance)
+	}
+	return ""
+}
+
+// publishHASensors publishes a Home Assistant discovery config for every enabled
+// entity of each service instance seen on the GX. It is run again when new
+// instances show up, and publishing an unchanged config again has no effect.
+func (c *client) publishHASensors(connection mqtt.Client) {
+	if c.config.HomeAssistant.Disabled {
+		return
+	}
+	if c.config.DeviceID == "" {
+		log.Println("No deviceId configured, skipping Home Assistant discovery")
+		return
+	}
+	c.legacyOnce.Do(func() {
+		c.clearLegacySensors(connection)
+	})
+	log.Println("Publishing HAS sensors to mqtt")
+	sensorDevice := SensorDevice{
+		Manufacturer: "Victron",
+		Name:         c.config.DeviceID,
+		Identifiers:  []string{c.config.DeviceID},
+	}
+	published := 0
+	for _, entity := range haEntities {
+		if !c.entityEnabled(entity) {
+			continue
+		}
+		instances := c.instances.all(entity.Service)
+		for _, instance := range instances {
+			name := entity.Name
+			if prefix := c.instanceName(entity.Service, instance, len(instances)); prefix != "" {
+				name = fmt.Sprintf("%s %s", prefix, name)
+			}
+			id := fmt.Sprintf("%s_%v_%s", entity.Service, instance, entity.ID)
+			c.publishHASensor(connection, id, SensorJSON{
+				UniqueId:          fmt.Sprintf("victron_%s_%s", c.config.DeviceID, id),
+				Name:              name,
+				StateTopic:        fmt.Sprintf("N/%s/%s/%v/%s", c.config.DeviceID, entity.Service, instance, entity.Path),
+				AvailabilityTopic: c.availabilityTopic(),
+				StateClass:        entity.StateClass,
+				DeviceClass:       entity.DeviceClass,
+				ValueTemplate:     "{{ value_json.value }}",
+				UnitOfMeasurement: entity.Unit,
+				Device:            sensorDevice,
+			})
+			published++
+		}
+	}
+	log.Printf("Published %v Home Assistant sensors", published)
+}
+
+// legacySensorIDs are the discovery ids published before the entity table. The
+// solar yield was published as e_pv0 and e_pv1, and later as e_pv<instance>.
+func (c *client) legacySensorIDs() []string {
+	ids := []string{"soc", "batt_chrg", "batt_dischrg", "e_eps", "e_pass", "e_inv_in", "e_inv_out_l1", "e_pv0", "e_pv1"}
+	for _, instance := range c.instances.all(ServiceSolarCharger) {
+		if id := fmt.Sprintf("e_pv%v", instance); id != "e_pv0" && id != "e_pv1" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// clearLegacySensors publishes an empty retained config to each legacy discovery
+// topic so Home Assistant removes the old entities instead of keeping them next
+// to the ones from the entity table.
+func (c *client) clearLegacySensors(connection mqtt.Client) {
+	for _, id := range c.legacySensorIDs() {
+		token := connection.Publish(c.discoveryTopic(id), 0, true, "")
+		token.Wait()
+	}
+}
+
+func (c *client) discoveryTopic(id string) string {
+	return fmt.Sprintf("%s/sensor/%s/%s/config", c.discoveryPrefix(), c.config.DeviceID, id)
+}
+
+// publishHASensor publishes the Home Assistant discovery config for one sensor.
+func (c *client) publishHASensor(connection mqtt.Client, id string, sensor SensorJSON) {
+	body, err := json.Marshal(sensor)
+	if err != nil {
+		return
+	}
+	if c.debug {
+		log.Printf("Publishing %s sensor to mqtt", sensor.Name)
+	}
+	token := connection.Publish(c.discoveryTopic(id), 0, true, body)
+	token.Wait()
+}
+
+// publishAvailability marks the bridge online or offline for Home Assistant.
+func (c *client) publishAvailability(connection mqtt.Client, state string) {
+	if c.config.HomeAssistant.Disabled || c.config.DeviceID == "" {
+		return
+	}
+	token := connection.Publish(c.availabilityTopic(), 1, true, state)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("Error publishing availability %s: %s", state, token.Error())
+	}
+}
@@ -0,0 +1,115 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+	"github.com/jgulick48/rv-homekit/internal/mqtt/tank"
+)
+
+// publishRecorder is a connection that keeps what is published.
+type publishRecorder struct {
+	mqtt.Client
+	published map[string][]byte
+}
+
+func (p *publishRecorder) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	switch value := payload.(type) {
+	case []byte:
+		p.published[topic] = value
+	case string:
+		p.published[topic] = []byte(value)
+	}
+	return &mqtt.DummyToken{}
+}
+
+type DiscoveryTest struct {
+	suite.Suite
+	client     *client
+	connection *publishRecorder
+}
+
+func (s *DiscoveryTest) SetupTest() {
+	s.client = &client{
+		config: models.MQTTConfiguration{
+			DeviceID: "d41243b4f71d",
+			HomeAssistant: models.HomeAssistantDiscovery{
+				Entities: map[string]bool{"battery/timeToGo": false, "vebus/acOutL2Power": true},
+			},
+		},
+		tank:      tank.NewTankClient(),
+		instances: newInstances(nil),
+	}
+	s.connection = &publishRecorder{published: map[string][]byte{}}
+	for _, topic := range []string{
+		"N/d41243b4f71d/vebus/276/Ac/Out/L1/P",
+		"N/d41243b4f71d/battery/288/Soc",
+		"N/d41243b4f71d/tank/20/Level",
+		"N/d41243b4f71d/tank/21/Level",
+	} {
+		s.client.instances.observe(strings.Split(topic, "/"))
+	}
+	s.client.tank.ParseTankData(strings.Split("N/d41243b4f71d/tank/21/CustomName", "/"), models.Message{Text: "Fresh"})
+}
+
+func (s *DiscoveryTest) sensor(id string) (SensorJSON, bool) {
+	var sensor SensorJSON
+	body, ok := s.connection.published["homeassistant/sensor/d41243b4f71d/"+id+"/config"]
+	if !ok {
+		return sensor, false
+	}
+	s.Require().NoError(json.Unmarshal(body, &sensor))
+	return sensor, true
+}
+
+func (s *DiscoveryTest) Test_PublishesObservedInstances() {
+	s.client.publishHASensors(s.connection)
+	soc, ok := s.sensor("battery_288_soc")
+	s.Require().True(ok)
+	s.Assert().Equal("N/d41243b4f71d/battery/288/Soc", soc.StateTopic)
+	s.Assert().Equal("rv-homekit/d41243b4f71d/status", soc.AvailabilityTopic)
+	s.Assert().Equal("battery", soc.DeviceClass)
+	s.Assert().Equal("State of Charge", soc.Name)
+	_, ok = s.sensor("battery_288_timeToGo")
+	s.Assert().False(ok)
+	_, ok = s.sensor("vebus_276_acOutL2Power")
+	s.Assert().True(ok)
+	_, ok = s.sensor("vebus_276_acOutL3Power")
+	s.Assert().False(ok)
+	_, ok = s.sensor("solarcharger_0_power")
+	s.Assert().False(ok)
+	fresh, ok := s.sensor("tank_21_level")
+	s.Require().True(ok)
+	s.Assert().Equal("Fresh Level", fresh.Name)
+	s.Assert().Empty(fresh.DeviceClass)
+	other, _ := s.sensor("tank_20_level")
+	s.Assert().Equal("Tank 20 Level", other.Name)
+}
+
+func (s *DiscoveryTest) Test_ClearsLegacySensors() {
+	s.client.instances.observe(strings.Split("N/d41243b4f71d/solarcharger/279/Yield/User", "/"))
+	s.client.publishHASensors(s.connection)
+	for _, id := range []string{"soc", "batt_chrg", "e_eps", "e_inv_out_l1", "e_pv0", "e_pv1", "e_pv279"} {
+		body, ok := s.connection.published["homeassistant/sensor/d41243b4f71d/"+id+"/config"]
+		s.Assert().True(ok, id)
+		s.Assert().Empty(body, id)
+	}
+	_, ok := s.sensor("solarcharger_279_yield")
+	s.Assert().True(ok)
+}
+
+func (s *DiscoveryTest) Test_Disabled() {
+	s.client.config.HomeAssistant.Disabled = true
+	s.client.publishHASensors(s.connection)
+	s.client.publishAvailability(s.connection, availabilityOnline)
+	s.Assert().Empty(s.connection.published)
+}
+
+func TestDiscoverySuite(t *testing.T) {
+	suite.Run(t, new(DiscoveryTest))
+}
@@ -0,0 +1,80 @@
+package gps
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+func NewGPSClient() Client {
+	return Client{
+		mux:      &sync.RWMutex{},
+		position: &position{},
+	}
+}
+
+type position struct {
+	latitude     float64
+	longitude    float64
+	hasLatitude  bool
+	hasLongitude bool
+	fix          bool
+}
+
+type Client struct {
+	mux      *sync.RWMutex
+	position *position
+}
+
+func (c Client) GetDataParser(segments []string, defaultParser func(topic []string, message models.Message) ([]string, float64)) func(topic []string, message models.Message) ([]string, float64) {
+	if len(segments) < 5 {
+		return defaultParser
+	}
+	switch segments[4] {
+	case "Position", "Fix":
+		return c.ParsePositionData
+	default:
+		return defaultParser
+	}
+}
+
+func (c Client) ParsePositionData(segments []string, message models.Message) ([]string, float64) {
+	if !message.Value.Valid {
+		return []string{}, 0
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	switch segments[len(segments)-1] {
+	case "Latitude":
+		c.position.latitude = message.Value.Float64
+		c.position.hasLatitude = true
+	case "Longitude":
+		c.position.longitude = message.Value.Float64
+		c.position.hasLongitude = true
+	case "Fix":
+		c.position.fix = message.Value.Float64 == 1
+	}
+	return []string{}, 0
+}
+
+// GetPosition returns the last reported latitude and longitude if the GPS has a
+// fix.
+func (c Client) GetPosition() (float64, float64, bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	if !c.position.fix || !c.position.hasLatitude || !c.position.hasLongitude {
+		return 0, 0, false
+	}
+	return c.position.latitude, c.position.longitude, true
+}
+
+// GetLocation returns the position rounded to roughly 100 meters so it can be
+// used to recognise the same campsite, or an empty string without a fix.
+func (c Client) GetLocation() string {
+	latitude, longitude, ok := c.GetPosition()
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%.3f,%.3f", latitude, longitude)
+}
@@ -0,0 +1,270 @@
+package gxio
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+// Kinds of HomeKit sensor a digital input is shown as.
+const (
+	KindContact = "contact"
+	KindLeak    = "leak"
+	KindSmoke   = "smoke"
+)
+
+// inputKinds maps the Type a digital input is configured as on the GX to the
+// sensor it is shown as. Pulse meters and disabled inputs are left out.
+var inputKinds = map[int]string{
+	2:  KindContact, // door alarm
+	3:  KindLeak,    // bilge pump
+	4:  KindLeak,    // bilge alarm
+	5:  KindContact, // burglar alarm
+	6:  KindSmoke,   // smoke alarm
+	7:  KindSmoke,   // fire alarm
+	8:  KindSmoke,   // CO2 alarm
+	9:  KindContact, // generator
+	10: KindContact, // touch input control
+}
+
+// activeStates are the State values of a digital input that count as
+// triggered: high, on, yes, open, alarm and running.
+var activeStates = map[int]bool{
+	1:  true,
+	3:  true,
+	5:  true,
+	6:  true,
+	9:  true,
+	10: true,
+}
+
+func NewIOClient() Client {
+	return Client{
+		mux:    &sync.RWMutex{},
+		relays: map[int]*Relay{},
+		inputs: map[int]*Input{},
+	}
+}
+
+// relayFunctionManual is the relay Function setting on the GX that leaves the
+// relay to be switched by hand. Relays used for the generator, alarms or tank
+// pumps are switched by the GX itself.
+const relayFunctionManual = 2
+
+// Relay is the last reported state of one of the GX relays.
+type Relay struct {
+	Number      int
+	On          bool
+	Function    int
+	HasFunction bool
+}
+
+// Manual reports whether the relay is set to manual on the GX and so can be
+// switched without fighting the GX.
+func (r Relay) Manual() bool {
+	return r.HasFunction && r.Function == relayFunctionManual
+}
+
+// Name returns the name of the relay as numbered on the GX.
+func (r Relay) Name() string {
+	return fmt.Sprintf("GX Relay %v", r.Number+1)
+}
+
+// Input is the last reported state of one GX digital input.
+type Input struct {
+	Instance   int
+	CustomName string
+	Type       int
+	State      int
+	Alarm      bool
+}
+
+// Name returns the custom name of the input, or a name made from its instance.
+func (i Input) Name() string {
+	if i.CustomName != "" {
+		return i.CustomName
+	}
+	return fmt.Sprintf("Digital Input %v", i.Instance)
+}
+
+// Kind returns the sensor the input is shown as, or false when its type is not
+// shown.
+func (i Input) Kind() (string, bool) {
+	kind, ok := inputKinds[i.Type]
+	return kind, ok
+}
+
+// Active reports whether the input is triggered or in alarm.
+func (i Input) Active() bool {
+	return i.Alarm || activeStates[i.State]
+}
+
+type Client struct {
+	mux    *sync.RWMutex
+	relays map[int]*Relay
+	inputs map[int]*Input
+}
+
+// GetRelayParser returns the parser for system/0/Relay/<n>/State, falling back
+// to defaultParser for other system topics.
+func (c Client) GetRelayParser(segments []string, defaultParser func(topic []string, message models.Message) ([]string, float64)) func(topic []string, message models.Message) ([]string, float64) {
+	if len(segments) != 7 || segments[4] != "Relay" || segments[6] != "State" {
+		return defaultParser
+	}
+	if _, err := strconv.Atoi(segments[5]); err != nil {
+		return defaultParser
+	}
+	return c.ParseRelayData
+}
+
+func (c Client) ParseRelayData(segments []string, message models.Message) ([]string, float64) {
+	number, err := strconv.Atoi(segments[5])
+	if err != nil || !message.Value.Valid {
+		return []string{}, 0
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	relay, ok := c.relays[number]
+	if !ok {
+		relay = &Relay{Number: number}
+		c.relays[number] = relay
+	}
+	relay.On = message.Value.Float64 == 1
+	return []string{}, 0
+}
+
+// GetRelayFunctionParser returns the parser for the relay Function settings,
+// settings/0/Settings/Relay/Function for the first relay and
+// settings/0/Settings/Relay/<n>/Function for the others, falling back to
+// defaultParser for other settings.
+func (c Client) GetRelayFunctionParser(segments []string, defaultParser func(topic []string, message models.Message) ([]string, float64)) func(topic []string, message models.Message) ([]string, float64) {
+	if _, ok := relayFunctionNumber(segments); ok {
+		return c.ParseRelayFunction
+	}
+	return defaultParser
+}
+
+func relayFunctionNumber(segments []string) (int, bool) {
+	if len(segments) < 7 || segments[4] != "Settings" || segments[5] != "Relay" || segments[len(segments)-1] != "Function" {
+		return 0, false
+	}
+	switch len(segments) {
+	case 7:
+		return 0, true
+	case 8:
+		number, err := strconv.Atoi(segments[6])
+		return number, err == nil
+	}
+	return 0, false
+}
+
+func (c Client) ParseRelayFunction(segments []string, message models.Message) ([]string, float64) {
+	number, ok := relayFunctionNumber(segments)
+	if !ok || !message.Value.Valid {
+		return []string{}, 0
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	relay, ok := c.relays[number]
+	if !ok {
+		relay = &Relay{Number: number}
+		c.relays[number] = relay
+	}
+	relay.Function = int(message.Value.Float64)
+	relay.HasFunction = true
+	return []string{}, 0
+}
+
+func (c Client) GetInputParser(segments []string, defaultParser func(topic []string, message models.Message) ([]string, float64)) func(topic []string, message models.Message) ([]string, float64) {
+	if len(segments) != 5 {
+		return defaultParser
+	}
+	if _, err := strconv.Atoi(segments[3]); err != nil {
+		return defaultParser
+	}
+	switch segments[4] {
+	case "State", "Type", "Alarm", "CustomName":
+		return c.ParseInputData
+	default:
+		return defaultParser
+	}
+}
+
+func (c Client) ParseInputData(segments []string, message models.Message) ([]string, float64) {
+	instance, err := strconv.Atoi(segments[3])
+	if err != nil {
+		return []string{}, 0
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	input, ok := c.inputs[instance]
+	if !ok {
+		input = &Input{Instance: instance}
+		c.inputs[instance] = input
+	}
+	switch segments[4] {
+	case "State":
+		input.State = int(message.Value.Float64)
+	case "Type":
+		input.Type = int(message.Value.Float64)
+	case "Alarm":
+		input.Alarm = message.Value.Float64 != 0
+	case "CustomName":
+		input.CustomName = strings.TrimSpace(message.Text)
+	}
+	return []string{}, 0
+}
+
+// GetRelay returns the last reported state of a relay.
+func (c Client) GetRelay(number int) (Relay, bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	relay, ok := c.relays[number]
+	if !ok {
+		return Relay{}, false
+	}
+	return *relay, true
+}
+
+// GetRelays returns every relay seen so far ordered by number.
+func (c Client) GetRelays() []Relay {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	relays := make([]Relay, 0, len(c.relays))
+	for _, relay := range c.relays {
+		relays = append(relays, *relay)
+	}
+	sort.Slice(relays, func(i, j int) bool {
+		return relays[i].Number < relays[j].Number
+	})
+	return relays
+}
+
+// GetInput returns the last reported state of a digital input.
+func (c Client) GetInput(instance int) (Input, bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	input, ok := c.inputs[instance]
+	if !ok {
+		return Input{}, false
+	}
+	return *input, true
+}
+
+// GetInputs returns every digital input seen so far ordered by instance.
+func (c Client) GetInputs() []Input {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	inputs := make([]Input, 0, len(c.inputs))
+	for _, input := range c.inputs {
+		inputs = append(inputs, *input)
+	}
+	sort.Slice(inputs, func(i, j int) bool {
+		return inputs[i].Instance < inputs[j].Instance
+	})
+	return inputs
+}
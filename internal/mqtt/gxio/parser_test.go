@@ -0,0 +1,80 @@
+package gxio
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+type IOTest struct {
+	suite.Suite
+}
+
+func defaultParser(topic []string, message models.Message) ([]string, float64) {
+	return []string{"default"}, 0
+}
+
+func parse(parser func([]string, func([]string, models.Message) ([]string, float64)) func([]string, models.Message) ([]string, float64), topic string, payload string) []string {
+	segments := strings.Split(topic, "/")
+	var message models.Message
+	_ = json.Unmarshal([]byte(payload), &message)
+	result, _ := parser(segments, defaultParser)(segments, message)
+	return result
+}
+
+func (s *IOTest) Test_Relays() {
+	client := NewIOClient()
+	parse(client.GetRelayParser, "N/d41243b4f71d/system/0/Relay/1/State", `{"value": 1}`)
+	parse(client.GetRelayParser, "N/d41243b4f71d/system/0/Relay/0/State", `{"value": 0}`)
+	s.Assert().Equal([]string{"default"}, parse(client.GetRelayParser, "N/d41243b4f71d/system/0/Control/Dvcc", `{"value": 1}`))
+	relays := client.GetRelays()
+	s.Require().Len(relays, 2)
+	s.Assert().False(relays[0].On)
+	s.Assert().True(relays[1].On)
+	s.Assert().Equal("GX Relay 2", relays[1].Name())
+}
+
+func (s *IOTest) Test_RelayFunction() {
+	client := NewIOClient()
+	parse(client.GetRelayParser, "N/d41243b4f71d/system/0/Relay/0/State", `{"value": 1}`)
+	parse(client.GetRelayFunctionParser, "N/d41243b4f71d/settings/0/Settings/Relay/Function", `{"value": 1}`)
+	parse(client.GetRelayFunctionParser, "N/d41243b4f71d/settings/0/Settings/Relay/1/Function", `{"value": 2}`)
+	s.Assert().Equal([]string{"default"}, parse(client.GetRelayFunctionParser, "N/d41243b4f71d/settings/0/Settings/Relay/Polarity", `{"value": 0}`))
+	generator, _ := client.GetRelay(0)
+	s.Assert().True(generator.On)
+	s.Assert().False(generator.Manual())
+	manual, _ := client.GetRelay(1)
+	s.Assert().True(manual.Manual())
+	parse(client.GetRelayParser, "N/d41243b4f71d/system/0/Relay/2/State", `{"value": 0}`)
+	unknown, _ := client.GetRelay(2)
+	s.Assert().False(unknown.Manual())
+}
+
+func (s *IOTest) Test_Inputs() {
+	client := NewIOClient()
+	parse(client.GetInputParser, "N/d41243b4f71d/digitalinput/3/Type", `{"value": 4}`)
+	parse(client.GetInputParser, "N/d41243b4f71d/digitalinput/3/CustomName", `{"value": "Bilge"}`)
+	parse(client.GetInputParser, "N/d41243b4f71d/digitalinput/3/State", `{"value": 8}`)
+	parse(client.GetInputParser, "N/d41243b4f71d/digitalinput/4/Type", `{"value": 1}`)
+	input, ok := client.GetInput(3)
+	s.Require().True(ok)
+	kind, ok := input.Kind()
+	s.Assert().True(ok)
+	s.Assert().Equal(KindLeak, kind)
+	s.Assert().Equal("Bilge", input.Name())
+	s.Assert().False(input.Active())
+	parse(client.GetInputParser, "N/d41243b4f71d/digitalinput/3/State", `{"value": 9}`)
+	input, _ = client.GetInput(3)
+	s.Assert().True(input.Active())
+	pulse, _ := client.GetInput(4)
+	_, ok = pulse.Kind()
+	s.Assert().False(ok)
+}
+
+func TestIOTest(t *testing.T) {
+	suite.Run(t, new(IOTest))
+}
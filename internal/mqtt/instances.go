@@ -0,0 +1,141 @@
+package mqtt
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	ServiceVEBus        = "vebus"
+	ServiceBattery      = "battery"
+	ServiceSolarCharger = "solarcharger"
+	ServiceTank         = "tank"
+	ServiceTemperature  = "temperature"
+	ServiceDCDC         = "dcdc"
+	ServiceAlternator   = "alternator"
+	ServiceDigitalInput = "digitalinput"
+	ServiceSystem       = "system"
+)
+
+// discoveredServices are the services whose instances are tracked from the
+// topics the GX publishes.
+var discoveredServices = map[string]bool{
+	ServiceVEBus:        true,
+	ServiceBattery:      true,
+	ServiceSolarCharger: true,
+	ServiceTank:         true,
+	ServiceTemperature:  true,
+	ServiceDCDC:         true,
+	ServiceAlternator:   true,
+	ServiceDigitalInput: true,
+	ServiceSystem:       true,
+}
+
+// instances keeps the device instances seen for each service along with any
+// configured overrides.
+type instances struct {
+	mux       sync.RWMutex
+	overrides map[string]int
+	found     map[string][]int
+	changes   int
+}
+
+func newInstances(overrides map[string]int) *instances {
+	return &instances{
+		overrides: overrides,
+		found:     make(map[string][]int),
+	}
+}
+
+// observe records the instance from a N/<portalId>/<service>/<instance>/...
+// topic.
+func (i *instances) observe(segments []string) {
+	if len(segments) < 4 || !discoveredServices[segments[2]] {
+		return
+	}
+	instance, err := strconv.Atoi(segments[3])
+	if err != nil {
+		return
+	}
+	service := segments[2]
+	i.mux.RLock()
+	known := containsInstance(i.found[service], instance)
+	i.mux.RUnlock()
+	if known {
+		return
+	}
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	if containsInstance(i.found[service], instance) {
+		return
+	}
+	found := append(i.found[service], instance)
+	sort.Ints(found)
+	i.found[service] = found
+	i.changes++
+	log.Printf("Discovered %s instance %v", service, instance)
+}
+
+// version changes whenever a new instance is discovered.
+func (i *instances) version() int {
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	return i.changes
+}
+
+func containsInstance(list []int, instance int) bool {
+	for _, item := range list {
+		if item == instance {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the instance to use for a service: the configured override, or
+// else the lowest instance discovered.
+func (i *instances) get(service string) (int, bool) {
+	if instance, ok := i.overrides[service]; ok {
+		return instance, true
+	}
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	if len(i.found[service]) == 0 {
+		return 0, false
+	}
+	return i.found[service][0], true
+}
+
+// all returns every discovered instance of a service, or just the override
+// when one is configured.
+func (i *instances) all(service string) []int {
+	if instance, ok := i.overrides[service]; ok {
+		return []int{instance}
+	}
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	list := make([]int, len(i.found[service]))
+	copy(list, i.found[service])
+	return list
+}
+
+// resolve fills in the instance for paths like vebus/Mode that name a
+// discovered service without one. Other paths are returned unchanged.
+func (i *instances) resolve(path string) (string, bool) {
+	segments := strings.SplitN(path, "/", 2)
+	if len(segments) < 2 || !discoveredServices[segments[0]] {
+		return path, true
+	}
+	if _, err := strconv.Atoi(strings.SplitN(segments[1], "/", 2)[0]); err == nil {
+		return path, true
+	}
+	instance, ok := i.get(segments[0])
+	if !ok {
+		return path, false
+	}
+	return fmt.Sprintf("%s/%v/%s", segments[0], instance, segments[1]), true
+}
@@ -0,0 +1,60 @@
+package mqtt
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type InstancesTest struct {
+	suite.Suite
+}
+
+func (s *InstancesTest) Test_discovered() {
+	found := newInstances(nil)
+	found.observe(strings.Split("N/d41243b4f71d/vebus/276/Ac/ActiveIn/CurrentLimit", "/"))
+	found.observe(strings.Split("N/d41243b4f71d/solarcharger/279/Yield/User", "/"))
+	found.observe(strings.Split("N/d41243b4f71d/solarcharger/278/Yield/User", "/"))
+	found.observe(strings.Split("N/d41243b4f71d/system/0/Dc/Battery/Soc", "/"))
+	instance, ok := found.get(ServiceVEBus)
+	s.Assert().True(ok)
+	s.Assert().Equal(276, instance)
+	s.Assert().Equal([]int{278, 279}, found.all(ServiceSolarCharger))
+	_, ok = found.get(ServiceBattery)
+	s.Assert().False(ok)
+	version := found.version()
+	found.observe(strings.Split("N/d41243b4f71d/solarcharger/278/Pv/V", "/"))
+	s.Assert().Equal(version, found.version())
+	found.observe(strings.Split("N/d41243b4f71d/tank/20/Level", "/"))
+	s.Assert().Equal(version+1, found.version())
+}
+
+func (s *InstancesTest) Test_override() {
+	found := newInstances(map[string]int{ServiceVEBus: 257})
+	found.observe(strings.Split("N/d41243b4f71d/vebus/276/Mode", "/"))
+	instance, ok := found.get(ServiceVEBus)
+	s.Assert().True(ok)
+	s.Assert().Equal(257, instance)
+	s.Assert().Equal([]int{257}, found.all(ServiceVEBus))
+}
+
+func (s *InstancesTest) Test_resolve() {
+	found := newInstances(nil)
+	found.observe(strings.Split("N/d41243b4f71d/vebus/276/Mode", "/"))
+	path, ok := found.resolve("vebus/Mode")
+	s.Assert().True(ok)
+	s.Assert().Equal("vebus/276/Mode", path)
+	path, ok = found.resolve("vebus/276/Mode")
+	s.Assert().True(ok)
+	s.Assert().Equal("vebus/276/Mode", path)
+	path, ok = found.resolve("settings/0/Settings/SystemSetup/MaxChargeCurrent")
+	s.Assert().True(ok)
+	s.Assert().Equal("settings/0/Settings/SystemSetup/MaxChargeCurrent", path)
+	_, ok = found.resolve("battery/Relay/0/State")
+	s.Assert().False(ok)
+}
+
+func TestInstancesSuite(t *testing.T) {
+	suite.Run(t, new(InstancesTest))
+}
@@ -4,10 +4,11 @@ type SensorJSON struct {
 	UniqueId          string       `json:"unique_id"`
 	Name              string       `json:"name"`
 	StateTopic        string       `json:"state_topic"`
-	StateClass        string       `json:"state_class"`
-	DeviceClass       string       `json:"device_class"`
+	AvailabilityTopic string       `json:"availability_topic,omitempty"`
+	StateClass        string       `json:"state_class,omitempty"`
+	DeviceClass       string       `json:"device_class,omitempty"`
 	ValueTemplate     string       `json:"value_template"`
-	UnitOfMeasurement string       `json:"unit_of_measurement"`
+	UnitOfMeasurement string       `json:"unit_of_measurement,omitempty"`
 	Device            SensorDevice `json:"device"`
 }
 
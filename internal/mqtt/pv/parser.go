@@ -15,7 +15,7 @@ import (
 func NewPVClient() Client {
 	client := Client{
 		values: map[string]pvMetric{},
-		mux:    sync.RWMutex{},
+		mux:    &sync.RWMutex{},
 	}
 	prometheus.MustRegister(pvMeasurements)
 	go func() {
@@ -84,10 +84,40 @@ func (c *Client) sendAllMetrics() {
 }
 
 type Client struct {
-	mux    sync.RWMutex
+	mux    *sync.RWMutex
 	values map[string]pvMetric
 }
 
+// sum adds up a measurement across all solar chargers.
+func (c Client) sum(name string) (float64, bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	total, found := float64(0), false
+	for _, value := range c.values {
+		if value.name == name {
+			total += value.value
+			found = true
+		}
+	}
+	return total, found
+}
+
+// GetPower returns the combined output power of the solar chargers in watts.
+func (c Client) GetPower() (float64, bool) {
+	return c.sum("pv_charger_watts")
+}
+
+// GetYieldToday returns the combined yield of the solar chargers today in kWh.
+func (c Client) GetYieldToday() (float64, bool) {
+	return c.sum("pv_history_yield_today")
+}
+
+// GetYieldYesterday returns the combined yield of the solar chargers yesterday
+// in kWh.
+func (c Client) GetYieldYesterday() (float64, bool) {
+	return c.sum("pv_history_yield_yesterday")
+}
+
 func (c Client) GetDataParser(segments []string, defaultParser func(topic []string, message models.Message) ([]string, float64)) func(topic []string, message models.Message) ([]string, float64) {
 	if len(segments) < 5 {
 		return defaultParser
@@ -0,0 +1,204 @@
+package system
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jgulick48/rv-homekit/internal/metrics"
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+// Names of the signals derived from the system overview.
+const (
+	HouseLoad   = "houseLoad"
+	SolarPower  = "solarPower"
+	GensetPower = "gensetPower"
+)
+
+// acTotals are the system/0 AC groups that publish a power reading per phase.
+var acTotals = map[string]string{
+	"Consumption":         "acConsumption",
+	"ConsumptionOnInput":  "acConsumptionOnInput",
+	"ConsumptionOnOutput": "acConsumptionOnOutput",
+	"Grid":                "grid",
+	"Genset":              "genset",
+	"PvOnGrid":            "pvOnGrid",
+	"PvOnOutput":          "pvOnOutput",
+	"PvOnGenset":          "pvOnGenset",
+}
+
+// dcValues are the system/0 DC readings that are tracked as they are.
+var dcValues = map[string]string{
+	"Dc/System/Power":  "dcSystem",
+	"Dc/Pv/Power":      "dcPv",
+	"Dc/Battery/Power": "dcBattery",
+}
+
+var systemPower = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "systemPower",
+		Help: "Power totals from the GX system overview in watts.",
+	},
+	[]string{
+		"measurement",
+	},
+)
+
+func NewSystemClient() Client {
+	client := Client{
+		values: map[string]float64{},
+		mux:    &sync.RWMutex{},
+	}
+	prometheus.MustRegister(systemPower)
+	go func() {
+		timer := time.NewTicker(10 * time.Second)
+		for range timer.C {
+			client.sendAllMetrics()
+		}
+	}()
+	return client
+}
+
+// Client keeps the latest totals published by the system/0 service, keyed by
+// measurement name and phase.
+type Client struct {
+	mux    *sync.RWMutex
+	values map[string]float64
+}
+
+// GetDataParser returns the parser for the system totals, falling back to
+// defaultParser for other system topics such as Control/Dvcc.
+func (c Client) GetDataParser(segments []string, defaultParser func(topic []string, message models.Message) ([]string, float64)) func(topic []string, message models.Message) ([]string, float64) {
+	if _, ok := measurementKey(segments); ok {
+		return c.ParseSystemData
+	}
+	return defaultParser
+}
+
+// measurementKey maps a topic such as N/<id>/system/0/Ac/Grid/L1/Power to the
+// key its value is stored under.
+func measurementKey(segments []string) (string, bool) {
+	if len(segments) < 6 {
+		return "", false
+	}
+	path := strings.Join(segments[4:], "/")
+	if name, ok := dcValues[path]; ok {
+		return name, true
+	}
+	if len(segments) == 8 && segments[4] == "Ac" && segments[7] == "Power" && strings.HasPrefix(segments[6], "L") {
+		if name, ok := acTotals[segments[5]]; ok {
+			return fmt.Sprintf("%s/%s", name, segments[6]), true
+		}
+	}
+	return "", false
+}
+
+func (c Client) ParseSystemData(segments []string, message models.Message) ([]string, float64) {
+	key, ok := measurementKey(segments)
+	if !ok {
+		return []string{}, 0
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if message.Value.Valid {
+		c.values[key] = message.Value.Float64
+	} else {
+		// Phases and devices that are not present publish null.
+		delete(c.values, key)
+	}
+	return []string{}, 0
+}
+
+// get returns a DC value or the total of an AC group across its phases.
+func (c Client) get(name string) (float64, bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	if value, ok := c.values[name]; ok {
+		return value, true
+	}
+	total, found := float64(0), false
+	for key, value := range c.values {
+		if strings.HasPrefix(key, name+"/") {
+			total += value
+			found = true
+		}
+	}
+	return total, found
+}
+
+// GetDCSystemPower returns the power drawn by the DC loads in watts.
+func (c Client) GetDCSystemPower() (float64, bool) {
+	return c.get("dcSystem")
+}
+
+// GetACConsumption returns the power drawn by the AC loads in watts.
+func (c Client) GetACConsumption() (float64, bool) {
+	return c.get("acConsumption")
+}
+
+// GetGridPower returns the power taken from shore power in watts.
+func (c Client) GetGridPower() (float64, bool) {
+	return c.get("grid")
+}
+
+// GetHouseLoad returns the combined AC and DC loads in watts.
+func (c Client) GetHouseLoad() (float64, bool) {
+	ac, acOk := c.GetACConsumption()
+	dc, dcOk := c.GetDCSystemPower()
+	return ac + dc, acOk || dcOk
+}
+
+// GetSolarPower returns the combined DC and AC coupled solar power in watts.
+func (c Client) GetSolarPower() (float64, bool) {
+	total, found := float64(0), false
+	for _, name := range []string{"dcPv", "pvOnGrid", "pvOnOutput", "pvOnGenset"} {
+		if value, ok := c.get(name); ok {
+			total += value
+			found = true
+		}
+	}
+	return total, found
+}
+
+// GetGensetPower returns the power taken from the generator in watts.
+func (c Client) GetGensetPower() (float64, bool) {
+	return c.get("genset")
+}
+
+// GetSignal returns one of the derived signals by name.
+func (c Client) GetSignal(name string) (float64, bool) {
+	switch name {
+	case HouseLoad:
+		return c.GetHouseLoad()
+	case SolarPower:
+		return c.GetSolarPower()
+	case GensetPower:
+		return c.GetGensetPower()
+	default:
+		return 0, false
+	}
+}
+
+func (c *Client) sendAllMetrics() {
+	if !metrics.StatsEnabled {
+		return
+	}
+	values := map[string]func() (float64, bool){
+		HouseLoad:       c.GetHouseLoad,
+		SolarPower:      c.GetSolarPower,
+		GensetPower:     c.GetGensetPower,
+		"gridPower":     c.GetGridPower,
+		"acConsumption": c.GetACConsumption,
+		"dcSystemPower": c.GetDCSystemPower,
+	}
+	for name, get := range values {
+		if value, ok := get(); ok {
+			metrics.SendGaugeMetric(fmt.Sprintf("system.%s", name), []string{}, value)
+			systemPower.WithLabelValues(name).Set(value)
+		}
+	}
+}
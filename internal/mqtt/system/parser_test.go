@@ -0,0 +1,68 @@
+package system
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/guregu/null"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+type SystemTest struct {
+	suite.Suite
+	client Client
+}
+
+func (s *SystemTest) SetupTest() {
+	s.client = Client{
+		values: map[string]float64{},
+		mux:    &sync.RWMutex{},
+	}
+}
+
+func (s *SystemTest) parse(topic string, value null.Float) {
+	segments := strings.Split(topic, "/")
+	parser := s.client.GetDataParser(segments, func(topic []string, message models.Message) ([]string, float64) {
+		return []string{}, 0
+	})
+	parser(segments, models.Message{Value: value})
+}
+
+func (s *SystemTest) Test_Signals() {
+	s.parse("N/d41243b4f71d/system/0/Ac/Consumption/L1/Power", null.FloatFrom(264))
+	s.parse("N/d41243b4f71d/system/0/Ac/Consumption/L2/Power", null.FloatFrom(100))
+	s.parse("N/d41243b4f71d/system/0/Ac/Consumption/L3/Power", null.Float{})
+	s.parse("N/d41243b4f71d/system/0/Dc/System/Power", null.FloatFrom(36))
+	s.parse("N/d41243b4f71d/system/0/Dc/Pv/Power", null.FloatFrom(671))
+	s.parse("N/d41243b4f71d/system/0/Ac/Genset/L1/Power", null.Float{})
+	load, ok := s.client.GetSignal(HouseLoad)
+	s.Assert().True(ok)
+	s.Assert().Equal(400.0, load)
+	solar, ok := s.client.GetSignal(SolarPower)
+	s.Assert().True(ok)
+	s.Assert().Equal(671.0, solar)
+	_, ok = s.client.GetSignal(GensetPower)
+	s.Assert().False(ok)
+	s.parse("N/d41243b4f71d/system/0/Ac/Genset/L1/Power", null.FloatFrom(1800))
+	genset, ok := s.client.GetGensetPower()
+	s.Assert().True(ok)
+	s.Assert().Equal(1800.0, genset)
+}
+
+func (s *SystemTest) Test_OtherTopicsUseDefault() {
+	called := false
+	segments := strings.Split("N/d41243b4f71d/system/0/Control/Dvcc", "/")
+	parser := s.client.GetDataParser(segments, func(topic []string, message models.Message) ([]string, float64) {
+		called = true
+		return []string{}, 0
+	})
+	parser(segments, models.Message{Value: null.FloatFrom(1)})
+	s.Assert().True(called)
+}
+
+func TestSystemTest(t *testing.T) {
+	suite.Run(t, new(SystemTest))
+}
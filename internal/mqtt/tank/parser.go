@@ -0,0 +1,121 @@
+package tank
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+// fluidTypes are the names of the FluidType values a GX tank reports.
+var fluidTypes = map[int]string{
+	0:  "fuel",
+	1:  "freshWater",
+	2:  "wasteWater",
+	3:  "liveWell",
+	4:  "oil",
+	5:  "blackWater",
+	6:  "gasoline",
+	7:  "diesel",
+	8:  "lpg",
+	9:  "lng",
+	10: "hydraulicOil",
+	11: "rawWater",
+}
+
+func NewTankClient() Client {
+	return Client{
+		mux:   &sync.RWMutex{},
+		tanks: map[int]*Tank{},
+	}
+}
+
+// Tank is the last reported state of one GX tank sender.
+type Tank struct {
+	Instance   int
+	CustomName string
+	FluidType  string
+	Level      float64
+	HasLevel   bool
+}
+
+// Name returns the custom name of the tank, or a name made from its instance.
+func (t Tank) Name() string {
+	if t.CustomName != "" {
+		return t.CustomName
+	}
+	return fmt.Sprintf("Tank %v", t.Instance)
+}
+
+type Client struct {
+	mux   *sync.RWMutex
+	tanks map[int]*Tank
+}
+
+func (c Client) GetDataParser(segments []string, defaultParser func(topic []string, message models.Message) ([]string, float64)) func(topic []string, message models.Message) ([]string, float64) {
+	if len(segments) != 5 {
+		return defaultParser
+	}
+	if _, err := strconv.Atoi(segments[3]); err != nil {
+		return defaultParser
+	}
+	switch segments[4] {
+	case "Level", "FluidType", "CustomName":
+		return c.ParseTankData
+	default:
+		return defaultParser
+	}
+}
+
+func (c Client) ParseTankData(segments []string, message models.Message) ([]string, float64) {
+	instance, err := strconv.Atoi(segments[3])
+	if err != nil {
+		return []string{}, 0
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	tank, ok := c.tanks[instance]
+	if !ok {
+		tank = &Tank{Instance: instance}
+		c.tanks[instance] = tank
+	}
+	switch segments[4] {
+	case "Level":
+		tank.Level = message.Value.Float64
+		tank.HasLevel = message.Value.Valid
+	case "FluidType":
+		if message.Value.Valid {
+			tank.FluidType = fluidTypes[int(message.Value.Float64)]
+		}
+	case "CustomName":
+		tank.CustomName = message.Text
+	}
+	return []string{}, 0
+}
+
+// GetTank returns the last reported state of a tank instance.
+func (c Client) GetTank(instance int) (Tank, bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	tank, ok := c.tanks[instance]
+	if !ok {
+		return Tank{}, false
+	}
+	return *tank, true
+}
+
+// GetTanks returns every tank seen so far ordered by instance.
+func (c Client) GetTanks() []Tank {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	tanks := make([]Tank, 0, len(c.tanks))
+	for _, tank := range c.tanks {
+		tanks = append(tanks, *tank)
+	}
+	sort.Slice(tanks, func(i, j int) bool {
+		return tanks[i].Instance < tanks[j].Instance
+	})
+	return tanks
+}
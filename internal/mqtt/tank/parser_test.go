@@ -0,0 +1,47 @@
+package tank
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+type TankTest struct {
+	suite.Suite
+}
+
+func parse(client Client, topic string, payload string) {
+	segments := strings.Split(topic, "/")
+	parser := client.GetDataParser(segments, func(topic []string, message models.Message) ([]string, float64) {
+		return []string{}, 0
+	})
+	var message models.Message
+	_ = json.Unmarshal([]byte(payload), &message)
+	parser(segments, message)
+}
+
+func (s *TankTest) Test_Tanks() {
+	client := NewTankClient()
+	parse(client, "N/d41243b4f71d/tank/21/Level", `{"value": 62.5}`)
+	parse(client, "N/d41243b4f71d/tank/21/FluidType", `{"value": 1}`)
+	parse(client, "N/d41243b4f71d/tank/21/CustomName", `{"value": "Fresh"}`)
+	parse(client, "N/d41243b4f71d/tank/20/FluidType", `{"value": 5}`)
+	tanks := client.GetTanks()
+	s.Require().Len(tanks, 2)
+	s.Assert().Equal("Tank 20", tanks[0].Name())
+	s.Assert().Equal("blackWater", tanks[0].FluidType)
+	s.Assert().False(tanks[0].HasLevel)
+	tank, ok := client.GetTank(21)
+	s.Assert().True(ok)
+	s.Assert().Equal("Fresh", tank.Name())
+	s.Assert().Equal("freshWater", tank.FluidType)
+	s.Assert().Equal(62.5, tank.Level)
+}
+
+func TestTankTest(t *testing.T) {
+	suite.Run(t, new(TankTest))
+}
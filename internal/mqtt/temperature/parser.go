@@ -0,0 +1,122 @@
+package temperature
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+// sensorTypes are the names of the TemperatureType values a GX sensor reports.
+var sensorTypes = map[int]string{
+	0: "battery",
+	1: "fridge",
+	2: "generic",
+	3: "room",
+	4: "outdoor",
+	5: "waterHeater",
+	6: "freezer",
+}
+
+func NewTemperatureClient() Client {
+	return Client{
+		mux:     &sync.RWMutex{},
+		sensors: map[int]*Sensor{},
+	}
+}
+
+// Sensor is the last reported state of one GX temperature sensor, such as a
+// Ruuvi tag or a temperature input.
+type Sensor struct {
+	Instance    int
+	CustomName  string
+	Type        string
+	Temperature float64
+	HasTemp     bool
+	Humidity    float64
+	HasHumidity bool
+}
+
+// Name returns the custom name of the sensor, or a name made from its instance.
+func (s Sensor) Name() string {
+	if s.CustomName != "" {
+		return s.CustomName
+	}
+	return fmt.Sprintf("Temperature %v", s.Instance)
+}
+
+type Client struct {
+	mux     *sync.RWMutex
+	sensors map[int]*Sensor
+}
+
+func (c Client) GetDataParser(segments []string, defaultParser func(topic []string, message models.Message) ([]string, float64)) func(topic []string, message models.Message) ([]string, float64) {
+	if len(segments) != 5 {
+		return defaultParser
+	}
+	if _, err := strconv.Atoi(segments[3]); err != nil {
+		return defaultParser
+	}
+	switch segments[4] {
+	case "Temperature", "Humidity", "TemperatureType", "CustomName":
+		return c.ParseTemperatureData
+	default:
+		return defaultParser
+	}
+}
+
+func (c Client) ParseTemperatureData(segments []string, message models.Message) ([]string, float64) {
+	instance, err := strconv.Atoi(segments[3])
+	if err != nil {
+		return []string{}, 0
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	sensor, ok := c.sensors[instance]
+	if !ok {
+		sensor = &Sensor{Instance: instance}
+		c.sensors[instance] = sensor
+	}
+	switch segments[4] {
+	case "Temperature":
+		sensor.Temperature = message.Value.Float64
+		sensor.HasTemp = message.Value.Valid
+	case "Humidity":
+		sensor.Humidity = message.Value.Float64
+		sensor.HasHumidity = message.Value.Valid
+	case "TemperatureType":
+		if message.Value.Valid {
+			sensor.Type = sensorTypes[int(message.Value.Float64)]
+		}
+	case "CustomName":
+		sensor.CustomName = message.Text
+	}
+	return []string{}, 0
+}
+
+// GetSensor returns the last reported state of a sensor instance.
+func (c Client) GetSensor(instance int) (Sensor, bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	sensor, ok := c.sensors[instance]
+	if !ok {
+		return Sensor{}, false
+	}
+	return *sensor, true
+}
+
+// GetSensors returns every sensor seen so far ordered by instance.
+func (c Client) GetSensors() []Sensor {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	sensors := make([]Sensor, 0, len(c.sensors))
+	for _, sensor := range c.sensors {
+		sensors = append(sensors, *sensor)
+	}
+	sort.Slice(sensors, func(i, j int) bool {
+		return sensors[i].Instance < sensors[j].Instance
+	})
+	return sensors
+}
@@ -0,0 +1,73 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+const vrmPort = 8883
+
+// vrmHost returns the VRM broker for a portal id. Victron shards the brokers by
+// the sum of the characters of the lower case portal id.
+func vrmHost(deviceID string) string {
+	sum := 0
+	for _, char := range strings.ToLower(deviceID) {
+		sum = sum + int(char)
+	}
+	return fmt.Sprintf("mqtt%v.victronenergy.com", sum%128)
+}
+
+func useTLS(config models.MQTTConfiguration) bool {
+	return config.UseVRM || config.TLS.Enabled
+}
+
+func brokerURL(config models.MQTTConfiguration) string {
+	scheme := "tcp"
+	if useTLS(config) {
+		scheme = "ssl"
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, config.Host, config.Port)
+}
+
+// credentials returns the username and password for the broker. With a VRM
+// token the password is sent as "Token <token>".
+func credentials(config models.MQTTConfiguration) (string, string) {
+	if config.VRMToken != "" {
+		return config.Username, fmt.Sprintf("Token %s", config.VRMToken)
+	}
+	return config.Username, config.Password
+}
+
+// newTLSConfig builds the TLS settings for the broker from the CA bundle and
+// client certificate in the config. Without a CA bundle the system roots are
+// used.
+func newTLSConfig(config models.TLSConfiguration, host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.CAFile != "" {
+		bundle, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle %s: %w", config.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate %s: %w", config.CertFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
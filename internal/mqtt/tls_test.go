@@ -0,0 +1,107 @@
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+type TLSTest struct {
+	suite.Suite
+	certFile string
+	keyFile  string
+}
+
+// SetupTest writes a self-signed certificate for localhost, standing in for a
+// local broker's certificate.
+func (s *TLSTest) SetupTest() {
+	dir := s.T().TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.Require().NoError(err)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	s.Require().NoError(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	s.Require().NoError(err)
+	s.certFile = filepath.Join(dir, "broker.crt")
+	s.keyFile = filepath.Join(dir, "broker.key")
+	s.Require().NoError(ioutil.WriteFile(s.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	s.Require().NoError(ioutil.WriteFile(s.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
+
+func (s *TLSTest) Test_handshakeWithSelfSignedCA() {
+	certificate, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	s.Require().NoError(err)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	s.Require().NoError(err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+	tlsConfig, err := newTLSConfig(models.TLSConfiguration{Enabled: true, CAFile: s.certFile, CertFile: s.certFile, KeyFile: s.keyFile}, "localhost")
+	s.Require().NoError(err)
+	s.Assert().Len(tlsConfig.Certificates, 1)
+	conn, err := tls.Dial("tcp", listener.Addr().String(), tlsConfig)
+	s.Require().NoError(err)
+	conn.Close()
+
+	untrusted, err := newTLSConfig(models.TLSConfiguration{Enabled: true}, "localhost")
+	s.Require().NoError(err)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	_, err = tls.Dial("tcp", listener.Addr().String(), untrusted)
+	s.Assert().Error(err)
+}
+
+func (s *TLSTest) Test_invalidCAFile() {
+	_, err := newTLSConfig(models.TLSConfiguration{Enabled: true, CAFile: s.keyFile}, "localhost")
+	s.Assert().Error(err)
+}
+
+func (s *TLSTest) Test_vrm() {
+	config := models.MQTTConfiguration{UseVRM: true, Host: vrmHost("D41243B4F71D"), Port: vrmPort, Username: "me@example.com", VRMToken: "abc"}
+	s.Assert().Equal("mqtt42.victronenergy.com", config.Host)
+	s.Assert().Equal("ssl://mqtt42.victronenergy.com:8883", brokerURL(config))
+	username, password := credentials(config)
+	s.Assert().Equal("me@example.com", username)
+	s.Assert().Equal("Token abc", password)
+	s.Assert().Equal("tcp://192.168.3.86:1883", brokerURL(models.MQTTConfiguration{Host: "192.168.3.86", Port: 1883}))
+}
+
+func TestTLSSuite(t *testing.T) {
+	suite.Run(t, new(TLSTest))
+}
@@ -0,0 +1,217 @@
+package vebus
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Priorities for the built in high power devices. Devices with a lower priority
+// are shed first and restored last.
+const (
+	PriorityWaterHeater = 1
+	PriorityEVSE        = 2
+	PriorityHVAC        = 3
+
+	RestorePrevious = "previous"
+	RestoreOn       = "on"
+	RestoreNever    = "never"
+
+	defaultShedThreshold    = 0.9
+	defaultRestoreThreshold = 0.7
+	defaultShedDelay        = 10 * time.Second
+	defaultRestoreDelay     = 60 * time.Second
+)
+
+var loadShedDevices = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "loadShedDevices",
+		Help: "Number of high power devices currently turned off by load shedding.",
+	},
+)
+
+type loadShedState struct {
+	overSince  time.Time
+	underSince time.Time
+	restoring  bool
+}
+
+// GetInputVoltage returns the highest voltage reported on the active AC input.
+func (c *Client) GetInputVoltage() float64 {
+	maxIn := float64(0)
+	c.mux.RLock()
+	for _, value := range c.values {
+		if value.name == "ac_activein_volts" {
+			if value.value > maxIn {
+				maxIn = value.value
+			}
+		}
+	}
+	c.mux.RUnlock()
+	return maxIn
+}
+
+// outputLimit returns the current the AC output is allowed to draw. On shore
+// power that is the input current limit, otherwise the configured inverter
+// rating, or the driving rating while on the road.
+func (c *Client) outputLimit() float64 {
+	minVoltage := c.shoreDetection.MinVoltage
+	if minVoltage == 0 {
+		minVoltage = 105
+	}
+	if c.GetInputVoltage() > minVoltage {
+		if limit := c.GetCurrentLimit(); limit > 0 {
+			return limit
+		}
+	}
+	if c.loadShedding.DrivingInverterRating > 0 && c.drivingFunc != nil && c.drivingFunc() {
+		return c.loadShedding.DrivingInverterRating
+	}
+	return c.loadShedding.InverterRating
+}
+
+// evaluateLoad sheds one device at a time while the output current stays above
+// the shed threshold and restores them in reverse order once it has stayed
+// below the restore threshold. It is paused while shore power is degraded, and
+// shed devices stay off until shore power has been good for the restore delay,
+// so a brownout does not cycle them on and off.
+func (c *Client) evaluateLoad(now time.Time) {
+	c.automation.mux.Lock()
+	paused := c.automation.ShutdownDueToPowerOut || c.loadShed.restoring
+	c.automation.mux.Unlock()
+	if paused || c.GetShoreQuality() != ShoreGood {
+		c.loadShed.overSince = time.Time{}
+		c.loadShed.underSince = time.Time{}
+		return
+	}
+	limit := c.outputLimit()
+	if limit <= 0 {
+		return
+	}
+	shedThreshold := c.loadShedding.ShedThreshold
+	if shedThreshold == 0 {
+		shedThreshold = defaultShedThreshold
+	}
+	restoreThreshold := c.loadShedding.RestoreThreshold
+	if restoreThreshold == 0 {
+		restoreThreshold = defaultRestoreThreshold
+	}
+	shedDelay := c.loadShedding.ShedDelay.Duration
+	if shedDelay == 0 {
+		shedDelay = defaultShedDelay
+	}
+	restoreDelay := c.loadShedding.RestoreDelay.Duration
+	if restoreDelay == 0 {
+		restoreDelay = defaultRestoreDelay
+	}
+	load := c.GetAmperageOut() / limit
+	switch {
+	case load >= shedThreshold:
+		c.loadShed.underSince = time.Time{}
+		if c.loadShed.overSince.IsZero() {
+			c.loadShed.overSince = now
+		}
+		if now.Sub(c.loadShed.overSince) >= shedDelay {
+			log.Printf("AC output at %.0f%% of %vA limit for %s, shedding load.", load*100, limit, now.Sub(c.loadShed.overSince))
+			c.shedNextDevice(now)
+			c.loadShed.overSince = now
+		}
+	case load <= restoreThreshold:
+		c.loadShed.overSince = time.Time{}
+		if c.loadShed.underSince.IsZero() {
+			c.loadShed.underSince = now
+		}
+		if now.Sub(c.loadShed.underSince) >= restoreDelay && c.shoreGoodFor(now, restoreDelay) {
+			c.restoreNextDevice()
+			c.loadShed.underSince = now
+		}
+	default:
+		c.loadShed.overSince = time.Time{}
+		c.loadShed.underSince = time.Time{}
+	}
+}
+
+// sortedDeviceIDs returns the registered device IDs ordered by priority, lowest
+// first. Callers must hold the automation mutex.
+func (c *Client) sortedDeviceIDs() []string {
+	ids := make([]string, 0, len(c.automation.HpDevices))
+	for id, item := range c.automation.HpDevices {
+		if item.Registered {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := c.automation.HpDevices[ids[i]], c.automation.HpDevices[ids[j]]
+		if a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+func (c *Client) shedNextDevice(now time.Time) {
+	c.automation.mux.Lock()
+	defer c.automation.mux.Unlock()
+	for _, id := range c.sortedDeviceIDs() {
+		item := c.automation.HpDevices[id]
+		if item.Shed || !item.inHPState() {
+			continue
+		}
+		state, err := item.GetState()
+		if err != nil {
+			log.Printf("failed to get status from item %s due to error: %s", id, err.Error())
+			continue
+		}
+		if state == "OFF" {
+			continue
+		}
+		log.Printf("Shedding %s (priority %v), turning off from %v.", item.Name, item.Priority, state)
+		item.Shed = true
+		item.ShedState = state
+		item.ShedAt = now.Unix()
+		c.automation.HpDevices[id] = item
+		item.SetState("OFF")
+		c.SaveToFile(c.stateFile)
+		c.updateShedMetric()
+		return
+	}
+	log.Printf("AC output is over the limit but there are no more devices to shed.")
+}
+
+func (c *Client) restoreNextDevice() {
+	c.automation.mux.Lock()
+	defer c.automation.mux.Unlock()
+	ids := c.sortedDeviceIDs()
+	for i := len(ids) - 1; i >= 0; i-- {
+		item := c.automation.HpDevices[ids[i]]
+		if !item.Shed {
+			continue
+		}
+		if state, ok := item.restoreState(item.ShedState); ok {
+			log.Printf("Restoring %s (priority %v) to %v after load shedding.", item.Name, item.Priority, state)
+			item.SetState(state)
+		} else {
+			log.Printf("Leaving %s off after load shedding due to restore policy.", item.Name)
+		}
+		item.Shed = false
+		item.ShedState = ""
+		item.ShedAt = 0
+		c.automation.HpDevices[ids[i]] = item
+		c.SaveToFile(c.stateFile)
+		c.updateShedMetric()
+		return
+	}
+}
+
+func (c *Client) updateShedMetric() {
+	count := 0
+	for _, item := range c.automation.HpDevices {
+		if item.Shed {
+			count++
+		}
+	}
+	loadShedDevices.Set(float64(count))
+}
@@ -0,0 +1,350 @@
+package vebus
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+type fakeDevice struct {
+	state string
+	onSet func(state string)
+}
+
+func (d *fakeDevice) GetState() (string, error) {
+	return d.state, nil
+}
+
+func (d *fakeDevice) SetState(state string) {
+	d.state = state
+	if d.onSet != nil {
+		d.onSet(state)
+	}
+}
+
+func (d *fakeDevice) InHPState() bool {
+	return d.state != "OFF"
+}
+
+type LoadShedTest struct {
+	suite.Suite
+	client      Client
+	waterHeater *fakeDevice
+	evse        *fakeDevice
+	hvac        *fakeDevice
+}
+
+func (s *LoadShedTest) SetupTest() {
+	s.client = Client{
+		values:       map[string]vebusMetric{},
+		mux:          &sync.RWMutex{},
+		loadShed:     &loadShedState{},
+		pollInterval: time.Millisecond,
+		shore:        &shoreMonitor{},
+		probe:        &pedestalProbe{Results: make(map[string]ProbeResult)},
+		probeFile:    filepath.Join(s.T().TempDir(), "pedestalProbe.json"),
+		stateFile:    filepath.Join(s.T().TempDir(), "hpItems.json"),
+		automation:   &Automation{HpDevices: make(map[string]hpDevice)},
+		shoreDetection: models.ShoreDetection{
+			Restore: models.RestoreSequence{DeviceDelay: models.Duration{Duration: time.Millisecond}},
+		},
+		loadShedding: models.LoadShedding{
+			Enabled:          true,
+			InverterRating:   25,
+			ShedThreshold:    0.9,
+			RestoreThreshold: 0.7,
+			ShedDelay:        models.Duration{Duration: 10 * time.Second},
+			RestoreDelay:     models.Duration{Duration: time.Minute},
+		},
+	}
+	s.waterHeater = &fakeDevice{state: "ON"}
+	s.evse = &fakeDevice{state: "ON"}
+	s.hvac = &fakeDevice{state: "COOL"}
+	s.client.RegisterHPDevice("hvac", "Thermostat", s.hvac, models.HighPowerDevice{Priority: PriorityHVAC})
+	s.client.RegisterHPDevice("water", "Water Heater", s.waterHeater, models.HighPowerDevice{Priority: PriorityWaterHeater})
+	s.client.RegisterHPDevice("EVSE", "EVSE", s.evse, models.HighPowerDevice{Priority: PriorityEVSE})
+}
+
+func (s *LoadShedTest) setOutput(amps float64) {
+	s.client.values["ac_out_current"] = vebusMetric{name: "ac_out_current", value: amps}
+}
+
+func (s *LoadShedTest) setInput(volts, amps float64) {
+	s.client.mux.Lock()
+	s.client.values["ac_activein_volts"] = vebusMetric{name: "ac_activein_volts", value: volts}
+	s.client.values["ac_activein_current"] = vebusMetric{name: "ac_activein_current", value: amps}
+	s.client.mux.Unlock()
+}
+
+func (s *LoadShedTest) Test_ShedAndRestoreInPriorityOrder() {
+	start := time.Now()
+	s.setOutput(24)
+	s.client.evaluateLoad(start)
+	s.Assert().Equal("ON", s.waterHeater.state)
+	s.client.evaluateLoad(start.Add(10 * time.Second))
+	s.Assert().Equal("OFF", s.waterHeater.state)
+	s.Assert().Equal("ON", s.evse.state)
+	s.client.evaluateLoad(start.Add(20 * time.Second))
+	s.Assert().Equal("OFF", s.evse.state)
+	s.Assert().Equal("COOL", s.hvac.state)
+
+	// Inside the hysteresis band nothing changes.
+	s.setOutput(20)
+	s.client.evaluateLoad(start.Add(5 * time.Minute))
+	s.Assert().Equal("OFF", s.evse.state)
+
+	s.setOutput(10)
+	s.client.evaluateLoad(start.Add(6 * time.Minute))
+	s.client.evaluateLoad(start.Add(7 * time.Minute))
+	s.Assert().Equal("ON", s.evse.state)
+	s.Assert().Equal("OFF", s.waterHeater.state)
+	s.client.evaluateLoad(start.Add(8 * time.Minute))
+	s.Assert().Equal("ON", s.waterHeater.state)
+	s.Assert().False(s.client.automation.HpDevices["water"].Shed)
+}
+
+func (s *LoadShedTest) Test_ShedStatePersists() {
+	start := time.Now()
+	s.setOutput(24)
+	s.client.evaluateLoad(start)
+	s.client.evaluateLoad(start.Add(10 * time.Second))
+
+	loaded := Client{automation: &Automation{}}
+	loaded.LoadFromFile(s.client.stateFile)
+	s.Assert().True(loaded.automation.HpDevices["water"].Shed)
+	s.Assert().Equal("ON", loaded.automation.HpDevices["water"].ShedState)
+	s.Assert().Equal(PriorityWaterHeater, loaded.automation.HpDevices["water"].Priority)
+}
+
+func (s *LoadShedTest) Test_ConfiguredStatesAndRestorePolicy() {
+	s.client.RegisterHPDevice("water", "Water Heater", s.waterHeater, models.HighPowerDevice{Priority: PriorityWaterHeater, RestorePolicy: RestoreNever})
+	s.client.RegisterHPDevice("hvac", "Thermostat", s.hvac, models.HighPowerDevice{Priority: PriorityHVAC, HighPowerStates: []string{"HEAT"}})
+	s.client.shutdownHPDevices()
+	s.Assert().Equal("OFF", s.waterHeater.state)
+	s.Assert().Equal("OFF", s.evse.state)
+	s.Assert().Equal("COOL", s.hvac.state)
+
+	s.setInput(120, 0)
+	s.client.restoreSequence()
+	s.Assert().Equal("OFF", s.waterHeater.state)
+	s.Assert().Equal("ON", s.evse.state)
+}
+
+func (s *LoadShedTest) Test_RestoreSequenceOrder() {
+	s.client.shutdownHPDevices()
+	restored := []string{}
+	s.hvac.onSet = func(state string) { restored = append(restored, "hvac") }
+	s.evse.onSet = func(state string) { restored = append(restored, "evse") }
+	s.waterHeater.onSet = func(state string) { restored = append(restored, "water") }
+	s.setInput(120, 0)
+	s.client.restoreSequence()
+	s.Assert().Equal([]string{"hvac", "evse", "water"}, restored)
+	s.Assert().Equal("COOL", s.hvac.state)
+}
+
+func (s *LoadShedTest) Test_RestoreSequenceAbortsOnSag() {
+	s.client.shutdownHPDevices()
+	s.hvac.onSet = func(state string) {
+		if state != "OFF" {
+			s.setInput(104, 28)
+		}
+	}
+	s.setInput(120, 0)
+	s.client.restoreSequence()
+	s.Assert().Equal("OFF", s.hvac.state)
+	s.Assert().Equal("OFF", s.evse.state)
+	s.Assert().Equal("OFF", s.waterHeater.state)
+	s.Assert().True(s.client.automation.ShutdownDueToPowerOut)
+	s.Assert().Equal("COOL", s.client.automation.HpDevices["hvac"].State)
+}
+
+func (s *LoadShedTest) Test_RestoreSagFollowsBaseline() {
+	s.client.shutdownHPDevices()
+	s.hvac.onSet = func(state string) {
+		if state != "OFF" {
+			s.setInput(115, 20)
+		}
+	}
+	s.setInput(124, 0)
+	s.client.restoreSequence()
+	s.Assert().Equal("OFF", s.hvac.state)
+	s.Assert().True(s.client.automation.ShutdownDueToPowerOut)
+	s.Assert().Equal(float64(105), s.client.sagVoltage(100))
+}
+
+func (s *LoadShedTest) feedShore(start time.Time, seconds int, volts float64) time.Time {
+	for i := 0; i < seconds; i++ {
+		start = start.Add(time.Second)
+		s.client.observeShore("V", volts, start)
+	}
+	return start
+}
+
+func (s *LoadShedTest) Test_ShoreIgnoresSingleBadReading() {
+	now := s.feedShore(time.Now(), 5, 120)
+	s.client.observeShore("V", 0, now.Add(time.Second))
+	s.Assert().Equal(ShoreGood, s.client.GetShoreQuality())
+	s.Assert().Equal("ON", s.waterHeater.state)
+}
+
+func (s *LoadShedTest) Test_ShoreLossAndFrequency() {
+	s.client.shoreDetection.MinFrequency = 57
+	now := s.feedShore(time.Now(), 5, 120)
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Second)
+		s.client.observeShore("F", 52, now)
+	}
+	s.Assert().Equal(ShoreLoss, s.client.GetShoreQuality())
+	s.Assert().Equal("OFF", s.waterHeater.state)
+	s.Assert().Equal("OFF", s.hvac.state)
+	events := s.client.GetShoreEvents()
+	s.Assert().Len(events, 1)
+	s.Assert().Equal("frequency 52.00Hz below 57.00Hz", events[0].Reason)
+}
+
+func (s *LoadShedTest) Test_ShoreBrownoutShedsLoad() {
+	s.client.shoreDetection.BrownoutVoltage = 110
+	s.client.shoreDetection.BrownoutDelay = models.Duration{Duration: 10 * time.Second}
+	s.client.shoreDetection.RecoveryDelay = models.Duration{Duration: 30 * time.Second}
+	now := s.feedShore(time.Now(), 5, 120)
+	now = s.feedShore(now, 15, 108)
+	s.Assert().Equal(ShoreBrownout, s.client.GetShoreQuality())
+	s.Assert().Equal("OFF", s.waterHeater.state)
+	s.Assert().Equal("ON", s.evse.state)
+	s.Assert().Equal("COOL", s.hvac.state)
+
+	// Within the hysteresis band the brownout does not clear.
+	now = s.feedShore(now, 40, 111)
+	s.Assert().Equal(ShoreBrownout, s.client.GetShoreQuality())
+	s.Assert().Equal("OFF", s.evse.state)
+
+	s.setInput(120, 0)
+	s.feedShore(now, 40, 120)
+	s.Assert().Equal(ShoreGood, s.client.GetShoreQuality())
+	s.Assert().Eventually(func() bool { return !s.client.hasShedDevices() }, time.Second, time.Millisecond)
+	s.Assert().Len(s.client.GetShoreEvents(), 2)
+}
+
+func (s *LoadShedTest) Test_BrownoutKeepsShedDevicesOff() {
+	s.client.shoreDetection.BrownoutVoltage = 110
+	s.client.shoreDetection.BrownoutDelay = models.Duration{Duration: 10 * time.Second}
+	s.client.shoreDetection.RecoveryDelay = models.Duration{Duration: 30 * time.Second}
+	now := s.feedShore(time.Now(), 5, 120)
+	now = s.feedShore(now, 35, 108)
+	s.Assert().Equal("OFF", s.hvac.state)
+
+	// A light load during the brownout does not bring the shed devices back.
+	s.setOutput(5)
+	s.client.evaluateLoad(now)
+	s.client.evaluateLoad(now.Add(2 * time.Minute))
+	s.Assert().Equal("OFF", s.hvac.state)
+
+	// Nor does it until shore power has been good for the restore delay.
+	now = s.feedShore(now, 40, 120)
+	s.Assert().Equal(ShoreGood, s.client.GetShoreQuality())
+	s.Assert().Eventually(func() bool {
+		s.client.automation.mux.Lock()
+		defer s.client.automation.mux.Unlock()
+		return !s.client.loadShed.restoring
+	}, time.Second, time.Millisecond)
+	s.client.evaluateLoad(now)
+	s.client.evaluateLoad(now.Add(30 * time.Second))
+	s.Assert().Equal("OFF", s.hvac.state)
+	s.client.evaluateLoad(now.Add(2 * time.Minute))
+	s.Assert().Equal("COOL", s.hvac.state)
+	s.Assert().Equal("OFF", s.waterHeater.state)
+}
+
+func (s *LoadShedTest) setupProbe() {
+	s.client.inputLimits = models.CurrentLimitConfiguration{
+		LowCurrentMax:  15,
+		HighCurrentMax: 30,
+		Steps:          3,
+		StepTime:       models.Duration{Duration: time.Millisecond},
+	}
+	s.client.shoreDetection.PedestalProbe = models.PedestalProbe{Enabled: true}
+	s.client.locationFunc = func() string { return "45.12,-122.34" }
+}
+
+func (s *LoadShedTest) Test_PedestalProbeStopsAtSag() {
+	s.setupProbe()
+	limits := []float64{}
+	s.client.inputCurrentFunc = func(value float64) {
+		limits = append(limits, value)
+		s.setInput(120-(value-15)/2, value)
+	}
+	s.setInput(120, 10)
+	s.client.rampInputLimit()
+	s.Assert().Equal([]float64{20, 25, 30, 25}, limits)
+
+	saved := pedestalProbe{}
+	saved.LoadFromFile(s.client.probeFile)
+	s.Assert().Equal(float64(25), saved.Results["45.12,-122.34"].Limit)
+	s.Assert().Equal("voltage sagged 7.5V at 30A", saved.Results["45.12,-122.34"].Reason)
+
+	// The saved limit is used without probing again.
+	limits = []float64{}
+	s.client.rampInputLimit()
+	s.Assert().Equal([]float64{18, 21, 25}, limits)
+}
+
+func (s *LoadShedTest) Test_PedestalProbeInconclusiveWithLightLoad() {
+	s.setupProbe()
+	limits := []float64{}
+	s.client.inputCurrentFunc = func(value float64) {
+		limits = append(limits, value)
+		s.setInput(120, 18)
+	}
+	s.setInput(120, 10)
+	s.client.rampInputLimit()
+	s.Assert().Equal([]float64{20, 25, 20, 20, 25, 30}, limits)
+
+	saved := pedestalProbe{}
+	saved.LoadFromFile(s.client.probeFile)
+	s.Assert().Empty(saved.Results)
+}
+
+func (s *LoadShedTest) Test_PedestalProbeInconclusiveKeepsSavedLimit() {
+	s.setupProbe()
+	s.client.probe.Results["45.12,-122.34"] = ProbeResult{Limit: 24}
+	limits := []float64{}
+	s.client.inputCurrentFunc = func(value float64) {
+		limits = append(limits, value)
+		s.setInput(120, 10)
+	}
+	s.setInput(120, 10)
+	s.client.runPedestalProbe(s.client.location())
+	s.Assert().Equal([]float64{20, 15, 18, 21, 24}, limits)
+	s.Assert().Equal(float64(24), s.client.probe.Results["45.12,-122.34"].Limit)
+}
+
+func (s *LoadShedTest) Test_PedestalProbeNotSavedWithoutLocation() {
+	s.setupProbe()
+	s.client.locationFunc = func() string { return "" }
+	limits := []float64{}
+	s.client.inputCurrentFunc = func(value float64) {
+		limits = append(limits, value)
+		s.setInput(120, value)
+	}
+	s.setInput(120, 10)
+	s.client.rampInputLimit()
+	s.Assert().Equal([]float64{20, 25, 30}, limits)
+
+	saved := pedestalProbe{}
+	saved.LoadFromFile(s.client.probeFile)
+	s.Assert().Empty(saved.Results)
+
+	// The next time shore power returns the pedestal is probed again.
+	limits = []float64{}
+	s.client.rampInputLimit()
+	s.Assert().Equal([]float64{20, 25, 30}, limits)
+}
+
+func TestLoadShedding(t *testing.T) {
+	suite.Run(t, new(LoadShedTest))
+}
@@ -1,11 +1,10 @@
 package vebus
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"math"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -14,32 +13,49 @@ import (
 
 	"github.com/jgulick48/rv-homekit/internal/metrics"
 	"github.com/jgulick48/rv-homekit/internal/models"
+	"github.com/jgulick48/rv-homekit/internal/storage"
 )
 
-func NewVeBusClient(dvccConfig models.CurrentLimitConfiguration, inputLimits models.CurrentLimitConfiguration, shoreDetection models.ShoreDetection, chargeCurrentFunc func(value float64), inputCurrentFunc func(value float64)) Client {
+func NewVeBusClient(dvccConfig models.CurrentLimitConfiguration, inputLimits models.CurrentLimitConfiguration, shoreDetection models.ShoreDetection, loadShedding models.LoadShedding, chargeCurrentFunc func(value float64), inputCurrentFunc func(value float64), locationFunc func() string, drivingFunc func() bool) Client {
 	client := Client{
 		values:            map[string]vebusMetric{},
-		mux:               sync.RWMutex{},
+		mux:               &sync.RWMutex{},
 		dvccConfig:        dvccConfig,
 		inputLimits:       inputLimits,
 		chargeCurrentFunc: chargeCurrentFunc,
 		inputCurrentFunc:  inputCurrentFunc,
+		locationFunc:      locationFunc,
+		drivingFunc:       drivingFunc,
 		shoreDetection:    shoreDetection,
+		loadShedding:      loadShedding,
+		loadShed:          &loadShedState{},
+		shore:             &shoreMonitor{},
+		probe:             &pedestalProbe{},
+		pollInterval:      time.Second,
 		startupTime:       time.Now(),
-		automation: Automation{
+		automation: &Automation{
 			HpDevices:             make(map[string]hpDevice, 0),
 			LastShutdownTime:      0,
 			ShutdownDueToPowerOut: false,
 		},
 	}
-	prometheus.MustRegister(acMeasurements)
+	prometheus.MustRegister(acMeasurements, loadShedDevices, shoreQuality)
 	client.LoadFromFile("")
+	client.probe.LoadFromFile("")
 	go func() {
 		timer := time.NewTicker(10 * time.Second)
 		for range timer.C {
 			client.sendAllMetrics()
 		}
 	}()
+	if loadShedding.Enabled {
+		go func() {
+			timer := time.NewTicker(time.Second)
+			for now := range timer.C {
+				client.evaluateLoad(now)
+			}
+		}()
+	}
 	return client
 }
 
@@ -68,14 +84,23 @@ type vebusMetric struct {
 }
 
 type Client struct {
-	mux               sync.RWMutex
+	mux               *sync.RWMutex
 	values            map[string]vebusMetric
-	automation        Automation
+	automation        *Automation
 	dvccConfig        models.CurrentLimitConfiguration
 	inputLimits       models.CurrentLimitConfiguration
 	shoreDetection    models.ShoreDetection
+	loadShedding      models.LoadShedding
+	loadShed          *loadShedState
+	shore             *shoreMonitor
+	probe             *pedestalProbe
+	probeFile         string
+	stateFile         string
+	pollInterval      time.Duration
 	chargeCurrentFunc func(value float64)
 	inputCurrentFunc  func(value float64)
+	locationFunc      func() string
+	drivingFunc       func() bool
 	startupTime       time.Time
 }
 
@@ -83,6 +108,8 @@ type Automation struct {
 	HpDevices             map[string]hpDevice `json:"HpDevices"`
 	LastShutdownTime      float64             `json:"LastShutdownTime"`
 	ShutdownDueToPowerOut bool                `json:"ShutdownDueToPowerOut"`
+	ShoreEvents           []ShoreEvent        `json:"shoreEvents"`
+	mux                   sync.Mutex
 }
 
 type HPDevice interface {
@@ -92,10 +119,48 @@ type HPDevice interface {
 }
 
 type hpDevice struct {
-	HPDevice   `json:"-"`
-	Name       string `json:"name"`
-	State      string `json:"state"`
-	Registered bool   `json:"-"`
+	HPDevice        `json:"-"`
+	Name            string        `json:"name"`
+	State           string        `json:"state"`
+	Priority        int           `json:"priority"`
+	HighPowerStates []string      `json:"highPowerStates"`
+	RestorePolicy   string        `json:"restorePolicy"`
+	RestoreDelay    time.Duration `json:"-"`
+	Shed            bool          `json:"shed"`
+	ShedState       string        `json:"shedState"`
+	ShedAt          int64         `json:"shedAt"`
+	Registered      bool          `json:"-"`
+}
+
+// inHPState reports whether the device is drawing high power, using the
+// configured states when there are any.
+func (d hpDevice) inHPState() bool {
+	if len(d.HighPowerStates) == 0 {
+		return d.InHPState()
+	}
+	state, err := d.GetState()
+	if err != nil {
+		return false
+	}
+	for _, hpState := range d.HighPowerStates {
+		if strings.EqualFold(state, hpState) {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreState returns the state to put the device back in after it was turned
+// off, or false if it should be left off.
+func (d hpDevice) restoreState(previous string) (string, bool) {
+	switch strings.ToLower(d.RestorePolicy) {
+	case RestoreNever:
+		return "", false
+	case RestoreOn:
+		return "ON", true
+	default:
+		return previous, previous != "" && previous != "OFF"
+	}
 }
 
 func (c *Client) GetAmperageOut() float64 {
@@ -128,46 +193,45 @@ func (c *Client) GetCurrentLimit() float64 {
 
 func (c *Client) LoadFromFile(filename string) {
 	if filename == "" {
-		filename = "./hpItems.json"
+		filename = storage.Path("hpItems.json")
 	}
-	configFile, err := ioutil.ReadFile(filename)
-	if err != nil {
+	err := storage.ReadJSON(filename, c.automation)
+	if os.IsNotExist(err) {
 		log.Printf("No state file found. Making new IDs")
-	}
-	err = json.Unmarshal(configFile, &c.automation)
-	if err != nil {
+	} else if err != nil {
 		log.Printf("Invliad config file provided")
 	}
 }
 
 func (c *Client) SaveToFile(filename string) {
 	if filename == "" {
-		filename = "./hpItems.json"
+		filename = storage.Path("hpItems.json")
 	}
-	data, err := json.MarshalIndent(c.automation, "", "  ")
-	if err != nil {
-		return
+	if err := storage.WriteJSON(filename, c.automation); err != nil {
+		log.Printf("Error saving %s: %s", filename, err)
 	}
-	ioutil.WriteFile(filename, data, 0644)
 }
 
-func (c *Client) RegisterHPDevice(id, name string, item HPDevice) {
+// RegisterHPDevice adds a device that can be turned off on power failure or
+// when shedding load. Devices with a lower priority are shed first.
+func (c *Client) RegisterHPDevice(id, name string, item HPDevice, config models.HighPowerDevice) {
+	c.automation.mux.Lock()
+	defer c.automation.mux.Unlock()
 	device, ok := c.automation.HpDevices[id]
 	if !ok {
 		enabled, _ := item.GetState()
-		c.automation.HpDevices[id] = hpDevice{
-			Name:       name,
-			HPDevice:   item,
-			State:      enabled,
-			Registered: true,
-		}
-	} else {
-		device.HPDevice = item
-		device.Name = name
-		device.Registered = true
-		c.automation.HpDevices[id] = device
+		device.State = enabled
 	}
-	c.SaveToFile("")
+	device.HPDevice = item
+	device.Name = name
+	device.Priority = config.Priority
+	device.HighPowerStates = config.HighPowerStates
+	device.RestorePolicy = config.RestorePolicy
+	device.RestoreDelay = config.RestoreDelay.Duration
+	device.Registered = true
+	c.automation.HpDevices[id] = device
+	log.Printf("Registered %s as a high power device with priority %v.", name, config.Priority)
+	c.SaveToFile(c.stateFile)
 }
 
 func (c *Client) GetDataParser(segments []string, defaultParser func(topic []string, message models.Message) ([]string, float64)) func(topic []string, message models.Message) ([]string, float64) {
@@ -273,23 +337,9 @@ func (c *Client) parseACLineMeasurements(tags []string, segments []string) ([]st
 
 func (c *Client) checkForShutdown(segments []string, value float64) {
 	switch segments[len(segments)-1] {
-	case "V":
+	case "V", "F":
 		if c.shoreDetection.Enabled && time.Now().After(c.startupTime.Add(c.shoreDetection.StartupDelay.Duration)) {
-			if (c.shoreDetection.MinVoltage > 0 && value > c.shoreDetection.MinVoltage) || value > 105 {
-				if c.automation.ShutdownDueToPowerOut {
-					if float64(time.Now().Unix()) > c.automation.LastShutdownTime+(time.Minute.Seconds()) {
-						c.resetHPDevices()
-						c.automation.ShutdownDueToPowerOut = false
-					}
-				}
-			} else {
-				c.automation.LastShutdownTime = float64(time.Now().Unix())
-				if !c.automation.ShutdownDueToPowerOut {
-					log.Printf("Shutting high power devices down due to power failure. Voltage at %v", value)
-					c.shutdownHPDevices()
-					c.automation.ShutdownDueToPowerOut = true
-				}
-			}
+			c.observeShore(segments[len(segments)-1], value, time.Now())
 		}
 	}
 }
@@ -310,75 +360,75 @@ func (c *Client) shutdownHPDevices() {
 			c.inputCurrentFunc(c.inputLimits.LowCurrentMax)
 		}
 	}
+	c.automation.mux.Lock()
+	defer c.automation.mux.Unlock()
 	for id, item := range c.automation.HpDevices {
 		if !item.Registered {
 			log.Printf("Device with ID \"%s\" was not registered on startup, skipping", id)
 			continue
 		}
 		log.Printf("Checking %s to see if shutdown is needed due to power failure.\n", id)
-		if !item.InHPState() {
+		if !item.inHPState() {
 			log.Printf("Item %s is not in high power state, not changing status", id)
 			continue
 		}
 		isEnabled, err := item.GetState()
 		if err != nil {
-			fmt.Errorf("failed to get status from item %s due to error: %s", id, err.Error())
+			log.Printf("failed to get status from item %s due to error: %s", id, err.Error())
 			continue
 		}
 		item.State = isEnabled
+		c.automation.HpDevices[id] = item
 		log.Printf("Setting item %s enabled to false from %v due to power failure.", id, isEnabled)
 		item.SetState("OFF")
 	}
-	c.SaveToFile("")
+	c.SaveToFile(c.stateFile)
 }
 
 func (c *Client) resetHPDevices() {
-	for id, item := range c.automation.HpDevices {
-		if item.Registered && item.State != "OFF" {
-			log.Printf("Setting item %s enabled to %v from False due to power restoration.", id, item.State)
-			item.SetState(item.State)
-		}
-	}
+	go c.restoreSequence()
 	if c.dvccConfig.HighCurrentMax != 0 {
-		go func() {
-			time.Sleep(c.dvccConfig.StartDelay.Duration)
-			t := time.NewTicker(c.dvccConfig.StepTime.Duration)
-			steps := 1
-			if c.dvccConfig.Steps == 0 {
-				c.dvccConfig.Steps = 1
-			}
-			stepValue := math.Round((c.dvccConfig.HighCurrentMax - c.dvccConfig.LowCurrentMax) / float64(c.dvccConfig.Steps))
-			for range t.C {
-				log.Printf("Processing step %v of %v", steps, c.dvccConfig.Steps)
-				if steps >= c.dvccConfig.Steps {
-					c.chargeCurrentFunc(c.dvccConfig.HighCurrentMax)
-					t.Stop()
-					return
-				}
-				c.chargeCurrentFunc(c.dvccConfig.LowCurrentMax + (float64(steps) * stepValue))
-				steps++
-			}
-		}()
+		go rampCurrent(c.dvccConfig, c.dvccConfig.HighCurrentMax, c.chargeCurrentFunc, nil)
 	}
 	if c.inputLimits.HighCurrentMax != 0 {
-		go func() {
-			time.Sleep(c.inputLimits.StartDelay.Duration)
-			t := time.NewTicker(c.inputLimits.StepTime.Duration)
-			steps := 1
-			if c.inputLimits.Steps == 0 {
-				c.inputLimits.Steps = 1
-			}
-			stepValue := math.Round((c.inputLimits.HighCurrentMax - c.inputLimits.LowCurrentMax) / float64(c.inputLimits.Steps))
-			for range t.C {
-				log.Printf("Processing step %v of %v", steps, c.inputLimits.Steps)
-				if steps >= c.inputLimits.Steps {
-					c.inputCurrentFunc(c.inputLimits.HighCurrentMax)
-					t.Stop()
-					return
-				}
-				c.inputCurrentFunc(c.inputLimits.LowCurrentMax + (float64(steps) * stepValue))
-				steps++
+		go c.rampInputLimit()
+	}
+}
+
+// rampCurrent steps setFunc from config.LowCurrentMax up to target over
+// config.Steps steps of config.StepTime. When check is set it is called a step
+// time after each new value and a false result puts the previous value back and
+// stops the ramp. It returns the last value that was kept.
+func rampCurrent(config models.CurrentLimitConfiguration, target float64, setFunc func(value float64), check func(value float64) bool) float64 {
+	time.Sleep(config.StartDelay.Duration)
+	stepTime := config.StepTime.Duration
+	if stepTime <= 0 {
+		stepTime = time.Second
+	}
+	steps := config.Steps
+	if steps == 0 {
+		steps = 1
+	}
+	t := time.NewTicker(stepTime)
+	defer t.Stop()
+	stepValue := math.Round((target - config.LowCurrentMax) / float64(steps))
+	value := config.LowCurrentMax
+	for step := 1; step <= steps; step++ {
+		<-t.C
+		log.Printf("Processing step %v of %v", step, steps)
+		next := config.LowCurrentMax + (float64(step) * stepValue)
+		if step >= steps {
+			next = target
+		}
+		setFunc(next)
+		if check != nil {
+			<-t.C
+			if !check(next) {
+				setFunc(value)
+				return value
 			}
-		}()
+		}
+		value = next
 	}
+	return value
 }
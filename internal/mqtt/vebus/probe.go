@@ -0,0 +1,216 @@
+package vebus
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jgulick48/rv-homekit/internal/storage"
+)
+
+const (
+	defaultMaxSag          = 5
+	defaultMinLoadFraction = 0.8
+)
+
+type ProbeResult struct {
+	Limit           float64 `json:"limit"`
+	BaselineVoltage float64 `json:"baselineVoltage"`
+	LowestVoltage   float64 `json:"lowestVoltage"`
+	InputCurrent    float64 `json:"inputCurrent"`
+	Reason          string  `json:"reason"`
+	ProbedAt        int64   `json:"probedAt"`
+}
+
+type pedestalProbe struct {
+	mux     sync.Mutex
+	running bool
+	abort   bool
+	Results map[string]ProbeResult `json:"results"`
+}
+
+func (p *pedestalProbe) LoadFromFile(filename string) {
+	if filename == "" {
+		filename = storage.Path("pedestalProbe.json")
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	err := storage.ReadJSON(filename, p)
+	if os.IsNotExist(err) {
+		log.Printf("No pedestal probe results found. Starting new.")
+	} else if err != nil {
+		log.Printf("Invalid pedestal probe file provided")
+	}
+	if p.Results == nil {
+		p.Results = make(map[string]ProbeResult)
+	}
+}
+
+// SaveToFile writes the probe results. Callers must hold the mutex.
+func (p *pedestalProbe) SaveToFile(filename string) {
+	if filename == "" {
+		filename = storage.Path("pedestalProbe.json")
+	}
+	if err := storage.WriteJSON(filename, p); err != nil {
+		log.Printf("Error saving %s: %s", filename, err)
+	}
+}
+
+// location returns the current GPS location, or an empty string without a fix.
+func (c *Client) location() string {
+	if c.locationFunc == nil {
+		return ""
+	}
+	return c.locationFunc()
+}
+
+// rampInputLimit ramps the input current limit after shore power returns, to the
+// probed limit for the current location when there is one. Without a GPS fix
+// the pedestal is probed but the result is not saved.
+func (c *Client) rampInputLimit() {
+	if !c.shoreDetection.PedestalProbe.Enabled {
+		rampCurrent(c.inputLimits, c.inputLimits.HighCurrentMax, c.inputCurrentFunc, nil)
+		return
+	}
+	location := c.location()
+	if location == "" {
+		c.runPedestalProbe(location)
+		return
+	}
+	c.probe.mux.Lock()
+	result, ok := c.probe.Results[location]
+	c.probe.mux.Unlock()
+	if ok {
+		log.Printf("Using pedestal limit of %vA probed at %s on %s.", result.Limit, location, time.Unix(result.ProbedAt, 0))
+		rampCurrent(c.inputLimits, result.Limit, c.inputCurrentFunc, nil)
+		return
+	}
+	c.runPedestalProbe(location)
+}
+
+// StartPedestalProbe probes the pedestal at the current location again,
+// replacing any saved result.
+func (c *Client) StartPedestalProbe() {
+	go c.runPedestalProbe(c.location())
+}
+
+// AbortPedestalProbe stops a running probe and ramps the input current limit to
+// the saved limit for the location, or the high current max without one.
+func (c *Client) AbortPedestalProbe() {
+	c.probe.mux.Lock()
+	defer c.probe.mux.Unlock()
+	if c.probe.running {
+		log.Printf("Aborting pedestal probe.")
+		c.probe.abort = true
+	}
+}
+
+func (c *Client) IsPedestalProbeRunning() bool {
+	c.probe.mux.Lock()
+	defer c.probe.mux.Unlock()
+	return c.probe.running
+}
+
+// fallbackLimit returns the saved limit for the location, or the high current
+// max when the pedestal there has not been probed.
+func (c *Client) fallbackLimit(location string) float64 {
+	c.probe.mux.Lock()
+	defer c.probe.mux.Unlock()
+	if result, ok := c.probe.Results[location]; ok && location != "" {
+		return result.Limit
+	}
+	return c.inputLimits.HighCurrentMax
+}
+
+func (c *Client) runPedestalProbe(location string) {
+	c.probe.mux.Lock()
+	if c.probe.running {
+		c.probe.mux.Unlock()
+		log.Printf("Pedestal probe already running, skipping.")
+		return
+	}
+	c.probe.running = true
+	c.probe.abort = false
+	c.probe.mux.Unlock()
+	defer func() {
+		c.probe.mux.Lock()
+		c.probe.running = false
+		c.probe.mux.Unlock()
+	}()
+	maxCurrent := c.shoreDetection.PedestalProbe.MaxCurrent
+	if maxCurrent == 0 {
+		maxCurrent = c.inputLimits.HighCurrentMax
+	}
+	maxSag := c.shoreDetection.PedestalProbe.MaxSag
+	if maxSag == 0 {
+		maxSag = defaultMaxSag
+	}
+	minLoad := c.shoreDetection.PedestalProbe.MinLoadFraction
+	if minLoad == 0 {
+		minLoad = defaultMinLoadFraction
+	}
+	baseline := c.GetInputVoltage()
+	log.Printf("Starting pedestal probe at %q from %vA to %vA with baseline voltage %vV.", location, c.inputLimits.LowCurrentMax, maxCurrent, baseline)
+	result := ProbeResult{
+		BaselineVoltage: baseline,
+		LowestVoltage:   baseline,
+		Reason:          "reached maximum current",
+	}
+	aborted, inconclusive, powerOut := false, false, false
+	limit := rampCurrent(c.inputLimits, maxCurrent, c.inputCurrentFunc, func(value float64) bool {
+		c.probe.mux.Lock()
+		abort := c.probe.abort
+		c.probe.mux.Unlock()
+		if c.isShutdownDueToPowerOut() {
+			powerOut = true
+			return false
+		}
+		if abort {
+			aborted = true
+			return false
+		}
+		voltage, current := c.GetInputVoltage(), c.GetInputCurrent()
+		if voltage < result.LowestVoltage {
+			result.LowestVoltage = voltage
+		}
+		log.Printf("Pedestal probe at %vA: input at %vV drawing %vA, %.1fV below baseline.", value, voltage, current, baseline-voltage)
+		if baseline-voltage > maxSag {
+			result.Reason = fmt.Sprintf("voltage sagged %.1fV at %vA", baseline-voltage, value)
+			return false
+		}
+		if current < value*minLoad {
+			result.Reason = fmt.Sprintf("load only drew %vA at %vA", current, value)
+			inconclusive = true
+			return false
+		}
+		result.InputCurrent = current
+		return true
+	})
+	if powerOut {
+		log.Printf("Pedestal probe stopped by a loss of shore power without saving a result.")
+		return
+	}
+	if aborted || inconclusive {
+		fallback := c.fallbackLimit(location)
+		if aborted {
+			log.Printf("Pedestal probe aborted without saving a result. Ramping input current limit to %vA.", fallback)
+		} else {
+			log.Printf("Pedestal probe inconclusive, %s. Ramping input current limit to %vA without saving a result.", result.Reason, fallback)
+		}
+		rampCurrent(c.inputLimits, fallback, c.inputCurrentFunc, nil)
+		return
+	}
+	if location == "" {
+		log.Printf("Pedestal probe settled on %vA: %s. Not saving the result without a GPS fix.", limit, result.Reason)
+		return
+	}
+	result.Limit = limit
+	result.ProbedAt = time.Now().Unix()
+	log.Printf("Pedestal probe at %s settled on %vA: %s. Voltage went from %vV to %vV with %vA drawn.", location, limit, result.Reason, result.BaselineVoltage, result.LowestVoltage, result.InputCurrent)
+	c.probe.mux.Lock()
+	c.probe.Results[location] = result
+	c.probe.SaveToFile(c.probeFile)
+	c.probe.mux.Unlock()
+}
@@ -0,0 +1,168 @@
+package vebus
+
+import (
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	defaultSettleThreshold = 0.8
+	defaultDeviceDelay     = 30 * time.Second
+	defaultRestoreSag      = 8
+)
+
+// GetInputCurrent returns the highest current reported on the active AC input.
+func (c *Client) GetInputCurrent() float64 {
+	maxIn := float64(0)
+	c.mux.RLock()
+	for _, value := range c.values {
+		if value.name == "ac_activein_current" {
+			if value.value > maxIn {
+				maxIn = value.value
+			}
+		}
+	}
+	c.mux.RUnlock()
+	return maxIn
+}
+
+// restoreSequence turns high power devices back on one at a time after shore
+// power returns, highest priority first. Each device waits for its delay and for
+// the input current to settle. If the input voltage sags the devices restored so
+// far are turned off again and the restore is retried once shore power has been
+// good for a while.
+func (c *Client) restoreSequence() {
+	c.automation.mux.Lock()
+	if c.loadShed.restoring {
+		c.automation.mux.Unlock()
+		return
+	}
+	c.loadShed.restoring = true
+	ids := c.sortedDeviceIDs()
+	c.automation.mux.Unlock()
+	sagVoltage := c.sagVoltage(c.GetInputVoltage())
+	defer func() {
+		c.automation.mux.Lock()
+		c.loadShed.restoring = false
+		c.automation.mux.Unlock()
+	}()
+	restored := make([]string, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		c.automation.mux.Lock()
+		item := c.automation.HpDevices[ids[i]]
+		c.automation.mux.Unlock()
+		if item.Shed {
+			continue
+		}
+		state, ok := item.restoreState(item.State)
+		if !ok {
+			continue
+		}
+		delay := item.RestoreDelay
+		if delay == 0 {
+			delay = c.deviceDelay()
+		}
+		if !c.waitToRestore(delay, sagVoltage) {
+			c.abortRestore(restored)
+			return
+		}
+		log.Printf("Setting item %s enabled to %v from False due to power restoration.", ids[i], state)
+		item.SetState(state)
+		restored = append(restored, ids[i])
+	}
+}
+
+// waitToRestore waits for the delay to pass and the input current to settle. It
+// returns false if shore power is lost or the input voltage sags below
+// sagVoltage while waiting.
+func (c *Client) waitToRestore(delay time.Duration, sagVoltage float64) bool {
+	deadline := time.Now().Add(delay)
+	for {
+		if c.isShutdownDueToPowerOut() {
+			return false
+		}
+		if voltage := c.GetInputVoltage(); voltage < sagVoltage {
+			log.Printf("Input voltage sagged to %v while restoring high power devices.", voltage)
+			return false
+		}
+		if !time.Now().Before(deadline) && c.inputSettled() {
+			return true
+		}
+		time.Sleep(c.pollInterval)
+	}
+}
+
+func (c *Client) inputSettled() bool {
+	limit := c.GetCurrentLimit()
+	if limit <= 0 {
+		return true
+	}
+	threshold := c.shoreDetection.Restore.SettleThreshold
+	if threshold == 0 {
+		threshold = defaultSettleThreshold
+	}
+	return c.GetInputCurrent() <= limit*threshold
+}
+
+func (c *Client) deviceDelay() time.Duration {
+	if c.shoreDetection.Restore.DeviceDelay.Duration > 0 {
+		return c.shoreDetection.Restore.DeviceDelay.Duration
+	}
+	return defaultDeviceDelay
+}
+
+// sagVoltage returns the input voltage that aborts a restore. Unless configured
+// it is a few volts below the baseline measured before the restore started, but
+// never below the voltage that counts as shore power lost.
+func (c *Client) sagVoltage(baseline float64) float64 {
+	if c.shoreDetection.Restore.SagVoltage > 0 {
+		return c.shoreDetection.Restore.SagVoltage
+	}
+	lossVoltage := c.shoreDetection.MinVoltage
+	if lossVoltage == 0 {
+		lossVoltage = defaultLossVoltage
+	}
+	return math.Max(lossVoltage, baseline-defaultRestoreSag)
+}
+
+// abortRestore turns the devices restored so far back off and marks shore power
+// as lost so the restore starts over once the voltage has recovered.
+func (c *Client) abortRestore(restored []string) {
+	c.automation.mux.Lock()
+	defer c.automation.mux.Unlock()
+	if c.automation.ShutdownDueToPowerOut {
+		return
+	}
+	log.Printf("Aborting restore of high power devices, turning %v devices back off.", len(restored))
+	for _, id := range restored {
+		c.automation.HpDevices[id].SetState("OFF")
+	}
+	c.automation.ShutdownDueToPowerOut = true
+	c.automation.LastShutdownTime = float64(time.Now().Unix())
+	c.SaveToFile(c.stateFile)
+}
+
+func (c *Client) isShutdownDueToPowerOut() bool {
+	c.automation.mux.Lock()
+	defer c.automation.mux.Unlock()
+	return c.automation.ShutdownDueToPowerOut
+}
+
+func (c *Client) setShutdownDueToPowerOut(value bool) {
+	c.automation.mux.Lock()
+	defer c.automation.mux.Unlock()
+	c.automation.ShutdownDueToPowerOut = value
+}
+
+func (c *Client) getLastShutdownTime() float64 {
+	c.automation.mux.Lock()
+	defer c.automation.mux.Unlock()
+	return c.automation.LastShutdownTime
+}
+
+func (c *Client) setLastShutdownTime(now time.Time) {
+	c.automation.mux.Lock()
+	defer c.automation.mux.Unlock()
+	c.automation.LastShutdownTime = float64(now.Unix())
+}
@@ -0,0 +1,317 @@
+package vebus
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	ShoreGood     = "good"
+	ShoreSag      = "sag"
+	ShoreBrownout = "brownout"
+	ShoreLoss     = "loss"
+
+	defaultLossVoltage    = 105
+	defaultShoreWindow    = 5 * time.Second
+	defaultHysteresis     = 2
+	defaultBrownoutDelay  = 10 * time.Second
+	defaultRecoveryDelay  = time.Minute
+	frequencyHysteresis   = 0.5
+	maxShoreEventsHistory = 100
+)
+
+var shoreSeverity = map[string]int{
+	ShoreGood:     0,
+	ShoreSag:      1,
+	ShoreBrownout: 2,
+	ShoreLoss:     3,
+}
+
+var shoreQuality = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "shoreQuality",
+		Help: "Shore power quality, 0 good, 1 sag, 2 brownout, 3 loss.",
+	},
+)
+
+type ShoreEvent struct {
+	Time      int64   `json:"time"`
+	Quality   string  `json:"quality"`
+	Reason    string  `json:"reason"`
+	Voltage   float64 `json:"voltage"`
+	Frequency float64 `json:"frequency"`
+}
+
+type shoreSample struct {
+	at    time.Time
+	value float64
+}
+
+type shoreMonitor struct {
+	mux          sync.Mutex
+	voltage      []shoreSample
+	frequency    []shoreSample
+	quality      string
+	pending      string
+	pendingSince time.Time
+	lastShed     time.Time
+	degradedAt   time.Time
+}
+
+func addSample(samples []shoreSample, sample shoreSample, window time.Duration) []shoreSample {
+	samples = append(samples, sample)
+	cutoff := sample.at.Add(-window)
+	for len(samples) > 1 && samples[0].at.Before(cutoff) {
+		samples = samples[1:]
+	}
+	return samples
+}
+
+// median is used rather than the mean so a single bad reading in the window
+// cannot move the result.
+func median(samples []shoreSample) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	values := make([]float64, len(samples))
+	for i, sample := range samples {
+		values[i] = sample.value
+	}
+	sort.Float64s(values)
+	middle := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[middle-1] + values[middle]) / 2
+	}
+	return values[middle]
+}
+
+// GetShoreQuality returns the current shore power quality.
+func (c *Client) GetShoreQuality() string {
+	c.shore.mux.Lock()
+	defer c.shore.mux.Unlock()
+	if c.shore.quality == "" {
+		return ShoreGood
+	}
+	return c.shore.quality
+}
+
+// shoreGoodFor reports whether shore power has stayed good for at least the
+// delay.
+func (c *Client) shoreGoodFor(now time.Time, delay time.Duration) bool {
+	c.shore.mux.Lock()
+	defer c.shore.mux.Unlock()
+	return c.shore.degradedAt.IsZero() || now.Sub(c.shore.degradedAt) >= delay
+}
+
+// GetShoreEvents returns the recorded shore power quality changes, oldest first.
+func (c *Client) GetShoreEvents() []ShoreEvent {
+	c.automation.mux.Lock()
+	defer c.automation.mux.Unlock()
+	events := make([]ShoreEvent, len(c.automation.ShoreEvents))
+	copy(events, c.automation.ShoreEvents)
+	return events
+}
+
+// classifyShore returns the quality for the windowed readings. Thresholds at or
+// below the current quality are raised by the hysteresis so a reading hovering
+// around a threshold does not flap.
+func (c *Client) classifyShore(voltage, frequency float64, current string) (string, string) {
+	hysteresis := c.shoreDetection.Hysteresis
+	if hysteresis == 0 {
+		hysteresis = defaultHysteresis
+	}
+	threshold := func(value float64, quality string) float64 {
+		if shoreSeverity[current] >= shoreSeverity[quality] {
+			return value + hysteresis
+		}
+		return value
+	}
+	lossVoltage := c.shoreDetection.MinVoltage
+	if lossVoltage == 0 {
+		lossVoltage = defaultLossVoltage
+	}
+	if voltage < threshold(lossVoltage, ShoreLoss) {
+		return ShoreLoss, fmt.Sprintf("voltage %.1fV below %.1fV", voltage, lossVoltage)
+	}
+	if frequency > 0 {
+		margin := float64(0)
+		if current == ShoreLoss {
+			margin = frequencyHysteresis
+		}
+		if c.shoreDetection.MinFrequency > 0 && frequency < c.shoreDetection.MinFrequency+margin {
+			return ShoreLoss, fmt.Sprintf("frequency %.2fHz below %.2fHz", frequency, c.shoreDetection.MinFrequency)
+		}
+		if c.shoreDetection.MaxFrequency > 0 && frequency > c.shoreDetection.MaxFrequency-margin {
+			return ShoreLoss, fmt.Sprintf("frequency %.2fHz above %.2fHz", frequency, c.shoreDetection.MaxFrequency)
+		}
+	}
+	if c.shoreDetection.BrownoutVoltage > 0 && voltage < threshold(c.shoreDetection.BrownoutVoltage, ShoreBrownout) {
+		return ShoreBrownout, fmt.Sprintf("voltage %.1fV below brownout threshold %.1fV", voltage, c.shoreDetection.BrownoutVoltage)
+	}
+	if c.shoreDetection.SagVoltage > 0 && voltage < threshold(c.shoreDetection.SagVoltage, ShoreSag) {
+		return ShoreSag, fmt.Sprintf("voltage %.1fV below sag threshold %.1fV", voltage, c.shoreDetection.SagVoltage)
+	}
+	return ShoreGood, fmt.Sprintf("voltage %.1fV", voltage)
+}
+
+func (c *Client) shoreDelay(quality, current string) time.Duration {
+	if shoreSeverity[quality] < shoreSeverity[current] {
+		if c.shoreDetection.RecoveryDelay.Duration > 0 {
+			return c.shoreDetection.RecoveryDelay.Duration
+		}
+		return defaultRecoveryDelay
+	}
+	switch quality {
+	case ShoreSag:
+		return c.shoreDetection.SagDelay.Duration
+	case ShoreBrownout:
+		if c.shoreDetection.BrownoutDelay.Duration > 0 {
+			return c.shoreDetection.BrownoutDelay.Duration
+		}
+		return defaultBrownoutDelay
+	case ShoreLoss:
+		return c.shoreDetection.LossDelay.Duration
+	}
+	return 0
+}
+
+// observeShore adds a voltage ("V") or frequency ("F") reading and acts on any
+// change in shore power quality.
+func (c *Client) observeShore(measurement string, value float64, now time.Time) {
+	window := c.shoreDetection.Window.Duration
+	if window == 0 {
+		window = defaultShoreWindow
+	}
+	c.shore.mux.Lock()
+	sample := shoreSample{at: now, value: value}
+	switch measurement {
+	case "V":
+		c.shore.voltage = addSample(c.shore.voltage, sample, window)
+	case "F":
+		c.shore.frequency = addSample(c.shore.frequency, sample, window)
+	}
+	if len(c.shore.voltage) == 0 {
+		c.shore.mux.Unlock()
+		return
+	}
+	voltage, frequency := median(c.shore.voltage), median(c.shore.frequency)
+	previous := c.shore.quality
+	if previous == "" {
+		previous = ShoreGood
+	}
+	quality, reason := c.classifyShore(voltage, frequency, previous)
+	changed := false
+	if quality == previous {
+		c.shore.pending = ""
+	} else {
+		if c.shore.pending != quality {
+			c.shore.pending = quality
+			c.shore.pendingSince = now
+		}
+		if now.Sub(c.shore.pendingSince) >= c.shoreDelay(quality, previous) {
+			c.shore.quality = quality
+			c.shore.pending = ""
+			changed = true
+		}
+	}
+	current := c.shore.quality
+	if current == "" {
+		current = ShoreGood
+	}
+	if current != ShoreGood {
+		c.shore.degradedAt = now
+	}
+	shedDue := current == ShoreBrownout && (changed || now.Sub(c.shore.lastShed) >= c.shoreDelay(ShoreBrownout, ShoreBrownout))
+	if shedDue {
+		c.shore.lastShed = now
+	}
+	c.shore.mux.Unlock()
+
+	if changed {
+		log.Printf("Shore power quality changed from %s to %s: %s.", previous, quality, reason)
+		shoreQuality.Set(float64(shoreSeverity[quality]))
+		c.recordShoreEvent(ShoreEvent{
+			Time:      now.Unix(),
+			Quality:   quality,
+			Reason:    reason,
+			Voltage:   voltage,
+			Frequency: frequency,
+		})
+	}
+	switch current {
+	case ShoreLoss:
+		if !c.isShutdownDueToPowerOut() {
+			c.setLastShutdownTime(now)
+			log.Printf("Shutting high power devices down due to power failure. Voltage at %v", voltage)
+			c.shutdownHPDevices()
+			c.setShutdownDueToPowerOut(true)
+		}
+	case ShoreBrownout:
+		if shedDue && !c.isShutdownDueToPowerOut() {
+			log.Printf("Shedding load due to brownout. Voltage at %v", voltage)
+			c.shedNextDevice(now)
+		}
+	default:
+		if c.isShutdownDueToPowerOut() {
+			if float64(now.Unix()) > c.getLastShutdownTime()+c.shoreDelay(ShoreGood, ShoreLoss).Seconds() {
+				c.setShutdownDueToPowerOut(false)
+				c.resetHPDevices()
+			}
+		} else if changed && previous == ShoreBrownout {
+			go c.restoreShedDevices()
+		}
+	}
+}
+
+func (c *Client) recordShoreEvent(event ShoreEvent) {
+	c.automation.mux.Lock()
+	defer c.automation.mux.Unlock()
+	c.automation.ShoreEvents = append(c.automation.ShoreEvents, event)
+	if len(c.automation.ShoreEvents) > maxShoreEventsHistory {
+		c.automation.ShoreEvents = c.automation.ShoreEvents[len(c.automation.ShoreEvents)-maxShoreEventsHistory:]
+	}
+	c.SaveToFile(c.stateFile)
+}
+
+// restoreShedDevices brings back devices shed during a brownout one at a time,
+// using the same delays and checks as the restore after a power failure.
+func (c *Client) restoreShedDevices() {
+	c.automation.mux.Lock()
+	if c.loadShed.restoring {
+		c.automation.mux.Unlock()
+		return
+	}
+	c.loadShed.restoring = true
+	c.automation.mux.Unlock()
+	defer func() {
+		c.automation.mux.Lock()
+		c.loadShed.restoring = false
+		c.automation.mux.Unlock()
+	}()
+	sagVoltage := c.sagVoltage(c.GetInputVoltage())
+	for c.hasShedDevices() {
+		if !c.waitToRestore(c.deviceDelay(), sagVoltage) {
+			return
+		}
+		if c.GetShoreQuality() != ShoreGood {
+			return
+		}
+		c.restoreNextDevice()
+	}
+}
+
+func (c *Client) hasShedDevices() bool {
+	c.automation.mux.Lock()
+	defer c.automation.mux.Unlock()
+	for _, item := range c.automation.HpDevices {
+		if item.Registered && item.Shed {
+			return true
+		}
+	}
+	return false
+}
@@ -5,14 +5,18 @@ import (
 	"fmt"
 	"github.com/jgulick48/rv-homekit/internal/openevse"
 	"github.com/jgulick48/rv-homekit/internal/tanksensors"
-	"io/ioutil"
 	"log"
 	"math"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jgulick48/hc/accessory"
+	"github.com/jgulick48/hc/characteristic"
+	"github.com/jgulick48/hc/service"
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/jgulick48/rv-homekit/internal/automation"
@@ -20,7 +24,15 @@ import (
 	"github.com/jgulick48/rv-homekit/internal/metrics"
 	"github.com/jgulick48/rv-homekit/internal/models"
 	"github.com/jgulick48/rv-homekit/internal/mqtt"
+	"github.com/jgulick48/rv-homekit/internal/mqtt/alarms"
+	"github.com/jgulick48/rv-homekit/internal/mqtt/gxio"
+	"github.com/jgulick48/rv-homekit/internal/mqtt/system"
+	"github.com/jgulick48/rv-homekit/internal/mqtt/tank"
+	"github.com/jgulick48/rv-homekit/internal/mqtt/temperature"
+	"github.com/jgulick48/rv-homekit/internal/mqtt/vebus"
 	"github.com/jgulick48/rv-homekit/internal/openHab"
+	"github.com/jgulick48/rv-homekit/internal/scheduler"
+	"github.com/jgulick48/rv-homekit/internal/storage"
 )
 
 type client struct {
@@ -30,9 +42,34 @@ type client struct {
 	tankSensors tanksensors.Client
 	mqttClient  mqtt.Client
 	evseClient  *openevse.Client
+	protection  *automation.ChargeProtection
+	health      *automation.HealthTracker
+	forecast    *automation.Forecaster
+	scheduler   *scheduler.Scheduler
+	tankLevels  *tankLevels
 	syncFuncs   []func()
 }
 
+// tankLevels holds the last level read for each tank by name, from both the
+// Mopeka sensors and the OneControl tanks.
+type tankLevels struct {
+	mux    sync.Mutex
+	levels map[string]float64
+}
+
+func (t *tankLevels) set(name string, level float64) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.levels[name] = level
+}
+
+func (t *tankLevels) get(name string) (float64, bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	level, ok := t.levels[name]
+	return level, ok
+}
+
 type Client interface {
 	GetAccessoriesFromOpenHab(things []openHab.EnrichedThingDTO) []*accessory.Accessory
 	SaveClientConfig(filename string)
@@ -43,14 +80,12 @@ func LoadClientConfig(filename string) models.Config {
 	if filename == "" {
 		filename = "./config.json"
 	}
-	configFile, err := ioutil.ReadFile(filename)
-	if err != nil {
+	var config models.Config
+	err := storage.ReadJSON(filename, &config)
+	if os.IsNotExist(err) {
 		log.Printf("No config file found. Making new IDs")
 		panic(err)
-	}
-	var config models.Config
-	err = json.Unmarshal(configFile, &config)
-	if err != nil {
+	} else if err != nil {
 		log.Printf("Invliad config file provided")
 		panic(err)
 	}
@@ -61,21 +96,27 @@ func (c *client) SaveClientConfig(filename string) {
 	if filename == "" {
 		filename = "./config.json"
 	}
-	data, err := json.MarshalIndent(c.config, "", "  ")
-	if err != nil {
-		return
+	if err := storage.WriteJSON(filename, c.config); err != nil {
+		log.Printf("Error saving %s: %s", filename, err)
 	}
-	ioutil.WriteFile(filename, data, 0644)
 }
 
 func NewClient(config models.Config, habClient openHab.Client, bmvClient *bmv.Client, tankSensors tanksensors.Client, mqttClient mqtt.Client, evseClient *openevse.Client) Client {
 	prometheus.MustRegister(
 		batteryAmpHours,
+		batteryAmpHoursDrawn,
 		batteryAutoChargeStarted,
 		batteryAutoChargeState,
+		batteryChargeCycles,
+		batteryChargeProtection,
 		batteryChargeTimeRemaining,
 		batteryCurrent,
+		batteryDepthOfDischarge,
+		batteryEstimatedCapacity,
+		batteryForecast,
+		batteryForecastWhatIf,
 		batteryStateOfCharge,
+		batteryStateOfHealth,
 		batteryTemperature,
 		batteryTimeRemaining,
 		batteryVolts,
@@ -84,11 +125,19 @@ func NewClient(config models.Config, habClient openHab.Client, bmvClient *bmv.Cl
 		tankBatteryVoltage,
 		tankLevel,
 		tankLevelMM,
+		sensorHumidity,
+		sensorTemperature,
+		drivingActive,
+		dcdcMeasurement,
+		tankRuleActive,
 		tankSensorQuality,
 		tankSensorRSSI,
 		tankTempCelsius,
 		tankTempFahrenheit,
 		generatorStatus,
+		generatorStartFailed,
+		generatorRunHours,
+		generatorServiceHoursRemaining,
 		hvacCurrentMode,
 		hvacCurrentStatus,
 		hvacTemperature,
@@ -100,6 +149,7 @@ func NewClient(config models.Config, habClient openHab.Client, bmvClient *bmv.Cl
 		tankSensors: tankSensors,
 		mqttClient:  mqttClient,
 		evseClient:  evseClient,
+		tankLevels:  &tankLevels{levels: make(map[string]float64)},
 		syncFuncs:   make([]func(), 0),
 	}
 }
@@ -118,12 +168,11 @@ func (c *client) RunSyncFunctions() {
 
 func (c *client) GetAccessoriesFromOpenHab(things []openHab.EnrichedThingDTO) []*accessory.Accessory {
 	var itemIDs map[string]uint64
-	itemConfigFile, err := ioutil.ReadFile("./items.json")
-	if err != nil {
+	err := storage.ReadJSON(storage.Path("items.json"), &itemIDs)
+	if os.IsNotExist(err) {
 		log.Printf("No config file found. Making new IDs")
 		itemIDs = make(map[string]uint64)
-	}
-	if err = json.Unmarshal(itemConfigFile, &itemIDs); err != nil {
+	} else if err != nil {
 		log.Printf("Invalid config file format. Starting new.")
 		itemIDs = make(map[string]uint64)
 	}
@@ -142,6 +191,20 @@ func (c *client) GetAccessoriesFromOpenHab(things []openHab.EnrichedThingDTO) []
 	accessories, ok = c.registerBatteryLevel(id, "House Battery", accessories)
 	if ok {
 		itemIDs["House Battery"] = id
+		if c.config.BatteryHealth.Enabled {
+			c.registerBatteryHealth("House Battery")
+		}
+	}
+	for _, bank := range c.config.Batteries {
+		id, ok = itemIDs[bank.Name]
+		if !ok {
+			id = maxID
+			maxID++
+		}
+		accessories, ok = c.registerBatteryBank(id, bank, accessories)
+		if ok {
+			itemIDs[bank.Name] = id
+		}
 	}
 	id, ok = itemIDs["EVSE"]
 	if !ok {
@@ -154,12 +217,88 @@ func (c *client) GetAccessoriesFromOpenHab(things []openHab.EnrichedThingDTO) []
 	if ok {
 		itemIDs["EVSE"] = id
 	}
+	if c.config.Forecast.Enabled && (c.bmvClient != nil || c.mqttClient.IsEnabled()) {
+		id, ok = itemIDs["Battery Forecast"]
+		if !ok {
+			id = maxID
+			maxID++
+			itemIDs["Battery Forecast"] = id
+		}
+		accessories = c.registerForecast(id, "House Battery", accessories)
+	}
+	if c.config.Scheduler.Enabled {
+		c.scheduler = scheduler.NewScheduler(c.config.Scheduler, c.scheduleTarget, c.schedulePosition)
+		for _, name := range c.scheduler.Names() {
+			key := fmt.Sprintf("Schedule %s", name)
+			id, ok = itemIDs[key]
+			if !ok {
+				id = maxID
+				maxID++
+				itemIDs[key] = id
+			}
+			accessories = c.registerSchedule(id, name, accessories)
+		}
+		c.scheduler.Start()
+	}
+	if c.config.ChargeProtection.Enabled && c.mqttClient.IsEnabled() {
+		id, ok = itemIDs["ChargeProtection"]
+		if !ok {
+			id = maxID
+			maxID++
+		}
+		accessories, ok = c.registerChargeProtection(id, accessories)
+		if ok {
+			itemIDs["ChargeProtection"] = id
+		}
+	}
+	if c.config.ShoreDetection.PedestalProbe.Enabled && c.mqttClient.IsEnabled() {
+		id, ok = itemIDs["PedestalProbe"]
+		if !ok {
+			id = maxID
+			maxID++
+			itemIDs["PedestalProbe"] = id
+		}
+		accessories = c.registerPedestalProbe(id, accessories)
+	}
+	if c.config.Driving.Enabled && c.mqttClient.IsEnabled() {
+		id, ok = itemIDs["Driving"]
+		if !ok {
+			id = maxID
+			maxID++
+			itemIDs["Driving"] = id
+		}
+		accessories = c.registerDriving(id, accessories)
+	}
 	var foundTankSensors int
 	if c.tankSensors != nil {
 		itemIDs, accessories, maxID, foundTankSensors = c.registerTankSensors(itemIDs, accessories)
 	} else {
 		log.Printf("Tank sensors not configured skipping.")
 	}
+	sensors := c.config.MQTTSensors
+	if (sensors.Tanks || sensors.Temperatures || sensors.Relays || sensors.DigitalInputs) && c.mqttClient.IsEnabled() {
+		itemIDs, accessories, maxID = c.registerMQTTSensors(itemIDs, accessories, maxID)
+	}
+	if c.config.MQTTSensors.Alarms && c.mqttClient.IsEnabled() {
+		id, ok = itemIDs["GX Alarms"]
+		if !ok {
+			id = maxID
+			maxID++
+			itemIDs["GX Alarms"] = id
+		}
+		accessories = c.registerGXAlarms(id, accessories)
+	}
+	if c.config.MQTTSensors.Power && c.mqttClient.IsEnabled() {
+		for _, signal := range powerSignals {
+			id, ok = itemIDs[signal.name]
+			if !ok {
+				id = maxID
+				maxID++
+				itemIDs[signal.name] = id
+			}
+			accessories = c.registerPowerSensor(id, signal.name, signal.signal, accessories)
+		}
+	}
 	for _, thing := range things {
 		if !thing.Editable {
 			continue
@@ -183,10 +322,10 @@ func (c *client) GetAccessoriesFromOpenHab(things []openHab.EnrichedThingDTO) []
 				id = maxID
 				itemIDs[thing.UID] = id
 			}
-			var generatorAutomation automation.Automation
+			var generatorAutomation *automation.Automation
 			accessories, generatorAutomation = c.registerGenerator(id, thing, accessories)
 			fmt.Printf("Found %s : %s\n", thing.Label, thing.UID)
-			if generatorAutomation.IsEnabled() {
+			if generatorAutomation != nil && generatorAutomation.IsEnabled() {
 				id, ok := itemIDs["BatteryAutoCharge"]
 				if !ok {
 					maxID++
@@ -194,6 +333,23 @@ func (c *client) GetAccessoriesFromOpenHab(things []openHab.EnrichedThingDTO) []
 					itemIDs["BatteryAutoCharge"] = id
 				}
 				accessories = c.registerGeneratorAutomation(id, generatorAutomation, accessories)
+				id, ok = itemIDs["GeneratorStartFailure"]
+				if !ok {
+					maxID++
+					id = maxID
+					itemIDs["GeneratorStartFailure"] = id
+				}
+				accessories = c.registerGeneratorStartFailure(id, generatorAutomation, accessories)
+				for _, status := range generatorAutomation.GetServiceStatus() {
+					key := fmt.Sprintf("GeneratorService:%s", status.Name)
+					id, ok := itemIDs[key]
+					if !ok {
+						maxID++
+						id = maxID
+						itemIDs[key] = id
+					}
+					accessories = c.registerGeneratorMaintenance(id, status.Name, generatorAutomation, accessories)
+				}
 			}
 			continue
 		}
@@ -213,17 +369,23 @@ func (c *client) GetAccessoriesFromOpenHab(things []openHab.EnrichedThingDTO) []
 				}
 				accessories = registrationMethod(id, item, thing.Label, accessories)
 				fmt.Printf("Found %s : %s\n", thing.Label, thing.UID)
+				if device, ok := c.getChannelHighPowerDevice(thing, channel, item); ok && c.mqttClient.IsEnabled() {
+					c.mqttClient.RegisterOpenHabHPDevice(&item, device)
+				}
 				if channel.ChannelTypeUID == "idsmyrv:hsvcolor" {
 					break
 				}
 			}
 		}
 	}
-	itemConfigFile, err = json.MarshalIndent(itemIDs, "", "  ")
+	if len(c.config.TankRules) > 0 {
+		c.registerTankRules()
+	}
+	itemConfigFile, err := json.MarshalIndent(itemIDs, "", "  ")
 	if err != nil {
 		log.Printf("Error trying to create config file: %s", err)
 	} else {
-		err = ioutil.WriteFile("./items.json", itemConfigFile, 0644)
+		err = storage.WriteFile(storage.Path("items.json"), itemConfigFile)
 		if err != nil {
 			log.Printf("Error trying to save config file: %s", err)
 		}
@@ -246,17 +408,49 @@ func (c *client) registerBatteryLevel(id uint64, name string, accessories []*acc
 	if c.bmvClient != nil {
 		bmvClient = *c.bmvClient
 	} else if c.mqttClient.IsEnabled() {
-		go func() {
-			for {
-				time.Sleep(time.Second * 10)
-				c.mqttClient.Connect()
-				log.Printf("Mqtt connection lost, reconnecting.")
-			}
-		}()
 		bmvClient = c.mqttClient.GetBatteryClient()
 	} else {
 		return accessories, false
 	}
+	return c.registerBattery(ac, name, bmvClient, accessories), true
+}
+
+// bankClient returns the battery monitor for an additional battery bank.
+func (c *client) bankClient(bank models.BatteryBank) (bmv.Client, bool) {
+	switch bank.Source {
+	case "mqtt":
+		if !c.mqttClient.IsEnabled() {
+			log.Printf("Battery %s needs an MQTT connection, skipping.", bank.Name)
+			return nil, false
+		}
+		return c.mqttClient.GetBatteryInstance(bank.Instance), true
+	case "vedirect":
+		if bank.Device == "" {
+			log.Printf("Battery %s has no device set, skipping.", bank.Name)
+			return nil, false
+		}
+		return bmv.NewClient(models.BMVConfig{Device: bank.Device, Baud: bank.Baud, Name: bank.Name}), true
+	default:
+		log.Printf("Battery %s has an unknown source %s, skipping.", bank.Name, bank.Source)
+		return nil, false
+	}
+}
+
+func (c *client) registerBatteryBank(id uint64, bank models.BatteryBank, accessories []*accessory.Accessory) ([]*accessory.Accessory, bool) {
+	bmvClient, ok := c.bankClient(bank)
+	if !ok {
+		return accessories, false
+	}
+	ac := accessory.NewHumiditySensor(accessory.Info{
+		Name: bank.Name,
+		ID:   id,
+	})
+	return c.registerBattery(ac, bank.Name, bmvClient, accessories), true
+}
+
+// registerBattery shows the state of charge of a battery in HomeKit and sends
+// its readings as metrics labelled with name.
+func (c *client) registerBattery(ac *accessory.HumiditySensor, name string, bmvClient bmv.Client, accessories []*accessory.Accessory) []*accessory.Accessory {
 	var lastState float64
 	syncFunc := func() {
 		soc, ok := bmvClient.GetBatteryStateOfCharge()
@@ -306,6 +500,274 @@ func (c *client) registerBatteryLevel(id uint64, name string, accessories []*acc
 	ac.HumiditySensor.CurrentRelativeHumidity.SetMinValue(0)
 	ac.HumiditySensor.CurrentRelativeHumidity.SetMaxValue(100)
 	accessories = append(accessories, ac.Accessory)
+	return accessories
+}
+
+// batteryClient returns the VE.Direct battery monitor if one is configured,
+// otherwise the battery reported over MQTT.
+func (c *client) batteryClient() bmv.Client {
+	if c.bmvClient != nil {
+		return *c.bmvClient
+	}
+	return c.mqttClient.GetBatteryClient()
+}
+
+// registerBatteryHealth starts tracking battery cycles and capacity and exports
+// the results as metrics.
+func (c *client) registerBatteryHealth(name string) {
+	c.health = automation.NewHealthTracker(c.config.BatteryHealth, c.batteryClient())
+	c.health.Start()
+	syncFunc := func() {
+		if !metrics.StatsEnabled {
+			return
+		}
+		tags := []string{fmt.Sprintf("name:%s", name)}
+		state := c.health.GetState()
+		metrics.SendGaugeMetricWithRate("battery.chargeCycles", state.ChargeCycles, tags, 1)
+		batteryChargeCycles.WithLabelValues(name, "charge").Set(state.ChargeCycles)
+		metrics.SendGaugeMetricWithRate("battery.fullDischarges", state.FullDischarges, tags, 1)
+		batteryChargeCycles.WithLabelValues(name, "fullDischarge").Set(state.FullDischarges)
+		metrics.SendGaugeMetricWithRate("battery.ampHoursDrawn", state.TotalAhDrawn, tags, 1)
+		batteryAmpHoursDrawn.WithLabelValues(name).Set(state.TotalAhDrawn)
+		metrics.SendGaugeMetricWithRate("battery.deepestDischarge", state.DeepestDischarge, tags, 1)
+		batteryDepthOfDischarge.WithLabelValues(name, "deepest").Set(state.DeepestDischarge)
+		if average, ok := c.health.AverageDischarge(); ok {
+			metrics.SendGaugeMetricWithRate("battery.averageDischarge", average, tags, 1)
+			batteryDepthOfDischarge.WithLabelValues(name, "average").Set(average)
+		}
+		if cycles, ok := c.health.EquivalentCycles(); ok {
+			metrics.SendGaugeMetricWithRate("battery.equivalentCycles", cycles, tags, 1)
+			batteryChargeCycles.WithLabelValues(name, "equivalent").Set(cycles)
+		}
+		if capacity, ok := c.health.EstimatedCapacity(); ok {
+			metrics.SendGaugeMetricWithRate("battery.estimatedCapacity", capacity, tags, 1)
+			batteryEstimatedCapacity.WithLabelValues(name).Set(capacity)
+		}
+		if health, ok := c.health.StateOfHealth(); ok {
+			metrics.SendGaugeMetricWithRate("battery.stateOfHealth", health, tags, 1)
+			batteryStateOfHealth.WithLabelValues(name).Set(health)
+		}
+	}
+	syncFunc()
+	c.syncFuncs = append(c.syncFuncs, syncFunc)
+}
+
+// registerForecast starts the battery forecast and adds a sensor showing the
+// hours until the battery is empty, capped at 100 while charging or idle.
+func (c *client) registerForecast(id uint64, name string, accessories []*accessory.Accessory) []*accessory.Accessory {
+	c.forecast = automation.NewForecaster(c.config.Forecast, c.batteryClient())
+	c.forecast.Start()
+	ac := accessory.NewHumiditySensor(accessory.Info{
+		Name: "Battery Hours Remaining",
+		ID:   id,
+	})
+	lastState := float64(-1)
+	syncFunc := func() {
+		result, ok := c.forecast.Forecast()
+		if !ok {
+			return
+		}
+		hours := float64(100)
+		if result.EmptyOK {
+			hours = math.Min(math.Round(result.TimeToEmpty.Hours()), 100)
+		}
+		if hours != lastState {
+			ac.HumiditySensor.CurrentRelativeHumidity.SetValue(hours)
+			lastState = hours
+		}
+		if metrics.StatsEnabled {
+			tags := []string{fmt.Sprintf("name:%s", name)}
+			metrics.SendGaugeMetricWithRate("battery.forecast.netPower", result.NetPower, tags, 1)
+			batteryForecast.WithLabelValues(name, "netPower").Set(result.NetPower)
+			// Estimates that are no longer valid are removed rather than left at
+			// their last value.
+			if result.EmptyOK {
+				metrics.SendGaugeMetricWithRate("battery.forecast.timeToEmpty", result.TimeToEmpty.Seconds(), tags, 1)
+				batteryForecast.WithLabelValues(name, "timeToEmpty").Set(result.TimeToEmpty.Seconds())
+			} else {
+				batteryForecast.DeleteLabelValues(name, "timeToEmpty")
+			}
+			if result.FullOK {
+				metrics.SendGaugeMetricWithRate("battery.forecast.timeToFull", result.TimeToFull.Seconds(), tags, 1)
+				batteryForecast.WithLabelValues(name, "timeToFull").Set(result.TimeToFull.Seconds())
+			} else {
+				batteryForecast.DeleteLabelValues(name, "timeToFull")
+			}
+			for _, load := range c.config.Forecast.Loads {
+				whatIf, ok := c.forecast.WhatIf(load.Name)
+				if !ok || !whatIf.EmptyOK {
+					batteryForecastWhatIf.DeleteLabelValues(name, load.Name)
+					continue
+				}
+				metrics.SendGaugeMetricWithRate("battery.forecast.whatIf.timeToEmpty", whatIf.TimeToEmpty.Seconds(), append(tags, fmt.Sprintf("load:%s", load.Name)), 1)
+				batteryForecastWhatIf.WithLabelValues(name, load.Name).Set(whatIf.TimeToEmpty.Seconds())
+			}
+		}
+	}
+	syncFunc()
+	c.syncFuncs = append(c.syncFuncs, syncFunc)
+	ac.HumiditySensor.CurrentRelativeHumidity.SetMinValue(0)
+	ac.HumiditySensor.CurrentRelativeHumidity.SetMaxValue(100)
+	accessories = append(accessories, ac.Accessory)
+	return accessories
+}
+
+// scheduleTarget returns the function used by the scheduler to set a target.
+func (c *client) scheduleTarget(target models.ScheduleTarget) (func(string), bool) {
+	switch target.Type {
+	case "openhab":
+		return func(value string) {
+			item, err := c.habClient.GetItem(target.Item)
+			if err != nil || item.Link == "" {
+				log.Printf("Unable to find openHAB item %s for schedule", target.Item)
+				return
+			}
+			item.SetItemState(value)
+		}, true
+	case "victron":
+		if !c.mqttClient.IsEnabled() {
+			return nil, false
+		}
+		return func(value string) {
+			c.mqttClient.Write(target.Item, value)
+		}, true
+	case "evse":
+		if c.evseClient == nil || !c.config.EVSEConfiguration.Enabled {
+			return nil, false
+		}
+		return c.evseClient.SetState, true
+	}
+	return nil, false
+}
+
+func (c *client) schedulePosition() (float64, float64, bool) {
+	if !c.mqttClient.IsEnabled() {
+		return 0, 0, false
+	}
+	return c.mqttClient.GetGPSClient().GetPosition()
+}
+
+// victronTarget writes a path on the GX device for tank rules. The current
+// value is not read back, so it cannot be held.
+type victronTarget struct {
+	mqttClient mqtt.Client
+	path       string
+}
+
+func (v victronTarget) GetState() (string, error) {
+	return "", fmt.Errorf("reading %s is not supported", v.path)
+}
+
+func (v victronTarget) SetState(state string) {
+	v.mqttClient.Write(v.path, state)
+}
+
+// tankTarget returns the device controlled by a tank rule.
+func (c *client) tankTarget(target models.ScheduleTarget) (automation.TankTarget, bool) {
+	switch target.Type {
+	case "openhab":
+		item, err := c.habClient.GetItem(target.Item)
+		if err != nil || item.Link == "" {
+			log.Printf("Unable to find openHAB item %s for tank rule", target.Item)
+			return nil, false
+		}
+		return &item, true
+	case "victron":
+		if !c.mqttClient.IsEnabled() {
+			return nil, false
+		}
+		return victronTarget{mqttClient: c.mqttClient, path: target.Item}, true
+	case "evse":
+		if c.evseClient == nil || !c.config.EVSEConfiguration.Enabled {
+			return nil, false
+		}
+		return c.evseClient, true
+	}
+	return nil, false
+}
+
+// ruleSignal returns the value of one of the system power signals when the MQTT
+// client is enabled.
+func (c *client) ruleSignal(name string) (float64, bool) {
+	if c.mqttClient.IsEnabled() {
+		return c.mqttClient.GetSystemClient().GetSignal(name)
+	}
+	return 0, false
+}
+
+// registerTankRules starts the tank level rules and reports which are active.
+func (c *client) registerTankRules() {
+	rules := automation.NewTankRules(c.config.TankRules, c.tankLevels.get, c.ruleSignal, c.tankTarget)
+	rules.Start()
+	syncFunc := func() {
+		if !metrics.StatsEnabled {
+			return
+		}
+		active := rules.ActiveRules()
+		for _, name := range rules.Names() {
+			value := float64(0)
+			if _, ok := active[name]; ok {
+				value = 1
+			}
+			metrics.SendGaugeMetricWithRate("tank.rule.active", value, []string{fmt.Sprintf("name:%s", name)}, 1)
+			tankRuleActive.WithLabelValues(name).Set(value)
+		}
+	}
+	c.syncFuncs = append(c.syncFuncs, syncFunc)
+}
+
+// registerSchedule adds a switch to enable or disable a schedule entry.
+func (c *client) registerSchedule(id uint64, name string, accessories []*accessory.Accessory) []*accessory.Accessory {
+	ac := accessory.NewSwitch(accessory.Info{
+		Name: fmt.Sprintf("Schedule %s", name),
+		ID:   id,
+	})
+	ac.Switch.On.OnValueRemoteUpdate(func(on bool) {
+		c.scheduler.SetEnabled(name, on)
+	})
+	syncFunc := func() {
+		ac.Switch.On.SetValue(c.scheduler.IsEnabled(name))
+	}
+	syncFunc()
+	c.syncFuncs = append(c.syncFuncs, syncFunc)
+	accessories = append(accessories, ac.Accessory)
+	return accessories
+}
+
+// registerChargeProtection starts the battery temperature charge protection and
+// adds a sensor that opens while charging is limited.
+func (c *client) registerChargeProtection(id uint64, accessories []*accessory.Accessory) ([]*accessory.Accessory, bool) {
+	c.protection = automation.NewChargeProtection(c.config.ChargeProtection, c.batteryClient(), c.mqttClient, c.config.DVCCConfiguration)
+	c.protection.Start()
+	ac := accessory.New(accessory.Info{
+		Name: "Battery Charge Protection",
+		ID:   id,
+	}, accessory.TypeSensor)
+	sensor := service.NewContactSensor()
+	ac.AddService(sensor.Service)
+	lastState := false
+	syncFunc := func() {
+		active := c.protection.IsActive()
+		if active != lastState {
+			if active {
+				sensor.ContactSensorState.SetValue(characteristic.ContactSensorStateContactNotDetected)
+			} else {
+				sensor.ContactSensorState.SetValue(characteristic.ContactSensorStateContactDetected)
+			}
+			lastState = active
+		}
+		if metrics.StatsEnabled {
+			value := float64(0)
+			if active {
+				value = 1
+			}
+			metrics.SendGaugeMetricWithRate("battery.chargeProtection", value, []string{}, 1)
+			batteryChargeProtection.WithLabelValues().Set(value)
+		}
+	}
+	syncFunc()
+	c.syncFuncs = append(c.syncFuncs, syncFunc)
+	accessories = append(accessories, ac)
 	return accessories, true
 }
 
@@ -397,7 +859,9 @@ func (c *client) registerTankSensor(id uint64, accessories []*accessory.Accessor
 			if temp = device.GetTempCelsius(); lastTemp != temp {
 				ac2.TempSensor.CurrentTemperature.SetValue(temp)
 			}
-			if level = device.GetLevelPercent(deviceConfig.Type); lastLevel != level {
+			level = device.GetLevelPercent(deviceConfig.Type)
+			c.tankLevels.set(name, level)
+			if lastLevel != level {
 				ac1.HumiditySensor.CurrentRelativeHumidity.SetValue(level)
 				log.Printf("got new tank level of %v for %s", level, name)
 			}
@@ -443,6 +907,9 @@ func (c *client) registerTankLevel(id uint64, item openHab.EnrichedItemDTO, name
 	syncFunc := func() {
 		item.GetCurrentValue()
 		level, err := strconv.ParseFloat(item.State, 64)
+		if err == nil {
+			c.tankLevels.set(name, level)
+		}
 		if err == nil && metrics.StatsEnabled {
 			metrics.SendGaugeMetricWithRate("tank.level", level, []string{fmt.Sprintf("name:%s", name)}, 1)
 			tankLevel.WithLabelValues(name, "OneControl").Set(level)
@@ -484,7 +951,7 @@ func (c *client) registerLightBulb(id uint64, item openHab.EnrichedItemDTO, name
 	return accessories
 }
 
-func (c *client) registerGeneratorAutomation(id uint64, generatorAutomation automation.Automation, accessories []*accessory.Accessory) []*accessory.Accessory {
+func (c *client) registerGeneratorAutomation(id uint64, generatorAutomation *automation.Automation, accessories []*accessory.Accessory) []*accessory.Accessory {
 	if !generatorAutomation.IsEnabled() {
 		return accessories
 	}
@@ -520,6 +987,9 @@ func (c *client) registerGeneratorAutomation(id uint64, generatorAutomation auto
 				metrics.SendGaugeMetricWithRate("battery.autocharge.state", 0, []string{}, 1)
 				batteryAutoChargeState.WithLabelValues().Set(0)
 			}
+			runHours := generatorAutomation.GetRunHours()
+			metrics.SendGaugeMetricWithRate("generator.runHours", runHours, []string{}, 1)
+			generatorRunHours.WithLabelValues().Set(runHours)
 		}
 	}
 	syncFunc()
@@ -528,7 +998,86 @@ func (c *client) registerGeneratorAutomation(id uint64, generatorAutomation auto
 	return accessories
 }
 
-func (c *client) registerGenerator(id uint64, thing openHab.EnrichedThingDTO, accessories []*accessory.Accessory) ([]*accessory.Accessory, automation.Automation) {
+func (c *client) registerGeneratorStartFailure(id uint64, generatorAutomation *automation.Automation, accessories []*accessory.Accessory) []*accessory.Accessory {
+	ac := accessory.New(accessory.Info{
+		Name: "Generator Start Failed",
+		ID:   id,
+	}, accessory.TypeSensor)
+	sensor := service.NewContactSensor()
+	fault := characteristic.NewStatusFault()
+	sensor.AddCharacteristic(fault.Characteristic)
+	ac.AddService(sensor.Service)
+	lastState := false
+	syncFunc := func() {
+		failed := generatorAutomation.IsStartFailed()
+		if failed != lastState {
+			if failed {
+				sensor.ContactSensorState.SetValue(characteristic.ContactSensorStateContactNotDetected)
+				fault.SetValue(characteristic.StatusFaultGeneralFault)
+			} else {
+				sensor.ContactSensorState.SetValue(characteristic.ContactSensorStateContactDetected)
+				fault.SetValue(characteristic.StatusFaultNoFault)
+			}
+			lastState = failed
+		}
+		if metrics.StatsEnabled {
+			value := float64(0)
+			if failed {
+				value = 1
+			}
+			metrics.SendGaugeMetricWithRate("generator.startFailed", value, []string{}, 1)
+			generatorStartFailed.WithLabelValues().Set(value)
+		}
+	}
+	syncFunc()
+	c.syncFuncs = append(c.syncFuncs, syncFunc)
+	accessories = append(accessories, ac)
+	return accessories
+}
+
+func (c *client) registerGeneratorMaintenance(id uint64, serviceName string, generatorAutomation *automation.Automation, accessories []*accessory.Accessory) []*accessory.Accessory {
+	ac := accessory.New(accessory.Info{
+		Name: fmt.Sprintf("Generator %s", serviceName),
+		ID:   id,
+	}, accessory.TypeOther)
+	maintenance := service.NewFilterMaintenance()
+	lifeLevel := characteristic.NewFilterLifeLevel()
+	reset := characteristic.NewResetFilterIndication()
+	maintenance.AddCharacteristic(lifeLevel.Characteristic)
+	maintenance.AddCharacteristic(reset.Characteristic)
+	ac.AddService(maintenance.Service)
+	reset.OnValueRemoteUpdate(func(int) {
+		generatorAutomation.ResetService(serviceName)
+	})
+	syncFunc := func() {
+		for _, status := range generatorAutomation.GetServiceStatus() {
+			if status.Name != serviceName {
+				continue
+			}
+			level := float64(100)
+			if status.Interval > 0 {
+				level = math.Max(0, 100*(1-status.HoursSince/status.Interval))
+			}
+			lifeLevel.SetValue(level)
+			if status.Due {
+				maintenance.FilterChangeIndication.SetValue(characteristic.FilterChangeIndicationChangeFilter)
+			} else {
+				maintenance.FilterChangeIndication.SetValue(characteristic.FilterChangeIndicationFilterOK)
+			}
+			if metrics.StatsEnabled {
+				remaining := status.Interval - status.HoursSince
+				metrics.SendGaugeMetricWithRate("generator.serviceHoursRemaining", remaining, []string{fmt.Sprintf("service:%s", serviceName)}, 1)
+				generatorServiceHoursRemaining.WithLabelValues(serviceName).Set(remaining)
+			}
+		}
+	}
+	syncFunc()
+	c.syncFuncs = append(c.syncFuncs, syncFunc)
+	accessories = append(accessories, ac)
+	return accessories
+}
+
+func (c *client) registerGenerator(id uint64, thing openHab.EnrichedThingDTO, accessories []*accessory.Accessory) ([]*accessory.Accessory, *automation.Automation) {
 	log.Printf("Initializing Generator.")
 	ac := accessory.NewSwitch(accessory.Info{
 		Name: thing.Label,
@@ -541,19 +1090,23 @@ func (c *client) registerGenerator(id uint64, thing openHab.EnrichedThingDTO, ac
 	startStopThing, ok := getThingFromChannels(channels, thing.UID, "command", c.habClient)
 	if !ok {
 		log.Printf("Unable to get switch for %s, skipping generator.", thing.UID)
-		return accessories, automation.Automation{}
+		return accessories, nil
 	}
 	stateThing, ok := getThingFromChannels(channels, thing.UID, "state", c.habClient)
 	if !ok {
 		log.Printf("Unable to get current state for %s, skipping generator.", thing.UID)
-		return accessories, automation.Automation{}
+		return accessories, nil
 	}
+	var generatorAutomation *automation.Automation
 	ac.Switch.On.OnValueRemoteUpdate(func(state bool) {
 		changeStateFunc := startStopThing.GetChangeFunction()
 		if !state {
 			time.Sleep(c.config.GeneratorOffDelay.Duration)
 		}
 		changeStateFunc(state)
+		if generatorAutomation != nil {
+			generatorAutomation.RecordManualChange(state)
+		}
 	})
 	if c.bmvClient != nil {
 		ac.AddBatteryLevel()
@@ -597,21 +1150,51 @@ func (c *client) registerGenerator(id uint64, thing openHab.EnrichedThingDTO, ac
 		lastValue = stateThing.State
 	}
 	syncFunc2()
-	var generatorAutomation automation.Automation
 	c.syncFuncs = append(c.syncFuncs, syncFunc2)
+	statusFunc := func() string {
+		stateThing.GetCurrentValue()
+		return stateThing.State
+	}
 	if c.bmvClient != nil {
 		bmvClient := *c.bmvClient
 		if config, ok := c.config.Automation["generator"]; ok {
-			generatorAutomation = automation.NewGeneratorAutomationClient(config, bmvClient, c.mqttClient, c.config.DVCCConfiguration, c.config.InputLimitConfiguration, startStopThing.GetChangeFunction(), stateThing.GetCurrentState)
+			generatorAutomation = automation.NewGeneratorAutomationClient(config, bmvClient, c.mqttClient, c.config.DVCCConfiguration, c.config.InputLimitConfiguration, startStopThing.GetChangeFunction(), stateThing.GetCurrentState, statusFunc)
 			generatorAutomation.AutomateGeneratorStart()
 		}
 	} else if c.mqttClient.IsEnabled() {
 		bmvClient := c.mqttClient.GetBatteryClient()
 		if config, ok := c.config.Automation["generator"]; ok {
-			generatorAutomation = automation.NewGeneratorAutomationClient(config, bmvClient, c.mqttClient, c.config.DVCCConfiguration, c.config.InputLimitConfiguration, startStopThing.GetChangeFunction(), stateThing.GetCurrentState)
+			generatorAutomation = automation.NewGeneratorAutomationClient(config, bmvClient, c.mqttClient, c.config.DVCCConfiguration, c.config.InputLimitConfiguration, startStopThing.GetChangeFunction(), stateThing.GetCurrentState, statusFunc)
 			generatorAutomation.AutomateGeneratorStart()
 		}
 	}
+	if config, ok := c.config.Automation["generator"]; ok && generatorAutomation != nil && config.DryRun {
+		log.Printf("Generator automation is in dry run and will not switch the generator.")
+		generatorAutomation.SetDryRun(true)
+	}
+	if generatorAutomation != nil && c.protection != nil {
+		generatorAutomation.AddStartInhibitor(c.protection.InhibitReason)
+	}
+	if generatorAutomation != nil && c.config.Driving.Enabled && c.config.Driving.InhibitGenerator && c.mqttClient.IsEnabled() {
+		chargers := c.mqttClient.GetDCDCClient()
+		generatorAutomation.AddStartInhibitor(func() string {
+			if chargers.IsDriving() {
+				return "driving with the alternator charging"
+			}
+			return ""
+		})
+	}
+	if generatorAutomation != nil && c.forecast != nil {
+		generatorAutomation.SetTimeToEmptyFunc(c.forecast.TimeToEmpty)
+	}
+	if config, ok := c.config.Automation["generator"]; ok && generatorAutomation != nil && config.SolarDeferral.Enabled && c.mqttClient.IsEnabled() {
+		vebusClient := c.mqttClient.GetVEBusClient()
+		deferral := automation.NewSolarDeferral(config.SolarDeferral, c.batteryClient(), c.mqttClient.GetPVClient(), func() bool {
+			return vebusClient.GetInputVoltage() > 0
+		})
+		deferral.Start()
+		generatorAutomation.SetStartDeferral(deferral.DeferReason)
+	}
 	accessories = append(accessories, ac.Accessory)
 	return accessories, generatorAutomation
 }
@@ -622,9 +1205,6 @@ func (c *client) registerSwitch(id uint64, item openHab.EnrichedItemDTO, name st
 		ID:   id,
 	})
 	ac.Switch.On.OnValueRemoteUpdate(item.GetChangeFunction())
-	if name == "Electric Water Heater" && c.mqttClient.IsEnabled() {
-		c.mqttClient.RegisterOpenHabHPDevice(&item)
-	}
 	lastValue := ""
 	syncFunc := func() {
 		item.GetCurrentValue()
@@ -649,8 +1229,9 @@ func (c *client) registerEVSE(id uint64, item *openevse.Client, name string, acc
 	})
 	ac.Switch.On.OnValueRemoteUpdate(item.Enable)
 	if c.mqttClient.IsEnabled() {
-		if c.config.EVSEConfiguration.Enabled && c.config.EVSEConfiguration.EnableControl {
-			c.mqttClient.RegisterEVSEHPDevice(item)
+		device, ok := c.getHighPowerDevice(name)
+		if ok && c.config.EVSEConfiguration.Enabled && c.config.EVSEConfiguration.EnableControl {
+			c.mqttClient.RegisterEVSEHPDevice(item, device)
 		}
 	}
 	lastValue := ""
@@ -667,6 +1248,30 @@ func (c *client) registerEVSE(id uint64, item *openevse.Client, name string, acc
 	return accessories, true
 }
 
+// registerPedestalProbe adds a switch that is on while the shore pedestal is
+// being probed. Turning it on probes again and turning it off aborts the probe.
+func (c *client) registerPedestalProbe(id uint64, accessories []*accessory.Accessory) []*accessory.Accessory {
+	vebusClient := c.mqttClient.GetVEBusClient()
+	ac := accessory.NewSwitch(accessory.Info{
+		Name: "Pedestal Probe",
+		ID:   id,
+	})
+	ac.Switch.On.OnValueRemoteUpdate(func(on bool) {
+		if on {
+			vebusClient.StartPedestalProbe()
+		} else {
+			vebusClient.AbortPedestalProbe()
+		}
+	})
+	syncFunc := func() {
+		ac.Switch.On.SetValue(vebusClient.IsPedestalProbeRunning())
+	}
+	syncFunc()
+	c.syncFuncs = append(c.syncFuncs, syncFunc)
+	accessories = append(accessories, ac.Accessory)
+	return accessories
+}
+
 func (c *client) registerDimmer(id uint64, item openHab.EnrichedItemDTO, name string, accessories []*accessory.Accessory) []*accessory.Accessory {
 	lightbulb := accessory.NewLightDimer(accessory.Info{
 		Name: name,
@@ -763,8 +1368,8 @@ func (c *client) registerThermostat(id uint64, thing openHab.EnrichedThingDTO, a
 		log.Printf("Unable to get current mode for %s, skipping thermostat.", thing.UID)
 		return accessories
 	}
-	if c.mqttClient.IsEnabled() {
-		c.mqttClient.RegisterOpenHabHPDevice(&modeThing)
+	if device, ok := c.getHighPowerDevice(thing.UID, thing.ThingTypeUID, thing.Label, modeThing.Name); ok && c.mqttClient.IsEnabled() {
+		c.mqttClient.RegisterOpenHabHPDevice(&modeThing, device)
 	}
 	statusThing, ok := getThingFromChannels(channels, thing.UID, "status", c.habClient)
 	if !ok {
@@ -944,6 +1549,43 @@ func (c *client) registerThermostat(id uint64, thing openHab.EnrichedThingDTO, a
 	return accessories
 }
 
+// defaultHighPowerDevices is used when no high power devices are configured.
+var defaultHighPowerDevices = []models.HighPowerDevice{
+	{Match: "Electric Water Heater", Priority: vebus.PriorityWaterHeater},
+	{Match: "EVSE", Priority: vebus.PriorityEVSE},
+	{Match: "idsmyrv:hvac-thing", Priority: vebus.PriorityHVAC},
+}
+
+// getHighPowerDevice returns the first configured high power device matching any
+// of the given UIDs or names.
+func (c *client) getHighPowerDevice(keys ...string) (models.HighPowerDevice, bool) {
+	devices := c.config.HighPowerDevices
+	if len(devices) == 0 {
+		devices = defaultHighPowerDevices
+	}
+	for _, device := range devices {
+		for _, key := range keys {
+			if key != "" && device.Match == key {
+				return device, true
+			}
+		}
+	}
+	return models.HighPowerDevice{}, false
+}
+
+// getChannelHighPowerDevice returns the high power device for a thing channel.
+// The channel UID or item name matches any channel, but the thing UID or label
+// only matches its switch channel so the thing's other items are left alone.
+func (c *client) getChannelHighPowerDevice(thing openHab.EnrichedThingDTO, channel openHab.ChannelDTO, item openHab.EnrichedItemDTO) (models.HighPowerDevice, bool) {
+	if device, ok := c.getHighPowerDevice(channel.UID, item.Name); ok {
+		return device, true
+	}
+	if channel.ChannelTypeUID != "idsmyrv:switch" {
+		return models.HighPowerDevice{}, false
+	}
+	return c.getHighPowerDevice(thing.UID, thing.Label)
+}
+
 func (c *client) getRegistrationMethod(channel openHab.ChannelDTO) (func(id uint64, item openHab.EnrichedItemDTO, name string, accessories []*accessory.Accessory) []*accessory.Accessory, bool) {
 	switch channel.ChannelTypeUID {
 	case "idsmyrv:switch":
@@ -1057,3 +1699,436 @@ func getThingFromChannels(channels map[string]openHab.ChannelDTO, thingID string
 	}
 	return thing, true
 }
+
+// registerMQTTSensors adds the tank senders, temperature sensors, relays and
+// digital inputs found on the GX device. The services announce themselves once
+// the connection is up, so wait for the count to settle before building the
+// accessories.
+func (c *client) registerMQTTSensors(itemIDs map[string]uint64, accessories []*accessory.Accessory, maxID uint64) (map[string]uint64, []*accessory.Accessory, uint64) {
+	wait := c.config.MQTTSensors.DiscoveryWait.Duration
+	if wait == 0 {
+		wait = 15 * time.Second
+	}
+	count := func() int {
+		io := c.mqttClient.GetIOClient()
+		return len(c.mqttClient.GetTankClient().GetTanks()) + len(c.mqttClient.GetTemperatureClient().GetSensors()) + len(io.GetRelays()) + len(io.GetInputs())
+	}
+	deadline := time.Now().Add(wait)
+	last, stableSince := count(), time.Now()
+	for time.Now().Before(deadline) {
+		if last > 0 && time.Since(stableSince) >= 3*time.Second {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+		if n := count(); n != last {
+			last, stableSince = n, time.Now()
+		}
+	}
+	if c.config.MQTTSensors.Tanks {
+		instances := c.rememberedInstances(itemIDs, "mqtt tank ")
+		for _, t := range c.mqttClient.GetTankClient().GetTanks() {
+			instances[t.Instance] = true
+		}
+		log.Printf("Found %v tanks on the GX device.", len(instances))
+		for _, instance := range sortedInstances(instances) {
+			key := fmt.Sprintf("mqtt tank %v", instance)
+			id, ok := itemIDs[key]
+			if !ok {
+				id = maxID
+				maxID++
+			}
+			accessories = c.registerMQTTTank(id, instance, accessories)
+			itemIDs[key] = id
+		}
+	}
+	if c.config.MQTTSensors.Temperatures {
+		instances := c.rememberedInstances(itemIDs, "mqtt temperature ")
+		for _, s := range c.mqttClient.GetTemperatureClient().GetSensors() {
+			instances[s.Instance] = true
+		}
+		log.Printf("Found %v temperature sensors on the GX device.", len(instances))
+		for _, instance := range sortedInstances(instances) {
+			key := fmt.Sprintf("mqtt temperature %v", instance)
+			id, ok := itemIDs[key]
+			if !ok {
+				id = maxID
+				maxID++
+			}
+			accessories = c.registerMQTTTemperature(id, instance, accessories)
+			itemIDs[key] = id
+		}
+	}
+	if c.config.MQTTSensors.Relays {
+		relays := c.rememberedInstances(itemIDs, "mqtt relay ")
+		for _, r := range c.mqttClient.GetIOClient().GetRelays() {
+			relays[r.Number] = true
+		}
+		log.Printf("Found %v relays on the GX device.", len(relays))
+		for _, number := range sortedInstances(relays) {
+			key := fmt.Sprintf("mqtt relay %v", number)
+			id, ok := itemIDs[key]
+			if !ok {
+				id = maxID
+				maxID++
+			}
+			accessories = c.registerGXRelay(id, number, accessories)
+			itemIDs[key] = id
+		}
+	}
+	if c.config.MQTTSensors.DigitalInputs {
+		inputs := c.rememberedInstances(itemIDs, "mqtt input ")
+		for _, input := range c.mqttClient.GetIOClient().GetInputs() {
+			if _, ok := input.Kind(); ok {
+				inputs[input.Instance] = true
+			}
+		}
+		log.Printf("Found %v digital inputs on the GX device.", len(inputs))
+		for _, instance := range sortedInstances(inputs) {
+			key := fmt.Sprintf("mqtt input %v", instance)
+			id, ok := itemIDs[key]
+			if !ok {
+				id = maxID
+				maxID++
+			}
+			var added bool
+			accessories, added = c.registerGXInput(id, instance, accessories)
+			if added {
+				itemIDs[key] = id
+			}
+		}
+	}
+	return itemIDs, accessories, maxID
+}
+
+// rememberedInstances returns the instances registered on an earlier run so
+// their accessories keep their IDs even if the sensor is slow to show up.
+func (c *client) rememberedInstances(itemIDs map[string]uint64, prefix string) map[int]bool {
+	instances := make(map[int]bool)
+	for key := range itemIDs {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if instance, err := strconv.Atoi(strings.TrimPrefix(key, prefix)); err == nil {
+			instances[instance] = true
+		}
+	}
+	return instances
+}
+
+func sortedInstances(instances map[int]bool) []int {
+	result := make([]int, 0, len(instances))
+	for instance := range instances {
+		result = append(result, instance)
+	}
+	sort.Ints(result)
+	return result
+}
+
+func (c *client) registerMQTTTank(id uint64, instance int, accessories []*accessory.Accessory) []*accessory.Accessory {
+	tanks := c.mqttClient.GetTankClient()
+	name := tank.Tank{Instance: instance}.Name()
+	if t, ok := tanks.GetTank(instance); ok {
+		name = t.Name()
+	}
+	ac := accessory.NewHumiditySensor(accessory.Info{
+		Name: fmt.Sprintf("%s Level", name),
+		ID:   id,
+	})
+	level := float64(0)
+	syncFunc := func() {
+		t, ok := tanks.GetTank(instance)
+		if !ok || !t.HasLevel {
+			if c.config.Debug {
+				log.Printf("No level has been read for tank %v yet.", instance)
+			}
+			return
+		}
+		lastLevel := level
+		level = t.Level
+		c.tankLevels.set(name, level)
+		if lastLevel != level {
+			ac.HumiditySensor.CurrentRelativeHumidity.SetValue(level)
+			log.Printf("got new tank level of %v for %s", level, name)
+		}
+		if metrics.StatsEnabled {
+			metrics.SendGaugeMetricWithRate("tank.level", level, []string{fmt.Sprintf("name:%s", name), fmt.Sprintf("type:%s", t.FluidType)}, 1)
+			tankLevel.WithLabelValues(name, t.FluidType).Set(level)
+		}
+	}
+	syncFunc()
+	c.syncFuncs = append(c.syncFuncs, syncFunc)
+	ac.HumiditySensor.CurrentRelativeHumidity.SetMinValue(0)
+	ac.HumiditySensor.CurrentRelativeHumidity.SetMaxValue(100)
+	return append(accessories, ac.Accessory)
+}
+
+func (c *client) registerMQTTTemperature(id uint64, instance int, accessories []*accessory.Accessory) []*accessory.Accessory {
+	sensors := c.mqttClient.GetTemperatureClient()
+	name := temperature.Sensor{Instance: instance}.Name()
+	if s, ok := sensors.GetSensor(instance); ok {
+		name = s.Name()
+	}
+	ac := accessory.NewTemperatureSensor(accessory.Info{
+		Name: name,
+		ID:   id,
+	}, 0, -40, 100, 1)
+	temp := float64(0)
+	syncFunc := func() {
+		s, ok := sensors.GetSensor(instance)
+		if !ok || !s.HasTemp {
+			if c.config.Debug {
+				log.Printf("No temperature has been read for sensor %v yet.", instance)
+			}
+			return
+		}
+		lastTemp := temp
+		if temp = s.Temperature; lastTemp != temp {
+			ac.TempSensor.CurrentTemperature.SetValue(temp)
+		}
+		if metrics.StatsEnabled {
+			fahrenheit := temp*9/5 + 32
+			metrics.SendGaugeMetricWithRate("temperature.celsius", temp, []string{fmt.Sprintf("name:%s", name)}, 1)
+			sensorTemperature.WithLabelValues(name, "celsius").Set(temp)
+			metrics.SendGaugeMetricWithRate("temperature.fahrenheit", fahrenheit, []string{fmt.Sprintf("name:%s", name)}, 1)
+			sensorTemperature.WithLabelValues(name, "fahrenheit").Set(fahrenheit)
+			if s.HasHumidity {
+				metrics.SendGaugeMetricWithRate("temperature.humidity", s.Humidity, []string{fmt.Sprintf("name:%s", name)}, 1)
+				sensorHumidity.WithLabelValues(name).Set(s.Humidity)
+			}
+		}
+	}
+	syncFunc()
+	c.syncFuncs = append(c.syncFuncs, syncFunc)
+	return append(accessories, ac.Accessory)
+}
+
+// registerDriving adds an occupancy sensor that is occupied while the DC-DC or
+// alternator charger shows the RV is on the road, for use in HomeKit
+// automations.
+func (c *client) registerDriving(id uint64, accessories []*accessory.Accessory) []*accessory.Accessory {
+	ac := accessory.New(accessory.Info{
+		Name: "Driving",
+		ID:   id,
+	}, accessory.TypeSensor)
+	sensor := service.NewOccupancySensor()
+	ac.AddService(sensor.Service)
+	chargers := c.mqttClient.GetDCDCClient()
+	lastState := false
+	syncFunc := func() {
+		driving := chargers.IsDriving()
+		if driving != lastState {
+			if driving {
+				log.Printf("Alternator charging detected, now driving.")
+				sensor.OccupancyDetected.SetValue(characteristic.OccupancyDetectedOccupancyDetected)
+			} else {
+				log.Printf("Alternator charging stopped, no longer driving.")
+				sensor.OccupancyDetected.SetValue(characteristic.OccupancyDetectedOccupancyNotDetected)
+			}
+			lastState = driving
+		}
+		if metrics.StatsEnabled {
+			value := float64(0)
+			if driving {
+				value = 1
+			}
+			metrics.SendGaugeMetricWithRate("driving.active", value, []string{}, 1)
+			drivingActive.Set(value)
+			for _, charger := range chargers.GetChargers() {
+				name := charger.Name()
+				tags := []string{fmt.Sprintf("name:%s", name), fmt.Sprintf("service:%s", charger.Service)}
+				metrics.SendGaugeMetricWithRate("dcdc.voltage", charger.Voltage, tags, 1)
+				dcdcMeasurement.WithLabelValues(name, charger.Service, "voltage").Set(charger.Voltage)
+				metrics.SendGaugeMetricWithRate("dcdc.current", charger.Current, tags, 1)
+				dcdcMeasurement.WithLabelValues(name, charger.Service, "current").Set(charger.Current)
+				metrics.SendGaugeMetricWithRate("dcdc.power", charger.Power, tags, 1)
+				dcdcMeasurement.WithLabelValues(name, charger.Service, "power").Set(charger.Power)
+			}
+		}
+	}
+	syncFunc()
+	c.syncFuncs = append(c.syncFuncs, syncFunc)
+	return append(accessories, ac)
+}
+
+// powerSignals are the system overview signals shown as power sensors.
+var powerSignals = []struct {
+	name   string
+	signal string
+}{
+	{name: "House Load", signal: system.HouseLoad},
+	{name: "Solar Power", signal: system.SolarPower},
+	{name: "Genset Power", signal: system.GensetPower},
+}
+
+// registerPowerSensor adds a light sensor reading a system signal in watts as
+// lux, as HomeKit has no power sensor.
+func (c *client) registerPowerSensor(id uint64, name string, signal string, accessories []*accessory.Accessory) []*accessory.Accessory {
+	ac := accessory.New(accessory.Info{
+		Name: name,
+		ID:   id,
+	}, accessory.TypeSensor)
+	sensor := service.NewLightSensor()
+	sensor.CurrentAmbientLightLevel.SetMaxValue(100000)
+	ac.AddService(sensor.Service)
+	systemClient := c.mqttClient.GetSystemClient()
+	lastValue := float64(-1)
+	syncFunc := func() {
+		watts, ok := systemClient.GetSignal(signal)
+		if !ok {
+			return
+		}
+		// The light level has a floor of 0.0001 lux.
+		value := math.Max(math.Round(watts), 0.0001)
+		if value != lastValue {
+			sensor.CurrentAmbientLightLevel.SetValue(value)
+			lastValue = value
+		}
+	}
+	syncFunc()
+	c.syncFuncs = append(c.syncFuncs, syncFunc)
+	return append(accessories, ac)
+}
+
+// registerGXRelay adds a switch for one of the GX relays. Only relays set to
+// manual on the GX can be switched, the others just show their state.
+func (c *client) registerGXRelay(id uint64, number int, accessories []*accessory.Accessory) []*accessory.Accessory {
+	io := c.mqttClient.GetIOClient()
+	ac := accessory.NewSwitch(accessory.Info{
+		Name: gxio.Relay{Number: number}.Name(),
+		ID:   id,
+	})
+	ac.Switch.On.OnValueRemoteUpdate(func(on bool) {
+		relay, _ := io.GetRelay(number)
+		if !relay.Manual() {
+			log.Printf("%s is not set to manual on the GX, ignoring change from HomeKit.", gxio.Relay{Number: number}.Name())
+			ac.Switch.On.SetValue(relay.On)
+			return
+		}
+		c.mqttClient.SetRelay(number, on)
+	})
+	syncFunc := func() {
+		if relay, ok := io.GetRelay(number); ok {
+			ac.Switch.On.SetValue(relay.On)
+		}
+	}
+	syncFunc()
+	c.syncFuncs = append(c.syncFuncs, syncFunc)
+	accessories = append(accessories, ac.Accessory)
+	return accessories
+}
+
+// registerGXInput adds a contact, leak or smoke sensor for a GX digital input
+// depending on the type it is configured as. Inputs with no known type, such as
+// one only remembered from an earlier run, are shown as contact sensors.
+func (c *client) registerGXInput(id uint64, instance int, accessories []*accessory.Accessory) ([]*accessory.Accessory, bool) {
+	io := c.mqttClient.GetIOClient()
+	input, found := io.GetInput(instance)
+	if !found {
+		input = gxio.Input{Instance: instance}
+	}
+	kind, ok := input.Kind()
+	if !ok {
+		if found {
+			log.Printf("Digital input %s is a type that is not shown in HomeKit, skipping.", input.Name())
+			return accessories, false
+		}
+		kind = gxio.KindContact
+	}
+	ac := accessory.New(accessory.Info{
+		Name: input.Name(),
+		ID:   id,
+	}, accessory.TypeSensor)
+	var setActive func(active bool)
+	switch kind {
+	case gxio.KindLeak:
+		sensor := service.NewLeakSensor()
+		ac.AddService(sensor.Service)
+		setActive = func(active bool) {
+			if active {
+				sensor.LeakDetected.SetValue(characteristic.LeakDetectedLeakDetected)
+			} else {
+				sensor.LeakDetected.SetValue(characteristic.LeakDetectedLeakNotDetected)
+			}
+		}
+	case gxio.KindSmoke:
+		sensor := service.NewSmokeSensor()
+		ac.AddService(sensor.Service)
+		setActive = func(active bool) {
+			if active {
+				sensor.SmokeDetected.SetValue(characteristic.SmokeDetectedSmokeDetected)
+			} else {
+				sensor.SmokeDetected.SetValue(characteristic.SmokeDetectedSmokeNotDetected)
+			}
+		}
+	default:
+		sensor := service.NewContactSensor()
+		ac.AddService(sensor.Service)
+		setActive = func(active bool) {
+			if active {
+				sensor.ContactSensorState.SetValue(characteristic.ContactSensorStateContactNotDetected)
+			} else {
+				sensor.ContactSensorState.SetValue(characteristic.ContactSensorStateContactDetected)
+			}
+		}
+	}
+	lastState := false
+	syncFunc := func() {
+		input, ok := io.GetInput(instance)
+		if !ok {
+			return
+		}
+		active := input.Active()
+		if active != lastState {
+			log.Printf("Digital input %s changed to active %v.", input.Name(), active)
+			setActive(active)
+			lastState = active
+		}
+	}
+	syncFunc()
+	c.syncFuncs = append(c.syncFuncs, syncFunc)
+	return append(accessories, ac), true
+}
+
+// registerGXAlarms adds a sensor that opens while any device on the GX has an
+// alarm and reports a fault for alarms, but not warnings.
+func (c *client) registerGXAlarms(id uint64, accessories []*accessory.Accessory) []*accessory.Accessory {
+	ac := accessory.New(accessory.Info{
+		Name: "GX Alarms",
+		ID:   id,
+	}, accessory.TypeSensor)
+	sensor := service.NewContactSensor()
+	fault := characteristic.NewStatusFault()
+	sensor.AddCharacteristic(fault.Characteristic)
+	ac.AddService(sensor.Service)
+	alarmClient := c.mqttClient.GetAlarmClient()
+	var mux sync.Mutex
+	lastSeverity := alarms.SeverityOK
+	syncFunc := func() {
+		mux.Lock()
+		defer mux.Unlock()
+		severity := alarmClient.Highest()
+		if severity != lastSeverity {
+			if severity == alarms.SeverityOK {
+				sensor.ContactSensorState.SetValue(characteristic.ContactSensorStateContactDetected)
+			} else {
+				sensor.ContactSensorState.SetValue(characteristic.ContactSensorStateContactNotDetected)
+			}
+			if severity == alarms.SeverityAlarm {
+				fault.SetValue(characteristic.StatusFaultGeneralFault)
+			} else {
+				fault.SetValue(characteristic.StatusFaultNoFault)
+			}
+			lastSeverity = severity
+		}
+		if metrics.StatsEnabled {
+			metrics.SendGaugeMetricWithRate("gx.alarms", float64(severity), []string{}, 1)
+		}
+	}
+	syncFunc()
+	c.syncFuncs = append(c.syncFuncs, syncFunc)
+	// Update as soon as an alarm changes rather than waiting for the next sync.
+	alarmClient.Subscribe(func(alarms.Event) {
+		syncFunc()
+	})
+	return append(accessories, ac)
+}
@@ -176,6 +176,112 @@ var (
 			"name",
 		},
 	)
+	generatorStartFailed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "generatorStartFailed",
+			Help: "Set to 1 when the generator automation gave up after failed start attempts.",
+		},
+		[]string{},
+	)
+	batteryChargeProtection = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "batteryChargeProtection",
+			Help: "Set to 1 while charging is limited because the battery is too cold.",
+		},
+		[]string{},
+	)
+	batteryStateOfHealth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "batteryStateOfHealth",
+			Help: "Estimated usable capacity as a percentage of the rated capacity.",
+		},
+		[]string{
+			"name",
+		},
+	)
+	batteryEstimatedCapacity = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "batteryEstimatedCapacity",
+			Help: "Estimated usable capacity in amp hours.",
+		},
+		[]string{
+			"name",
+		},
+	)
+	batteryChargeCycles = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "batteryChargeCycles",
+			Help: "Number of charge cycles, counted or as reported by the battery monitor.",
+		},
+		[]string{
+			"name",
+			"type",
+		},
+	)
+	tankRuleActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tankRuleActive",
+			Help: "Set to 1 while a tank level rule is active.",
+		},
+		[]string{
+			"name",
+		},
+	)
+	batteryForecast = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "batteryForecast",
+			Help: "Forecast net power in watts and time to empty or full in seconds.",
+		},
+		[]string{
+			"name",
+			"type",
+		},
+	)
+	batteryForecastWhatIf = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "batteryForecastWhatIf",
+			Help: "Forecast time to empty in seconds with the named load turned on.",
+		},
+		[]string{
+			"name",
+			"load",
+		},
+	)
+	batteryAmpHoursDrawn = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "batteryAmpHoursDrawn",
+			Help: "Cumulative amp hours drawn from the battery.",
+		},
+		[]string{
+			"name",
+		},
+	)
+	batteryDepthOfDischarge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "batteryDepthOfDischarge",
+			Help: "Depth of discharge as a percentage, deepest and average.",
+		},
+		[]string{
+			"name",
+			"type",
+		},
+	)
+	generatorRunHours = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "generatorRunHours",
+			Help: "Cumulative generator run hours recorded by the generator automation.",
+		},
+		[]string{},
+	)
+	generatorServiceHoursRemaining = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "generatorServiceHoursRemaining",
+			Help: "Generator run hours remaining until the service interval is due.",
+		},
+		[]string{
+			"service",
+		},
+	)
 	hvacTemperature = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "hvacTemperature",
@@ -203,4 +309,40 @@ var (
 			"name",
 		},
 	)
+	sensorHumidity = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sensorHumidity",
+			Help: "Relative humidity reported by a GX temperature sensor.",
+		},
+		[]string{
+			"name",
+		},
+	)
+	sensorTemperature = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sensorTemperature",
+			Help: "Temperature reported by a GX temperature sensor.",
+		},
+		[]string{
+			"name",
+			"unit",
+		},
+	)
+	drivingActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "drivingActive",
+			Help: "Whether the DC-DC or alternator charger shows the RV is driving.",
+		},
+	)
+	dcdcMeasurement = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dcdcMeasurement",
+			Help: "Output readings of the DC-DC and alternator chargers.",
+		},
+		[]string{
+			"name",
+			"service",
+			"measurementType",
+		},
+	)
 )
@@ -0,0 +1,132 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five field cron expression. Each field is a bit set
+// of the values it matches.
+type cronSchedule struct {
+	minute  uint64
+	hour    uint64
+	day     uint64
+	month   uint64
+	weekday uint64
+	anyDay  bool
+	anyWeek bool
+}
+
+type cronField struct {
+	min int
+	max int
+}
+
+var cronFields = []cronField{
+	{min: 0, max: 59},
+	{min: 0, max: 23},
+	{min: 1, max: 31},
+	{min: 1, max: 12},
+	{min: 0, max: 7},
+}
+
+// parseCron parses "minute hour day month weekday". Fields accept *, single
+// values, ranges (1-5), lists (1,3,5) and steps (*/15 or 8-18/2). Weekday 0 and
+// 7 are both Sunday.
+func parseCron(expression string) (*cronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("expected %v fields in cron expression %q, got %v", len(cronFields), expression, len(fields))
+	}
+	sets := make([]uint64, len(fields))
+	stars := make([]bool, len(fields))
+	for i, field := range fields {
+		set, star, err := parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", expression, err)
+		}
+		sets[i], stars[i] = set, star
+	}
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	allDays, allWeekdays := cronRange(1, 31), cronRange(0, 6)
+	return &cronSchedule{
+		minute:  sets[0],
+		hour:    sets[1],
+		day:     sets[2],
+		month:   sets[3],
+		weekday: sets[4],
+		anyDay:  stars[2] || sets[2]&allDays == allDays,
+		anyWeek: stars[4] || sets[4]&allWeekdays == allWeekdays,
+	}, nil
+}
+
+// cronRange returns the bit set of every value from start to end.
+func cronRange(start, end int) uint64 {
+	var set uint64
+	for value := start; value <= end; value++ {
+		set |= 1 << uint(value)
+	}
+	return set
+}
+
+// parseCronField returns the bit set of values the field matches and whether it
+// is built from * only, such as * or */2, which cron treats as unrestricted.
+func parseCronField(field string, bounds cronField) (uint64, bool, error) {
+	var set uint64
+	star := true
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if index := strings.Index(part, "/"); index >= 0 {
+			value, err := strconv.Atoi(part[index+1:])
+			if err != nil || value <= 0 {
+				return 0, false, fmt.Errorf("invalid step in %q", part)
+			}
+			step = value
+			part = part[:index]
+		}
+		start, end := bounds.min, bounds.max
+		if part != "*" {
+			star = false
+			rangeParts := strings.SplitN(part, "-", 2)
+			value, err := strconv.Atoi(rangeParts[0])
+			if err != nil {
+				return 0, false, fmt.Errorf("invalid value %q", part)
+			}
+			start, end = value, value
+			if len(rangeParts) == 2 {
+				end, err = strconv.Atoi(rangeParts[1])
+				if err != nil {
+					return 0, false, fmt.Errorf("invalid range %q", part)
+				}
+			} else if step > 1 {
+				end = bounds.max
+			}
+		}
+		if start < bounds.min || end > bounds.max || start > end {
+			return 0, false, fmt.Errorf("%q is outside %v-%v", part, bounds.min, bounds.max)
+		}
+		for value := start; value <= end; value += step {
+			set |= 1 << uint(value)
+		}
+	}
+	return set, star, nil
+}
+
+// matches reports whether the schedule fires in the minute of t. As in cron,
+// when both day of month and weekday are restricted either one matching is
+// enough.
+func (s *cronSchedule) matches(t time.Time) bool {
+	if s.minute&(1<<uint(t.Minute())) == 0 || s.hour&(1<<uint(t.Hour())) == 0 || s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	day := s.day&(1<<uint(t.Day())) != 0
+	weekday := s.weekday&(1<<uint(t.Weekday())) != 0
+	if s.anyDay || s.anyWeek {
+		return day && weekday
+	}
+	return day || weekday
+}
@@ -0,0 +1,196 @@
+package scheduler
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+	"github.com/jgulick48/rv-homekit/internal/storage"
+)
+
+// TargetFunc returns the function that sets a schedule target to a value, or
+// false if the target is not available.
+type TargetFunc func(target models.ScheduleTarget) (func(value string), bool)
+
+// PositionFunc returns the current latitude and longitude, or false without a
+// fix.
+type PositionFunc func() (float64, float64, bool)
+
+type State struct {
+	Disabled map[string]bool `json:"disabled"`
+}
+
+func (s *State) LoadFromFile(filename string) {
+	if filename == "" {
+		filename = storage.Path("schedules.json")
+	}
+	err := storage.ReadJSON(filename, &s)
+	if os.IsNotExist(err) {
+		log.Printf("No schedule state found. Starting new.")
+	} else if err != nil {
+		log.Printf("Invalid schedule state file provided")
+	}
+	if s.Disabled == nil {
+		s.Disabled = make(map[string]bool)
+	}
+}
+
+func (s *State) SaveToFile(filename string) {
+	if filename == "" {
+		filename = storage.Path("schedules.json")
+	}
+	if err := storage.WriteJSON(filename, s); err != nil {
+		log.Printf("Error saving %s: %s", filename, err)
+	}
+}
+
+type entry struct {
+	config  models.ScheduleEntry
+	cron    *cronSchedule
+	lastRun time.Time
+}
+
+type Scheduler struct {
+	config       models.Scheduler
+	entries      []*entry
+	targetFunc   TargetFunc
+	positionFunc PositionFunc
+	state        State
+	stateFile    string
+	mutex        sync.Mutex
+}
+
+func NewScheduler(config models.Scheduler, targetFunc TargetFunc, positionFunc PositionFunc) *Scheduler {
+	var state State
+	state.LoadFromFile("")
+	s := &Scheduler{
+		config:       config,
+		targetFunc:   targetFunc,
+		positionFunc: positionFunc,
+		state:        state,
+	}
+	for _, config := range config.Entries {
+		item := &entry{config: config}
+		switch {
+		case config.Cron != "":
+			cron, err := parseCron(config.Cron)
+			if err != nil {
+				log.Printf("Skipping schedule %s: %s", config.Name, err)
+				continue
+			}
+			item.cron = cron
+		case config.Sun == Sunrise || config.Sun == Sunset:
+		default:
+			log.Printf("Skipping schedule %s: it needs a cron expression or a sun event of %s or %s", config.Name, Sunrise, Sunset)
+			continue
+		}
+		s.entries = append(s.entries, item)
+	}
+	return s
+}
+
+// Start runs the schedules at the start of every minute.
+func (s *Scheduler) Start() {
+	go func() {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		s.run(time.Now())
+		ticker := time.NewTicker(time.Minute)
+		for range ticker.C {
+			s.run(time.Now())
+		}
+	}()
+}
+
+func (s *Scheduler) run(now time.Time) {
+	minute := now.Truncate(time.Minute)
+	s.mutex.Lock()
+	due := make([]models.ScheduleEntry, 0)
+	for _, item := range s.entries {
+		if s.state.Disabled[item.config.Name] || item.lastRun.Equal(minute) {
+			continue
+		}
+		if s.isDue(item, minute) {
+			item.lastRun = minute
+			due = append(due, item.config)
+		}
+	}
+	s.mutex.Unlock()
+	for _, config := range due {
+		set, ok := s.targetFunc(config.Target)
+		if !ok {
+			log.Printf("Schedule %s has an unknown target %s %s, skipping.", config.Name, config.Target.Type, config.Target.Item)
+			continue
+		}
+		log.Printf("Running schedule %s, setting %s %s to %s.", config.Name, config.Target.Type, config.Target.Item, config.Value)
+		go set(config.Value)
+	}
+}
+
+// isDue reports whether the entry fires in the given minute. Callers must hold
+// the mutex.
+func (s *Scheduler) isDue(item *entry, minute time.Time) bool {
+	if item.cron != nil {
+		return item.cron.matches(minute)
+	}
+	at, ok := s.sunEvent(item.config, minute)
+	return ok && at.Truncate(time.Minute).Equal(minute)
+}
+
+// sunEvent returns when the entry's sun event happens on the day of the given
+// time, including its offset.
+func (s *Scheduler) sunEvent(config models.ScheduleEntry, day time.Time) (time.Time, bool) {
+	latitude, longitude, ok := s.position()
+	if !ok {
+		return time.Time{}, false
+	}
+	// Look up the event for the day before the offset is applied, so an entry
+	// such as an hour before sunrise still runs on the right day.
+	sunrise, sunset, ok := sunTimes(day.Add(-config.Offset.Duration), latitude, longitude)
+	if !ok {
+		return time.Time{}, false
+	}
+	if config.Sun == Sunrise {
+		return sunrise.Add(config.Offset.Duration), true
+	}
+	return sunset.Add(config.Offset.Duration), true
+}
+
+func (s *Scheduler) position() (float64, float64, bool) {
+	if s.config.Latitude != 0 || s.config.Longitude != 0 {
+		return s.config.Latitude, s.config.Longitude, true
+	}
+	if s.positionFunc != nil {
+		return s.positionFunc()
+	}
+	return 0, 0, false
+}
+
+// Names returns the names of the valid schedule entries in config order.
+func (s *Scheduler) Names() []string {
+	names := make([]string, 0, len(s.entries))
+	for _, item := range s.entries {
+		names = append(names, item.config.Name)
+	}
+	return names
+}
+
+func (s *Scheduler) IsEnabled(name string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.state.Disabled[name]
+}
+
+func (s *Scheduler) SetEnabled(name string, enabled bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if enabled {
+		delete(s.state.Disabled, name)
+	} else {
+		s.state.Disabled[name] = true
+	}
+	log.Printf("Schedule %s enabled set to %v.", name, enabled)
+	s.state.SaveToFile(s.stateFile)
+}
@@ -0,0 +1,100 @@
+package scheduler
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/jgulick48/rv-homekit/internal/models"
+)
+
+type SchedulerTest struct {
+	suite.Suite
+	denver *time.Location
+}
+
+func (s *SchedulerTest) SetupTest() {
+	var err error
+	s.denver, err = time.LoadLocation("America/Denver")
+	s.Require().NoError(err)
+}
+
+func (s *SchedulerTest) Test_CronMatches() {
+	schedule, err := parseCron("*/15 8-18 * * 1-5")
+	s.Require().NoError(err)
+	s.Assert().True(schedule.matches(time.Date(2024, 6, 3, 8, 45, 0, 0, time.UTC)))
+	s.Assert().False(schedule.matches(time.Date(2024, 6, 3, 8, 50, 0, 0, time.UTC)))
+	s.Assert().False(schedule.matches(time.Date(2024, 6, 2, 8, 45, 0, 0, time.UTC)))
+
+	schedule, err = parseCron("0 22 1 * 7")
+	s.Require().NoError(err)
+	s.Assert().True(schedule.matches(time.Date(2024, 6, 2, 22, 0, 0, 0, time.UTC)))
+	s.Assert().True(schedule.matches(time.Date(2024, 7, 1, 22, 0, 0, 0, time.UTC)))
+	s.Assert().False(schedule.matches(time.Date(2024, 7, 2, 22, 0, 0, 0, time.UTC)))
+
+	// A day of month of */2 or 1-31 is not a restriction, so only the weekday
+	// has to match.
+	for _, expression := range []string{"0 7 */2 * 1", "0 7 1-31 * 1"} {
+		schedule, err = parseCron(expression)
+		s.Require().NoError(err)
+		s.Assert().True(schedule.matches(time.Date(2024, 6, 3, 7, 0, 0, 0, time.UTC)), expression)
+		s.Assert().False(schedule.matches(time.Date(2024, 6, 5, 7, 0, 0, 0, time.UTC)), expression)
+	}
+
+	for _, invalid := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		_, err = parseCron(invalid)
+		s.Assert().Error(err, invalid)
+	}
+}
+
+func (s *SchedulerTest) Test_SunTimes() {
+	sunrise, sunset, ok := sunTimes(time.Date(2024, 6, 21, 0, 0, 0, 0, s.denver), 39.74, -104.99)
+	s.Require().True(ok)
+	s.Assert().WithinDuration(time.Date(2024, 6, 21, 5, 32, 0, 0, s.denver), sunrise, 3*time.Minute)
+	s.Assert().WithinDuration(time.Date(2024, 6, 21, 20, 31, 0, 0, s.denver), sunset, 3*time.Minute)
+
+	_, _, ok = sunTimes(time.Date(2024, 6, 21, 0, 0, 0, 0, time.UTC), 78.2, 15.6)
+	s.Assert().False(ok)
+}
+
+func (s *SchedulerTest) Test_RunsEntries() {
+	set := make(chan string, 10)
+	targetFunc := func(target models.ScheduleTarget) (func(string), bool) {
+		if target.Type != "openhab" {
+			return nil, false
+		}
+		return func(value string) {
+			set <- target.Item + "=" + value
+		}, true
+	}
+	scheduler := NewScheduler(models.Scheduler{
+		Enabled: true,
+		Entries: []models.ScheduleEntry{
+			{Name: "Porch On", Sun: Sunset, Offset: models.Duration{Duration: -30 * time.Minute}, Target: models.ScheduleTarget{Type: "openhab", Item: "Porch"}, Value: "ON"},
+			{Name: "Water Heater", Cron: "0 6 * * *", Target: models.ScheduleTarget{Type: "openhab", Item: "WaterHeater"}, Value: "ON"},
+			{Name: "Invalid", Cron: "bad"},
+		},
+	}, targetFunc, func() (float64, float64, bool) { return 39.74, -104.99, true })
+	scheduler.stateFile = filepath.Join(s.T().TempDir(), "schedules.json")
+	s.Assert().Equal([]string{"Porch On", "Water Heater"}, scheduler.Names())
+
+	_, sunset, _ := sunTimes(time.Date(2024, 6, 21, 0, 0, 0, 0, s.denver), 39.74, -104.99)
+	porch := sunset.Add(-30 * time.Minute).Truncate(time.Minute)
+	scheduler.run(porch)
+	scheduler.run(porch.Add(10 * time.Second))
+	s.Assert().Equal("Porch=ON", <-set)
+
+	scheduler.SetEnabled("Water Heater", false)
+	scheduler.run(time.Date(2024, 6, 21, 6, 0, 0, 0, s.denver))
+	scheduler.SetEnabled("Water Heater", true)
+	s.Assert().True(scheduler.IsEnabled("Water Heater"))
+	scheduler.run(time.Date(2024, 6, 22, 6, 0, 0, 0, s.denver))
+	s.Assert().Equal("WaterHeater=ON", <-set)
+	s.Assert().Len(set, 0)
+}
+
+func TestScheduler(t *testing.T) {
+	suite.Run(t, new(SchedulerTest))
+}
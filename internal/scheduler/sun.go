@@ -0,0 +1,49 @@
+package scheduler
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	Sunrise = "sunrise"
+	Sunset  = "sunset"
+
+	julianUnixEpoch = 2440587.5
+	julian2000      = 2451545.0
+)
+
+func toRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+func toDegrees(radians float64) float64 {
+	return radians * 180 / math.Pi
+}
+
+func fromJulian(julian float64) time.Time {
+	return time.Unix(0, int64((julian-julianUnixEpoch)*86400*float64(time.Second)))
+}
+
+// sunTimes returns sunrise and sunset on the calendar day of date, using the
+// sunrise equation. It returns false during polar day or night. Longitude is
+// positive east of Greenwich.
+func sunTimes(date time.Time, latitude, longitude float64) (time.Time, time.Time, bool) {
+	year, month, day := date.Date()
+	noon := time.Date(year, month, day, 12, 0, 0, 0, time.UTC)
+	days := math.Round(float64(noon.Unix())/86400 + julianUnixEpoch - julian2000)
+	meanSolarTime := days - longitude/360
+	anomaly := math.Mod(357.5291+0.98560028*meanSolarTime, 360)
+	center := 1.9148*math.Sin(toRadians(anomaly)) + 0.02*math.Sin(toRadians(2*anomaly)) + 0.0003*math.Sin(toRadians(3*anomaly))
+	eclipticLongitude := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := julian2000 + meanSolarTime + 0.0053*math.Sin(toRadians(anomaly)) - 0.0069*math.Sin(toRadians(2*eclipticLongitude))
+	declination := math.Asin(math.Sin(toRadians(eclipticLongitude)) * math.Sin(toRadians(23.4397)))
+	cosHourAngle := (math.Sin(toRadians(-0.833)) - math.Sin(toRadians(latitude))*math.Sin(declination)) / (math.Cos(toRadians(latitude)) * math.Cos(declination))
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	hourAngle := toDegrees(math.Acos(cosHourAngle))
+	sunrise := fromJulian(transit - hourAngle/360).In(date.Location())
+	sunset := fromJulian(transit + hourAngle/360).In(date.Location())
+	return sunrise, sunset, true
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const backupSuffix = ".bak"
+
+var (
+	dataDir = "."
+	mux     sync.RWMutex
+)
+
+// SetDataDir sets the directory persisted files are kept in, creating it if
+// needed. An empty dir keeps the current working directory.
+func SetDataDir(dir string) {
+	if dir == "" {
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("Error creating data directory %s: %s", dir, err)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	dataDir = dir
+}
+
+// DataDir returns the directory persisted files are kept in.
+func DataDir() string {
+	mux.RLock()
+	defer mux.RUnlock()
+	return dataDir
+}
+
+// Path returns the location of the named file in the data directory.
+func Path(name string) string {
+	return filepath.Join(DataDir(), name)
+}
+
+// Migrate copies the named files and directories from dir into the data
+// directory when they exist in dir but not yet in the data directory, so the
+// state saved before dataDir was set, such as the HomeKit pairing, is kept.
+func Migrate(dir string, names ...string) {
+	from, err := filepath.Abs(dir)
+	if err != nil {
+		log.Printf("Unable to resolve %s for migration: %s", dir, err)
+		return
+	}
+	to, err := filepath.Abs(DataDir())
+	if err != nil || from == to {
+		return
+	}
+	for _, name := range names {
+		source := filepath.Join(from, name)
+		target := filepath.Join(to, name)
+		if _, err := os.Stat(source); err != nil {
+			continue
+		}
+		if _, err := os.Stat(target); err == nil {
+			continue
+		}
+		if err := copyPath(source, target); err != nil {
+			log.Printf("Error migrating %s to %s: %s", source, target, err)
+			continue
+		}
+		log.Printf("Migrated %s to %s", source, target)
+	}
+}
+
+// copyPath copies a file, or a directory and everything in it.
+func copyPath(source, target string) error {
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		destination := filepath.Join(target, relative)
+		if info.IsDir() {
+			return os.MkdirAll(destination, info.Mode().Perm())
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(destination, data, info.Mode().Perm())
+	})
+}
+
+// WriteFile replaces filename with data without ever leaving a partially
+// written file behind. The data is written and synced to a temporary file in
+// the same directory, the current file is kept as filename.bak and the
+// temporary file is renamed into place.
+func WriteFile(filename string, data []byte) error {
+	dir := filepath.Dir(filename)
+	temp, err := ioutil.TempFile(dir, "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err = temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err = temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(temp.Name(), 0644); err != nil {
+		return err
+	}
+	if _, err = os.Stat(filename); err == nil {
+		if err = os.Rename(filename, filename+backupSuffix); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(temp.Name(), filename); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir flushes the directory entry so the renames survive a power cut.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	d.Sync()
+}
+
+// WriteJSON saves v to filename as indented JSON using WriteFile.
+func WriteJSON(filename string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFile(filename, data)
+}
+
+// ReadJSON loads filename into v. If the file is missing or is not valid JSON
+// the backup from the last write is used instead. The error from the primary
+// file is returned when neither can be read, so os.IsNotExist reports whether
+// there was nothing saved yet.
+func ReadJSON(filename string, v interface{}) error {
+	err := readJSON(filename, v)
+	if err == nil {
+		return nil
+	}
+	backupErr := readJSON(filename+backupSuffix, v)
+	if backupErr == nil {
+		log.Printf("Unable to read %s: %s. Loaded backup %s instead.", filename, err, filename+backupSuffix)
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		log.Printf("Unable to read %s or its backup: %s", filename, backupErr)
+	}
+	return err
+}
+
+func readJSON(filename string, v interface{}) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if !json.Valid(data) {
+		return fmt.Errorf("%s is not valid JSON", filename)
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type StorageTest struct {
+	suite.Suite
+	filename string
+}
+
+type testState struct {
+	Value int `json:"value"`
+}
+
+func (s *StorageTest) SetupTest() {
+	s.filename = filepath.Join(s.T().TempDir(), "state.json")
+}
+
+func (s *StorageTest) Test_WriteJSONKeepsBackup() {
+	s.Require().NoError(WriteJSON(s.filename, testState{Value: 1}))
+	s.Require().NoError(WriteJSON(s.filename, testState{Value: 2}))
+	var state testState
+	s.Require().NoError(ReadJSON(s.filename, &state))
+	s.Assert().Equal(2, state.Value)
+	var backup testState
+	s.Require().NoError(ReadJSON(s.filename+backupSuffix, &backup))
+	s.Assert().Equal(1, backup.Value)
+	files, err := ioutil.ReadDir(filepath.Dir(s.filename))
+	s.Require().NoError(err)
+	s.Assert().Len(files, 2)
+}
+
+func (s *StorageTest) Test_ReadJSONFallsBackToBackup() {
+	s.Require().NoError(WriteJSON(s.filename, testState{Value: 1}))
+	s.Require().NoError(WriteJSON(s.filename, testState{Value: 2}))
+	s.Require().NoError(ioutil.WriteFile(s.filename, []byte(`{"val`), 0644))
+	var state testState
+	s.Require().NoError(ReadJSON(s.filename, &state))
+	s.Assert().Equal(1, state.Value)
+}
+
+func (s *StorageTest) Test_ReadJSONMissing() {
+	var state testState
+	err := ReadJSON(s.filename, &state)
+	s.Assert().True(os.IsNotExist(err))
+}
+
+func (s *StorageTest) Test_MigrateCopiesMissingFiles() {
+	oldDir := s.T().TempDir()
+	newDir := filepath.Join(s.T().TempDir(), "data")
+	previous := DataDir()
+	defer func() { dataDir = previous }()
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(oldDir, "items.json"), []byte(`{"a":1}`), 0644))
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(oldDir, "state.json"), []byte(`{"old":true}`), 0644))
+	s.Require().NoError(os.MkdirAll(filepath.Join(oldDir, "Bridge"), 0755))
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(oldDir, "Bridge", "uuid"), []byte("pairing"), 0644))
+	SetDataDir(newDir)
+	s.Require().NoError(ioutil.WriteFile(Path("state.json"), []byte(`{"new":true}`), 0644))
+	Migrate(oldDir, "items.json", "state.json", "missing.json", "Bridge")
+	data, err := ioutil.ReadFile(Path("items.json"))
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"a":1}`, string(data))
+	data, err = ioutil.ReadFile(Path("state.json"))
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"new":true}`, string(data))
+	data, err = ioutil.ReadFile(filepath.Join(newDir, "Bridge", "uuid"))
+	s.Require().NoError(err)
+	s.Assert().Equal("pairing", string(data))
+	_, err = os.Stat(Path("missing.json"))
+	s.Assert().True(os.IsNotExist(err))
+}
+
+func TestStorageSuite(t *testing.T) {
+	suite.Run(t, new(StorageTest))
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/jgulick48/rv-homekit/internal/openevse"
 	"github.com/jgulick48/rv-homekit/internal/tanksensors"
 	"log"
@@ -10,6 +11,7 @@ import (
 	_ "net/http/pprof"
 	"net/url"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
@@ -18,16 +20,54 @@ import (
 	"github.com/mitchellh/panicwrap"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/jgulick48/rv-homekit/internal/automation"
 	"github.com/jgulick48/rv-homekit/internal/bmv"
 	"github.com/jgulick48/rv-homekit/internal/metrics"
 	"github.com/jgulick48/rv-homekit/internal/mqtt"
 	"github.com/jgulick48/rv-homekit/internal/openHab"
 	"github.com/jgulick48/rv-homekit/internal/rvhomekit"
+	"github.com/jgulick48/rv-homekit/internal/storage"
 )
 
 var configLocation = flag.String("configFile", "./config.json", "Location for the configuration file.")
+var trainSolarModel = flag.Bool("trainSolarModel", false, "Train the solar deferral model from the recorded solar history and exit.")
+var replayTelemetry = flag.String("replay", "", "Replay recorded battery telemetry (CSV of time,soc,voltage,current) through the generator automation in dry run, print its decisions and exit.")
+
+// persistedFiles are the files saved in the data directory. They are copied
+// from the working directory the first time dataDir is set, along with the
+// HomeKit pairing directory named after the bridge.
+var persistedFiles = []string{
+	"items.json",
+	"state.json",
+	"generatorHistory.json",
+	"solarHistory.json",
+	"solarModel.json",
+	"chargeProtection.json",
+	"batteryHealth.json",
+	"schedules.json",
+	"hpItems.json",
+	"pedestalProbe.json",
+}
+
+func useDataDir(dataDir string, bridgeName string) {
+	storage.SetDataDir(dataDir)
+	if dataDir != "" {
+		storage.Migrate(".", append(persistedFiles, bridgeName)...)
+	}
+}
 
 func main() {
+	flag.Parse()
+	if *trainSolarModel {
+		config := rvhomekit.LoadClientConfig(*configLocation)
+		useDataDir(config.DataDir, config.BridgeName)
+		automation.TrainSolarModelFromFile()
+		return
+	}
+	if *replayTelemetry != "" {
+		replay(*replayTelemetry)
+		return
+	}
 
 	startService()
 	exitStatus, err := panicwrap.BasicWrap(panicHandler)
@@ -44,6 +84,25 @@ func main() {
 	}
 }
 
+func replay(filename string) {
+	config := rvhomekit.LoadClientConfig(*configLocation)
+	parameters, ok := config.Automation["generator"]
+	if !ok {
+		log.Printf("No generator automation found in %s.", *configLocation)
+		os.Exit(1)
+	}
+	samples, err := automation.LoadTelemetry(filename)
+	if err != nil {
+		log.Printf("Error loading telemetry from %s: %s", filename, err)
+		os.Exit(1)
+	}
+	decisions := automation.Replay(parameters, samples)
+	for _, decision := range decisions {
+		fmt.Printf("%s %-5s soc=%v%% %s\n", decision.Time.Format(time.RFC3339), decision.Action, decision.SOC, decision.Reason)
+	}
+	fmt.Printf("%v decisions from %v samples.\n", len(decisions), len(samples))
+}
+
 func panicHandler(output string) {
 	// output contains the full output (including stack traces) of the
 	// panic. Put it in a file or something.
@@ -58,6 +117,7 @@ func startService() {
 	}
 	log.Print(path)
 	config := rvhomekit.LoadClientConfig(*configLocation)
+	useDataDir(config.DataDir, config.BridgeName)
 	if config.StatsServer != "" {
 		metrics.Metrics, err = statsd.New(config.StatsServer)
 		if err != nil {
@@ -82,7 +142,10 @@ func startService() {
 	if config.TankSensors.Enabled {
 		tankSensors = tanksensors.NewTankSensorClient(config.TankSensors.APIAddress)
 	}
-	mqttClient := mqtt.NewClient(config.MQTTConfiguration, config.DVCCConfiguration, config.InputLimitConfiguration, config.ShoreDetection, config.Debug)
+	mqttClient := mqtt.NewClient(config.MQTTConfiguration, config.DVCCConfiguration, config.InputLimitConfiguration, config.ShoreDetection, config.LoadShedding, config.Driving, config.Debug)
+	if mqttClient.IsEnabled() {
+		mqttClient.Connect()
+	}
 	openEVSEClient := openevse.NewClient(mqttClient.GetVEBusClient(), config.EVSEConfiguration, http.DefaultClient)
 	rvHomeKitClient := rvhomekit.NewClient(config, habClient, bmvClient, tankSensors, mqttClient, &openEVSEClient)
 	accessories := rvHomeKitClient.GetAccessoriesFromOpenHab(things)
@@ -100,6 +163,9 @@ func startService() {
 	if config.Port != "" {
 		hcConfig.Port = config.Port
 	}
+	if config.DataDir != "" {
+		hcConfig.StoragePath = filepath.Join(config.DataDir, config.BridgeName)
+	}
 	t, err := hc.NewIPTransport(hcConfig, bridge.Accessory, accessories...)
 	if err != nil {
 		log.Panic(err)
@@ -147,6 +213,7 @@ func startService() {
 		<-t.Stop()
 		ticker.Stop()
 		openEVSEClient.Stop()
+		mqttClient.Close()
 		done <- true
 	})
 	t.Start()